@@ -0,0 +1,138 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/backfill"
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/manager"
+)
+
+const backfillUsage = "backfill [group/version/kind] [--page-size n] [--concurrency n] [--state-file path]"
+
+// runBackfill emits an event for every existing object of the configured watches, or of the kind
+// given as an argument, then exits.
+func runBackfill(args []string) error {
+	flags, opts := newCommandFlags("backfill")
+	pageSize := flags.Int64("page-size", 500, "Number of objects listed in each page.")
+	concurrency := flags.Int("concurrency", 16, "Maximum number of events being delivered at once.")
+	stateFile := flags.String("state-file", "dynowatch-backfill.json",
+		"File that records the progress of the backfill, so that it resumes where it stopped if it is "+
+			"interrupted. Set to an empty string to always start from the beginning.")
+	settings, err := parseCommandFlags(flags, opts, args)
+	if err != nil {
+		return err
+	}
+
+	var watches []config.Watch
+	switch flags.NArg() {
+	case 0:
+		watches = settings.Watches
+		if len(watches) == 0 {
+			return errors.New("no watches are configured")
+		}
+	case 1:
+		gvk, err := parseGroupVersionKind(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		watches = []config.Watch{{Name: flags.Arg(0), Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}}
+	default:
+		return errors.New("usage: " + backfillUsage)
+	}
+
+	restConfig, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+	kubeClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	ctx := ctrl.SetupSignalHandler()
+	namespaced := len(settings.WatchNamespaces) > 0
+	if watches, err = manager.DiscoverWatches(ctx, kubeClient, discoveryClient, watches, namespaced); err != nil {
+		return err
+	}
+	if watches, err = manager.ResolveWatches(kubeClient.RESTMapper(), discoveryClient, watches); err != nil {
+		return err
+	}
+	if namespaced {
+		if err := manager.ValidateNamespacedWatches(kubeClient.RESTMapper(), watches); err != nil {
+			return err
+		}
+	}
+	kinds := watchKinds(watches)
+	pipeline, err := newEventsPipeline(ctx, kubeClient, kubeClient, settings.CloudEvents)
+	if err != nil {
+		return err
+	}
+	b := &backfill.Backfill{
+		Reader:      kubeClient,
+		Sender:      pipeline.sender,
+		Source:      settings.CloudEvents.SourceURI,
+		Target:      pipeline.target,
+		PageSize:    *pageSize,
+		Concurrency: *concurrency,
+		StateFile:   *stateFile,
+		Namespaces:  settings.WatchNamespaces,
+	}
+	delivered, err := b.Run(ctx, kinds)
+	setupLog.Info("Backfilled objects", "delivered", delivered)
+	return err
+}
+
+// watchKinds returns the kind of each watch, without duplicates.
+func watchKinds(watches []config.Watch) []schema.GroupVersionKind {
+	kinds := []schema.GroupVersionKind{}
+	seen := map[schema.GroupVersionKind]bool{}
+	for _, watch := range watches {
+		gvk := schema.GroupVersionKind{Group: watch.Group, Version: watch.Version, Kind: watch.Kind}
+		if !seen[gvk] {
+			seen[gvk] = true
+			kinds = append(kinds, gvk)
+		}
+	}
+	return kinds
+}
+
+// parseGroupVersionKind parses a kind in the form group/version/kind, or version/kind for the core
+// API group.
+func parseGroupVersionKind(value string) (schema.GroupVersionKind, error) {
+	parts := strings.Split(value, "/")
+	switch {
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return schema.GroupVersionKind{Version: parts[0], Kind: parts[1]}, nil
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "":
+		return schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}, nil
+	default:
+		return schema.GroupVersionKind{}, fmt.Errorf("kind %q must be group/version/kind, or version/kind for core objects", value)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	goflag "flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	flag "github.com/spf13/pflag"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// command is a dynowatch subcommand. Running dynowatch without a subcommand starts the manager.
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"backfill": {
+		usage:       backfillUsage,
+		description: "Send an event for every existing object once, then exit",
+		run:         runBackfill,
+	},
+	"config": {
+		usage:       configUsage,
+		description: "Validate the configuration, or print the effective configuration or its JSON Schema",
+		run:         runConfig,
+	},
+	"dead-letter": {
+		usage:       deadLetterUsage,
+		description: "Send dead-lettered events to the target again",
+		run:         runDeadLetter,
+	},
+	"rbac": {
+		usage:       rbacUsage,
+		description: "Print the least-privileged ClusterRole and Roles that the configuration needs",
+		run:         runRBAC,
+	},
+}
+
+// runCommand runs the named subcommand and exits.
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		failNow(err, fmt.Sprintf("Command %s failed", name))
+	}
+}
+
+func printUsage() {
+	program := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage:\n  %s [flags]\t\tStart the dynowatch manager\n", program)
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\t%s\n", program, commands[name].usage, commands[name].description)
+	}
+}
+
+// newCommandFlags returns a flag set for a subcommand, with the logging flags bound to it.
+func newCommandFlags(name string) (*flag.FlagSet, *zap.Options) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	opts := &zap.Options{
+		Development: true,
+	}
+	goflags := goflag.NewFlagSet(name, goflag.ContinueOnError)
+	opts.BindFlags(goflags)
+	flags.AddGoFlagSet(goflags)
+	return flags, opts
+}
+
+// parseCommandFlags parses the subcommand flags, sets up logging, then reads and validates the config
+// file.
+func parseCommandFlags(flags *flag.FlagSet, opts *zap.Options, args []string) (*config.DynowatchConfig, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(opts)))
+	if err := appConfig.SafeReadInConfig(); err != nil {
+		return nil, err
+	}
+	secretReader, err := newOptionalKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	appConfig.SetSecretReader(secretReader)
+	return appConfig.Load()
+}
+
+// newOptionalKubeClient returns a client for the current kubeconfig context, or nil if no
+// kubeconfig is available. Subcommands only need a client for some settings, such as sink
+// references and service account tokens.
+func newOptionalKubeClient() (client.Client, error) {
+	restConfig, err := ctrl.GetConfig()
+	if err != nil {
+		setupLog.Info("Kubernetes client is not available", "reason", err.Error())
+		return nil, nil
+	}
+	return client.New(restConfig, client.Options{Scheme: scheme})
+}
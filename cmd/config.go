@@ -0,0 +1,326 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/manager"
+)
+
+const configUsage = "config validate|print|schema [--file path] [--conf-dir path] [--output format] " +
+	"[--cluster] [--service-account namespace/name]"
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// diagnostic is a problem found in the configuration.
+type diagnostic struct {
+	Severity string `json:"severity"`
+	Key      string `json:"key,omitempty"`
+	Message  string `json:"message"`
+}
+
+// runConfig validates the configuration, or prints the effective configuration or its JSON Schema.
+func runConfig(args []string) error {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "print" && args[0] != "schema") {
+		return errors.New("usage: " + configUsage)
+	}
+	action := args[0]
+	if action == "schema" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(config.Schema())
+	}
+	flags, opts := newCommandFlags("config " + action)
+	if err := bindManagerFlags(flags); err != nil {
+		return err
+	}
+	file := flags.String("file", "", "Config file to load. Defaults to dynowatch.yaml in the usual directories.")
+	confDir := flags.String("conf-dir", "",
+		"Directory of additional config files to merge. Defaults to the conf.d directory next to the config file.")
+	output := flags.String("output", "", "Output format: text or json for validate, yaml or json for print.")
+	cluster := flags.Bool("cluster", false,
+		"Also check that the watched kinds are served by the cluster of the current kubeconfig context, and "+
+			"that they can be listed and watched.")
+	serviceAccount := flags.String("service-account", "",
+		"Service account, as namespace/name, whose access to the watched kinds is checked with --cluster. "+
+			"Defaults to the user of the current kubeconfig context.")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(opts)))
+	if *file != "" {
+		appConfig.SetConfigFile(*file)
+	}
+	if *confDir != "" {
+		appConfig.SetConfDir(*confDir)
+	}
+	err := appConfig.SafeReadInConfig()
+
+	if action == "print" {
+		if err != nil {
+			return err
+		}
+		// References are printed instead of their values.
+		return printConfig(os.Stdout, *output, appConfig.AllSettings())
+	}
+	var diagnostics []diagnostic
+	if err != nil {
+		diagnostics = append(diagnostics, diagnostic{Severity: severityError, Message: err.Error()})
+	} else {
+		secretReader, err := newOptionalKubeClient()
+		if err != nil {
+			return err
+		}
+		appConfig.SetSecretReader(secretReader)
+		settings, err := appConfig.Load()
+		diagnostics = append(diagnostics, configDiagnostics(err)...)
+		if err == nil && *cluster {
+			diagnostics = append(diagnostics, clusterDiagnostics(ctrl.SetupSignalHandler(), settings.Watches,
+				settings.WatchNamespaces, *serviceAccount)...)
+		}
+	}
+	if err := printDiagnostics(os.Stdout, *output, diagnostics); err != nil {
+		return err
+	}
+	errorCount := 0
+	for _, d := range diagnostics {
+		if d.Severity == severityError {
+			errorCount++
+		}
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("%d errors found in the configuration", errorCount)
+	}
+	return nil
+}
+
+// configDiagnostics returns a diagnostic for each invalid setting reported by err.
+func configDiagnostics(err error) []diagnostic {
+	if err == nil {
+		return nil
+	}
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		return []diagnostic{{Severity: severityError, Message: err.Error()}}
+	}
+	diagnostics := []diagnostic{}
+	for _, err := range validationErr.Errors {
+		var settingErr *config.SettingError
+		if errors.As(err, &settingErr) {
+			diagnostics = append(diagnostics, diagnostic{Severity: severityError, Key: settingErr.Key,
+				Message: settingErr.Message})
+		} else {
+			diagnostics = append(diagnostics, diagnostic{Severity: severityError, Message: err.Error()})
+		}
+	}
+	return diagnostics
+}
+
+// clusterDiagnostics checks that the kinds of the watches are served by the cluster, and that they
+// can be listed and watched, in the watched namespaces if any.
+func clusterDiagnostics(ctx context.Context, watches []config.Watch, watchNamespaces []string,
+	serviceAccount string) []diagnostic {
+	clusterError := func(err error) []diagnostic {
+		return []diagnostic{{Severity: severityError, Message: err.Error()}}
+	}
+	restConfig, err := ctrl.GetConfig()
+	if err != nil {
+		return clusterError(err)
+	}
+	kubeClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return clusterError(err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return clusterError(err)
+	}
+	namespaced := len(watchNamespaces) > 0
+	if watches, err = manager.DiscoverWatches(ctx, kubeClient, discoveryClient, watches, namespaced); err != nil {
+		return clusterError(err)
+	}
+	mapper := kubeClient.RESTMapper()
+	var resolved, pending []config.Watch
+	if namespaced {
+		// Watches cannot wait for their CustomResourceDefinition without access to the cluster scope.
+		resolved, err = manager.ResolveWatches(mapper, discoveryClient, watches)
+		if err == nil {
+			err = manager.ValidateNamespacedWatches(mapper, resolved)
+		}
+	} else {
+		resolved, pending, err = manager.ResolveWatchesAllowingPending(mapper, discoveryClient, watches)
+	}
+	if err != nil {
+		// Each invalid watch is reported on its own.
+		var joined interface{ Unwrap() []error }
+		if !errors.As(err, &joined) {
+			return clusterError(err)
+		}
+		var diagnostics []diagnostic
+		for _, err := range joined.Unwrap() {
+			diagnostics = append(diagnostics, diagnostic{Severity: severityError, Key: config.ObjectWatchesKey,
+				Message: err.Error()})
+		}
+		return diagnostics
+	}
+
+	var diagnostics []diagnostic
+	for _, watch := range pending {
+		diagnostics = append(diagnostics, diagnostic{Severity: severityWarning, Key: config.ObjectWatchesKey,
+			Message: fmt.Sprintf("watch %q is pending until its CustomResourceDefinition is installed", watch.Name)})
+	}
+	for _, watch := range resolved {
+		gk := schema.GroupKind{Group: watch.Group, Kind: watch.Kind}
+		mapping, err := mapper.RESTMapping(gk, watch.Version)
+		if err != nil {
+			return append(diagnostics, clusterError(err)...)
+		}
+		namespaces := watchNamespaces
+		if !namespaced {
+			namespaces = []string{""}
+		}
+		var denied []string
+		for _, namespace := range namespaces {
+			for _, verb := range []string{"get", "list", "watch"} {
+				allowed, err := accessAllowed(ctx, kubeClient, serviceAccount, authorizationv1.ResourceAttributes{
+					Namespace: namespace,
+					Verb:      verb,
+					Group:     mapping.Resource.Group,
+					Version:   mapping.Resource.Version,
+					Resource:  mapping.Resource.Resource,
+				})
+				if err != nil {
+					return append(diagnostics, clusterError(err)...)
+				}
+				if !allowed && namespace == "" {
+					denied = append(denied, verb)
+				} else if !allowed {
+					denied = append(denied, verb+" in "+namespace)
+				}
+			}
+		}
+		if len(denied) > 0 {
+			diagnostics = append(diagnostics, diagnostic{Severity: severityError, Key: config.ObjectWatchesKey,
+				Message: fmt.Sprintf("watch %q: not allowed to %s %s", watch.Name, strings.Join(denied, ", "),
+					mapping.Resource.GroupResource())})
+		}
+	}
+	return diagnostics
+}
+
+// accessAllowed reports whether the service account, or the current user if it is empty, is
+// allowed to access the resource, in every namespace unless the attributes name one.
+func accessAllowed(ctx context.Context, kubeClient client.Client, serviceAccount string,
+	attributes authorizationv1.ResourceAttributes) (bool, error) {
+	if serviceAccount == "" {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes},
+		}
+		if err := kubeClient.Create(ctx, review); err != nil {
+			return false, err
+		}
+		return review.Status.Allowed, nil
+	}
+	namespace, name, ok := strings.Cut(serviceAccount, "/")
+	if !ok || namespace == "" || name == "" {
+		return false, fmt.Errorf("service account %q must be namespace/name", serviceAccount)
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+			User:               "system:serviceaccount:" + namespace + ":" + name,
+			Groups:             []string{"system:serviceaccounts", "system:serviceaccounts:" + namespace, "system:authenticated"},
+		},
+	}
+	if err := kubeClient.Create(ctx, review); err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
+
+// printDiagnostics writes the diagnostics as text, one per line, or as a JSON document.
+func printDiagnostics(w io.Writer, output string, diagnostics []diagnostic) error {
+	valid := true
+	for _, d := range diagnostics {
+		valid = valid && d.Severity != severityError
+	}
+	switch output {
+	case "", "text":
+		for _, d := range diagnostics {
+			if d.Key != "" {
+				fmt.Fprintf(w, "%s: %s: %s\n", d.Severity, d.Key, d.Message)
+			} else {
+				fmt.Fprintf(w, "%s: %s\n", d.Severity, d.Message)
+			}
+		}
+		if valid {
+			fmt.Fprintln(w, "The configuration is valid")
+		}
+		return nil
+	case "json":
+		if diagnostics == nil {
+			diagnostics = []diagnostic{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Valid       bool         `json:"valid"`
+			Diagnostics []diagnostic `json:"diagnostics"`
+		}{Valid: valid, Diagnostics: diagnostics})
+	default:
+		return fmt.Errorf("output %q must be text or json", output)
+	}
+}
+
+// printConfig writes the settings as YAML or JSON.
+func printConfig(w io.Writer, output string, settings map[string]any) error {
+	var data []byte
+	var err error
+	switch output {
+	case "", "yaml":
+		data, err = yaml.Marshal(settings)
+	case "json":
+		data, err = json.MarshalIndent(settings, "", "  ")
+		data = append(data, '\n')
+	default:
+		return fmt.Errorf("output %q must be yaml or json", output)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
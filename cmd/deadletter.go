@@ -0,0 +1,70 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/kubearchive/dynowatch/internal/delivery"
+)
+
+const deadLetterUsage = "dead-letter redrive [--file path]"
+
+// runDeadLetter re-drives the events in the dead-letter file to the configured target. Only
+// dead-letter sinks of type file can be re-driven.
+func runDeadLetter(args []string) error {
+	if len(args) == 0 || args[0] != "redrive" {
+		return errors.New("usage: " + deadLetterUsage)
+	}
+	flags, opts := newCommandFlags("dead-letter redrive")
+	file := flags.String("file", "", "Dead-letter file to re-drive. Defaults to cloud-events.dead-letter.file.")
+	settings, err := parseCommandFlags(flags, opts, args[1:])
+	if err != nil {
+		return err
+	}
+	if *file == "" {
+		deadLetter := settings.CloudEvents.DeadLetter
+		if deadLetter == nil || deadLetter.File == "" {
+			return errors.New("no dead-letter file is configured")
+		}
+		*file = deadLetter.File
+	}
+
+	kubeClient, err := newOptionalKubeClient()
+	if err != nil {
+		return err
+	}
+	ctx := ctrl.SetupSignalHandler()
+	pipeline, err := newEventsPipeline(ctx, kubeClient, kubeClient, settings.CloudEvents)
+	if err != nil {
+		return err
+	}
+	sender := pipeline.sender
+	// Events that fail again are written back to the file instead of the dead-letter sink.
+	if deadLetter, ok := sender.(*delivery.DeadLetter); ok {
+		sender = deadLetter.Sender
+	}
+	delivered, failed, err := delivery.Redrive(ctx, *file, sender)
+	setupLog.Info("Re-drove dead-lettered events", "file", *file, "delivered", delivered, "failed", failed)
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d events could not be delivered", failed)
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/delivery"
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	targetSinkName     = "target"
+	deadLetterSinkName = "dead-letter"
+)
+
+// eventsPipeline delivers events to the configured target, applying the configured delivery
+// policies.
+type eventsPipeline struct {
+	// sender delivers events with all delivery policies applied.
+	sender sink.Sender
+	// target is the resolved address of the target.
+	target string
+	// breakers are the circuit breakers of the target and dead-letter sinks.
+	breakers []*delivery.CircuitBreaker
+	// targetClient and deadLetterClient deliver events over HTTP to the target and dead-letter
+	// sinks, and are replaced by reload. deadLetterClient is nil unless the dead-letter sink
+	// delivers over HTTP.
+	targetClient     *sink.Reloadable
+	deadLetterClient *sink.Reloadable
+
+	mu sync.Mutex
+	// batches are the batch senders of the target and dead-letter sinks.
+	batches []*sink.BatchSender
+}
+
+// reloadableKeys are the settings that reload applies while the manager runs. A change to any
+// other setting read from a reference is only applied on restart.
+var reloadableKeys = []string{
+	config.CloudEventsTargetAddressKey,
+	config.CloudEventsSinkRefKey,
+	config.CloudEventsAuthKey,
+	config.CloudEventsOverridesKey,
+	config.CloudEventsDeadLetterKey + ".target-address",
+	config.CloudEventsDeadLetterKey + ".sink-ref",
+	config.CloudEventsDeadLetterKey + ".auth",
+}
+
+// isReloadable reports whether reload applies the setting at key.
+func isReloadable(key string) bool {
+	for _, reloadable := range reloadableKeys {
+		if key == reloadable || strings.HasPrefix(key, reloadable+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryPolicy is the retry, timeout and circuit breaker configuration of a sink.
+type deliveryPolicy struct {
+	retry     *config.RetryConfig
+	timeout   time.Duration
+	breaker   *config.CircuitBreakerConfig
+	rateLimit *config.RateLimitConfig
+}
+
+// apply layers the delivery policy in front of sender. Each attempt made by the retry policy is
+// subject to the circuit breaker, rate limit and timeout.
+func (p deliveryPolicy) apply(name string, sender sink.Sender) (sink.Sender, *delivery.CircuitBreaker) {
+	if p.timeout > 0 {
+		sender = &delivery.Timeout{Sender: sender, Timeout: p.timeout}
+	}
+	if p.rateLimit != nil {
+		sender = &delivery.RateLimit{
+			Sender:  sender,
+			Name:    name,
+			Limiter: delivery.NewLimiter(p.rateLimit.EventsPerSecond, p.rateLimit.Burst),
+		}
+	}
+	var breaker *delivery.CircuitBreaker
+	if p.breaker != nil {
+		breaker = &delivery.CircuitBreaker{
+			Sender:           sender,
+			Name:             name,
+			FailureThreshold: p.breaker.FailureThreshold,
+			OpenDuration:     p.breaker.OpenDuration,
+		}
+		sender = breaker
+	}
+	if p.retry != nil {
+		sender = &delivery.Retry{
+			Sender:         sender,
+			Name:           name,
+			MaxAttempts:    p.retry.MaxAttempts,
+			InitialBackoff: p.retry.InitialBackoff,
+			MaxBackoff:     p.retry.MaxBackoff,
+			Jitter:         p.retry.Jitter,
+		}
+	}
+	return sender, breaker
+}
+
+// newEventsPipeline sets up delivery of events to the configured target, and to the dead-letter
+// sink if one is configured.
+func newEventsPipeline(ctx context.Context, reader client.Reader, kubeClient client.Client,
+	events config.CloudEventConfig) (*eventsPipeline, error) {
+	pipeline := &eventsPipeline{}
+	targetClient, err := pipeline.newTargetClient(ctx, reader, kubeClient, events)
+	if err != nil {
+		return nil, err
+	}
+	pipeline.target = targetClient.Address
+	pipeline.targetClient = sink.NewReloadable(targetClient)
+	policy := deliveryPolicy{
+		retry:     events.Retry,
+		timeout:   events.Timeout,
+		breaker:   events.CircuitBreaker,
+		rateLimit: events.RateLimit,
+	}
+	deadLetter := events.DeadLetter
+	if policy.retry == nil && deadLetter != nil {
+		policy.retry = &config.RetryConfig{MaxAttempts: delivery.DefaultMaxAttempts}
+	}
+
+	sender, breaker := policy.apply(targetSinkName, pipeline.targetClient)
+	pipeline.addBreaker(breaker)
+	if deadLetter != nil {
+		deadLetterSender, err := pipeline.newDeadLetterSender(ctx, reader, kubeClient, deadLetter, events.Overrides)
+		if err != nil {
+			return nil, err
+		}
+		deadLetterPolicy := deliveryPolicy{
+			retry:     deadLetter.Retry,
+			timeout:   deadLetter.Timeout,
+			breaker:   deadLetter.CircuitBreaker,
+			rateLimit: deadLetter.RateLimit,
+		}
+		deadLetterSender, breaker = deadLetterPolicy.apply(deadLetterSinkName, deadLetterSender)
+		pipeline.addBreaker(breaker)
+		sender = &delivery.DeadLetter{Sender: sender, DeadLetter: deadLetterSender}
+	}
+	pipeline.sender = sender
+	return pipeline, nil
+}
+
+func (p *eventsPipeline) addBreaker(breaker *delivery.CircuitBreaker) {
+	if breaker != nil {
+		p.breakers = append(p.breakers, breaker)
+	}
+}
+
+func (p *eventsPipeline) newDeadLetterSender(ctx context.Context, reader client.Reader, kubeClient client.Client,
+	cfg *config.DeadLetterConfig, overrides *config.CloudEventOverrides) (sink.Sender, error) {
+	set := 0
+	for _, isSet := range []bool{cfg.File != "", cfg.TargetAddress != "", cfg.SinkRef != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("dead-letter requires exactly one of file, target-address, or sink-ref")
+	}
+	if cfg.File != "" {
+		return sink.NewFileSender(cfg.File)
+	}
+	deadLetterClient, err := p.newDeadLetterClient(ctx, reader, kubeClient, cfg, overrides)
+	if err != nil {
+		return nil, err
+	}
+	p.deadLetterClient = sink.NewReloadable(deadLetterClient)
+	return p.deadLetterClient, nil
+}
+
+// newTargetClient returns a Sender that delivers events over HTTP to the resolved address of the
+// target.
+func (p *eventsPipeline) newTargetClient(ctx context.Context, reader client.Reader, kubeClient client.Client,
+	events config.CloudEventConfig) (*sink.Target, error) {
+	target, err := sink.ResolveTarget(ctx, reader, events.TargetAddress, events.SinkRef)
+	if err != nil {
+		return nil, err
+	}
+	if events.SinkRef != nil {
+		setupLog.Info("Resolved sink reference", "kind", events.SinkRef.Kind, "name", events.SinkRef.Name,
+			"address", target)
+	}
+	httpSender, err := p.newHTTPSender(events.Auth, events.Overrides, kubeClient, events.Batch, events.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &sink.Target{Sender: httpSender, Address: target}, nil
+}
+
+// newDeadLetterClient returns a Sender that delivers events over HTTP to the resolved address of
+// the dead-letter sink.
+func (p *eventsPipeline) newDeadLetterClient(ctx context.Context, reader client.Reader, kubeClient client.Client,
+	cfg *config.DeadLetterConfig, overrides *config.CloudEventOverrides) (*sink.Target, error) {
+	target, err := sink.ResolveTarget(ctx, reader, cfg.TargetAddress, cfg.SinkRef)
+	if err != nil {
+		return nil, err
+	}
+	httpSender, err := p.newHTTPSender(cfg.Auth, overrides, kubeClient, cfg.Batch, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &sink.Target{Sender: httpSender, Address: target}, nil
+}
+
+// reload applies the settings of events that are read from a reference: the addresses,
+// credentials, TLS settings, and overrides of the target and dead-letter sinks. Their HTTP senders
+// are only replaced once all of them are created, so that nothing changes if any setting cannot
+// be applied.
+func (p *eventsPipeline) reload(ctx context.Context, reader client.Reader, kubeClient client.Client,
+	events config.CloudEventConfig) error {
+	targetClient, err := p.newTargetClient(ctx, reader, kubeClient, events)
+	if err != nil {
+		return err
+	}
+	var deadLetterClient *sink.Target
+	if p.deadLetterClient != nil && events.DeadLetter != nil {
+		deadLetterClient, err = p.newDeadLetterClient(ctx, reader, kubeClient, events.DeadLetter, events.Overrides)
+		if err != nil {
+			return err
+		}
+	}
+	p.targetClient.Reload(targetClient)
+	if deadLetterClient != nil {
+		p.deadLetterClient.Reload(deadLetterClient)
+	}
+	return nil
+}
+
+// newHTTPSender returns a Sender that delivers events over HTTP. If batch is set, events are sent
+// in batches, and each batch request is bounded by timeout.
+func (p *eventsPipeline) newHTTPSender(auth *config.AuthConfig, overrides *config.CloudEventOverrides, kubeClient client.Client,
+	batch *config.BatchConfig, timeout time.Duration) (sink.Sender, error) {
+	if batch == nil {
+		return sink.NewHTTPClient(auth, overrides, kubeClient)
+	}
+	batchSender, err := sink.NewHTTPBatchSender(batch, auth, overrides, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	batchSender.Timeout = timeout
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.batches = append(p.batches, batchSender)
+	return batchSender, nil
+}
+
+// flush sends the open batches right away, instead of waiting for them to fill up or for their
+// max delay, so that they are delivered while draining. This includes the batch senders replaced by
+// reload, whose last batches may still be open.
+func (p *eventsPipeline) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, batch := range p.batches {
+		batch.Flush()
+	}
+}
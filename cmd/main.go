@@ -17,10 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	goflag "flag"
 	"os"
+	"strings"
+	"time"
 
-	cloudevents "github.com/cloudevents/sdk-go/v2"
 	flag "github.com/spf13/pflag"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -30,12 +33,15 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/delivery"
 	"github.com/kubearchive/dynowatch/internal/manager"
+	"github.com/kubearchive/dynowatch/internal/outbox"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -54,29 +60,14 @@ func init() {
 }
 
 func main() {
-
-	flag.String("metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
-	if err := appConfig.BindPFlag(config.MetricsBindAddressKey, flag.Lookup("metrics-bind-address")); err != nil {
-		failNow(err, "Binding flag metrics-bind-address")
-	}
-	flag.String("health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	if err := appConfig.BindPFlag(config.HealthzBindAddressKey, flag.Lookup("health-probe-bind-address")); err != nil {
-		failNow(err, "Binding flag health-probe-binding-address")
-	}
-	flag.Bool("leader-elect", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
-	if err := appConfig.BindPFlag(config.LeaderElectionKey, flag.Lookup("leader-elect")); err != nil {
-		failNow(err, "Binding flag leader-elect")
-	}
-	flag.String("events-source-uri-ref", "locahost",
-		"Source of the CloudEvent as a URI reference. The source plus ID of a CloudEvent should be uniquely identifiable.")
-	if err := appConfig.BindPFlag(config.CloudEventsSourceURIKey, flag.Lookup("events-source-uri-ref")); err != nil {
-		failNow(err, "Binding flag vents-source-uri-ref")
+	defer runAtExit()
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runCommand(os.Args[1], os.Args[2:])
+		return
 	}
-	flag.String("events-target-address", "http://localhost:8082", "The target address to send CloudEvents to.")
-	if err := appConfig.BindPFlag(config.CloudEventsTargetAddressKey, flag.Lookup("events-target-address")); err != nil {
-		failNow(err, "Binding flag events-target-address")
+
+	if err := bindManagerFlags(flag.CommandLine); err != nil {
+		failNow(err, "Binding flags")
 	}
 	opts := &zap.Options{
 		Development: true,
@@ -85,26 +76,51 @@ func main() {
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
 	flag.Parse()
 
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(opts)))
+
 	if err := appConfig.SafeReadInConfig(); err != nil {
 		failNow(err, "Failed to read config")
 	}
+	secretReader, err := newOptionalKubeClient()
+	if err != nil {
+		failNow(err, "Unable to create Kubernetes client")
+	}
+	appConfig.SetSecretReader(secretReader)
+	settings, err := appConfig.Load()
+	if err != nil {
+		failNow(err, "Invalid config")
+	}
 
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(opts)))
-
+	// Settings read from a reference, such as a Secret, are never logged.
 	setupLog.Info("Starting dynowatch controller manager")
 	setupLog.Info("Configuration data",
-		config.MetricsBindAddressKey, appConfig.GetString(config.MetricsBindAddressKey),
-		config.HealthzBindAddressKey, appConfig.GetString(config.HealthzBindAddressKey),
-		config.LeaderElectionKey, appConfig.GetBool(config.LeaderElectionKey),
-		config.CloudEventsSourceURIKey, appConfig.GetString(config.CloudEventsSourceURIKey),
-		config.CloudEventsTargetAddressKey, appConfig.GetString(config.CloudEventsTargetAddressKey))
+		config.MetricsBindAddressKey, appConfig.Redact(config.MetricsBindAddressKey, settings.Metrics.BindAddress),
+		config.HealthzBindAddressKey, appConfig.Redact(config.HealthzBindAddressKey, settings.Healthz.BindAddress),
+		config.LeaderElectionKey, settings.LeaderElection,
+		config.CloudEventsSourceURIKey, appConfig.Redact(config.CloudEventsSourceURIKey, settings.CloudEvents.SourceURI),
+		config.CloudEventsTargetAddressKey,
+		appConfig.Redact(config.CloudEventsTargetAddressKey, settings.CloudEvents.TargetAddress),
+		config.WatchNamespacesKey, settings.WatchNamespaces)
 
+	drainTimeout := settings.DrainTimeout
+	// Restricting the cache to the watched namespaces lets the controllers run with namespaced Roles.
+	cacheOptions := cache.Options{}
+	if len(settings.WatchNamespaces) > 0 {
+		cacheOptions.DefaultNamespaces = map[string]cache.Config{}
+		for _, namespace := range settings.WatchNamespaces {
+			cacheOptions.DefaultNamespaces[namespace] = cache.Config{}
+		}
+	}
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
-		Metrics:                metricsserver.Options{BindAddress: appConfig.GetString(config.MetricsBindAddressKey)},
-		HealthProbeBindAddress: appConfig.GetString(config.HealthzBindAddressKey),
-		LeaderElection:         appConfig.GetBool(config.LeaderElectionKey),
+		Cache:                  cacheOptions,
+		Metrics:                metricsserver.Options{BindAddress: settings.Metrics.BindAddress},
+		HealthProbeBindAddress: settings.Healthz.BindAddress,
+		LeaderElection:         settings.LeaderElection,
 		LeaderElectionID:       "fc6a04ff.kubearchive.io",
+		// Controllers finish the reconciles in progress when the manager stops, so that events
+		// being delivered are not abandoned.
+		GracefulShutdownTimeout: &drainTimeout,
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -121,24 +137,85 @@ func main() {
 		failNow(err, "Unable to start manager")
 	}
 
-	protocol, err := cloudevents.NewHTTP()
-	if err != nil {
-		failNow(err, "Unable to set up cloudevents protocol")
-	}
-	eventsClient, err := cloudevents.NewClient(protocol, cloudevents.WithTimeNow(), cloudevents.WithUUIDs())
+	ctx, stop := context.WithCancel(ctrl.SetupSignalHandler())
+	defer stop()
+	pipeline, err := newEventsPipeline(ctx, mgr.GetAPIReader(), mgr.GetClient(), settings.CloudEvents)
 	if err != nil {
 		failNow(err, "Unable to set up cloudevents client")
 	}
+	shutdownStarted := make(chan time.Time, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownStarted <- time.Now()
+		pipeline.flush()
+	}()
 
-	// TODO: Refactor this to its own internal package
-	watches, err := appConfig.GetWatches()
-	if err != nil {
-		failNow(err, "Unable to get watched objects")
+	// Changes to the settings of the events pipeline read from a reference are applied while the
+	// manager runs. Other settings are only read on start, so a change to them stops the manager, and
+	// the process exits once the events are drained, so that its container is restarted.
+	referencesChanged := make(chan []string, 1)
+	go appConfig.WatchReferences(ctx, settings.ReferenceRefreshInterval, func(keys []string) {
+		var restart []string
+		for _, key := range keys {
+			if !isReloadable(key) {
+				restart = append(restart, key)
+			}
+		}
+		if len(restart) > 0 {
+			setupLog.Info("Settings read from a reference changed, stopping to apply them on restart", "settings", restart)
+			select {
+			case referencesChanged <- restart:
+			default:
+			}
+			stop()
+			return
+		}
+		reloaded, err := appConfig.Load()
+		if err == nil {
+			err = pipeline.reload(ctx, mgr.GetAPIReader(), mgr.GetClient(), reloaded.CloudEvents)
+		}
+		if err != nil {
+			setupLog.Error(err, "Unable to apply the settings read from a reference, keeping the previous values",
+				"settings", keys)
+			return
+		}
+		setupLog.Info("Applied the settings read from a reference", "settings", keys)
+	})
+
+	eventsSender := pipeline.sender
+	var eventsOutbox *outbox.Outbox
+	if outboxConfig := settings.Outbox; outboxConfig != nil && outboxConfig.Path != "" {
+		eventsOutbox, err = outbox.Open(outboxConfig.Path, pipeline.sender, outboxConfig.MaxBackoff)
+		if err != nil {
+			failNow(err, "Unable to open outbox")
+		}
+		eventsOutbox.MaxAttempts = outboxConfig.MaxAttempts
+		atExit(func() {
+			if err := eventsOutbox.Close(); err != nil {
+				setupLog.Error(err, "Failed to close outbox")
+			}
+		})
+		if err := mgr.Add(eventsOutbox); err != nil {
+			failNow(err, "Unable to set up outbox dispatcher")
+		}
+		eventsSender = eventsOutbox
+		setupLog.Info("Delivering events through outbox", "path", outboxConfig.Path)
+	}
+	if settings.CloudEvents.Ordering == config.OrderingPerObject {
+		eventsSender = &delivery.Ordered{Sender: eventsSender}
+		setupLog.Info("Delivering events in order for each object")
 	}
 
-	if err := manager.SetupControllers(mgr, eventsClient, watches,
-		appConfig.GetString(config.CloudEventsSourceURIKey),
-		appConfig.GetString(config.CloudEventsTargetAddressKey)); err != nil {
+	graceful := &delivery.Graceful{Sender: eventsSender}
+	if err := manager.SetupControllers(mgr, manager.Options{
+		Sender:            graceful,
+		EventsSource:      settings.CloudEvents.SourceURI,
+		EventsTarget:      pipeline.target,
+		Watches:           settings.Watches,
+		Checkpoint:        settings.Checkpoint,
+		DiscoveryInterval: settings.DiscoveryInterval,
+		WatchNamespaces:   settings.WatchNamespaces,
+	}); err != nil {
 		failNow(err, "Unable to create controllers")
 	}
 
@@ -150,14 +227,102 @@ func main() {
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		failNow(err, "Unable to set up ready check")
 	}
+	for _, breaker := range pipeline.breakers {
+		if err := mgr.AddReadyzCheck(breaker.Name+"-circuit-breaker", breaker.Check); err != nil {
+			failNow(err, "Unable to set up circuit breaker ready check")
+		}
+	}
 
 	setupLog.Info("Starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctx)
+	drainEvents(shutdownStarted, drainTimeout, graceful, eventsOutbox)
+	if err != nil {
 		failNow(err, "Problem running manager")
 	}
+	select {
+	case keys := <-referencesChanged:
+		setupLog.Info("Exiting to apply the settings read from a reference on restart", "settings", keys)
+	default:
+	}
+}
+
+// bindManagerFlags defines the flags of the manager that override settings of the config file, and
+// binds them to the config.
+func bindManagerFlags(flags *flag.FlagSet) error {
+	flags.String("metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
+	if err := appConfig.BindPFlag(config.MetricsBindAddressKey, flags.Lookup("metrics-bind-address")); err != nil {
+		return err
+	}
+	flags.String("health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	if err := appConfig.BindPFlag(config.HealthzBindAddressKey, flags.Lookup("health-probe-bind-address")); err != nil {
+		return err
+	}
+	flags.Bool("leader-elect", false,
+		"Enable leader election for controller manager. "+
+			"Enabling this will ensure there is only one active controller manager.")
+	if err := appConfig.BindPFlag(config.LeaderElectionKey, flags.Lookup("leader-elect")); err != nil {
+		return err
+	}
+	flags.String("events-source-uri-ref", "locahost",
+		"Source of the CloudEvent as a URI reference. The source plus ID of a CloudEvent should be uniquely identifiable.")
+	if err := appConfig.BindPFlag(config.CloudEventsSourceURIKey, flags.Lookup("events-source-uri-ref")); err != nil {
+		return err
+	}
+	flags.String("events-target-address", "http://localhost:8082", "The target address to send CloudEvents to.")
+	if err := appConfig.BindPFlag(config.CloudEventsTargetAddressKey, flags.Lookup("events-target-address")); err != nil {
+		return err
+	}
+	flags.StringSlice("watch-namespace", nil,
+		"Namespace to restrict the watches to, so that only namespaced Roles are needed. Can be repeated. "+
+			"Every namespace is watched if it is not set.")
+	return appConfig.BindPFlag(config.WatchNamespacesKey, flags.Lookup("watch-namespace"))
+}
+
+// drainEvents delivers the events that were in flight when the manager stopped, until drainTimeout
+// has passed since shutdown started. The number of events that could not be delivered is logged.
+// Events in the outbox are delivered when the manager starts again.
+func drainEvents(shutdownStarted <-chan time.Time, drainTimeout time.Duration, graceful *delivery.Graceful,
+	eventsOutbox *outbox.Outbox) {
+	start := time.Now()
+	select {
+	case start = <-shutdownStarted:
+	default:
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(drainTimeout))
+	defer cancel()
+
+	setupLog.Info("Draining event deliveries", "timeout", drainTimeout)
+	dropped := graceful.Drain(ctx)
+	if eventsOutbox != nil {
+		if pending, err := eventsOutbox.Len(); err == nil && pending > 0 {
+			setupLog.Info("Undelivered events remain in the outbox", "events", pending)
+		}
+	}
+	if dropped > 0 {
+		setupLog.Error(errors.New("drain timeout exceeded"), "Dropped undelivered events", "events", dropped)
+		return
+	}
+	setupLog.Info("Drained event deliveries", "dropped", dropped)
+}
+
+// exitFuncs are run before the process exits, including when it exits with failNow, which skips
+// deferred calls.
+var exitFuncs []func()
+
+// atExit registers f to be run before the process exits. Functions run in reverse order.
+func atExit(f func()) {
+	exitFuncs = append(exitFuncs, f)
+}
+
+func runAtExit() {
+	for i := len(exitFuncs) - 1; i >= 0; i-- {
+		exitFuncs[i]()
+	}
+	exitFuncs = nil
 }
 
 func failNow(err error, msg string) {
 	setupLog.Error(err, msg)
+	runAtExit()
 	os.Exit(1)
 }
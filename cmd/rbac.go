@@ -0,0 +1,145 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubearchive/dynowatch/internal/rbac"
+)
+
+const rbacUsage = "rbac generate [--file path] [--conf-dir path] [--api-resources path] [--name name] " +
+	"[--service-account namespace/name] [--watch-namespace namespace]..."
+
+// runRBAC prints the RBAC objects that the configuration needs.
+func runRBAC(args []string) error {
+	if len(args) == 0 || args[0] != "generate" {
+		return errors.New("usage: " + rbacUsage)
+	}
+	flags, opts := newCommandFlags("rbac generate")
+	if err := bindManagerFlags(flags); err != nil {
+		return err
+	}
+	file := flags.String("file", "", "Config file to load. Defaults to dynowatch.yaml in the usual directories.")
+	confDir := flags.String("conf-dir", "",
+		"Directory of additional config files to merge. Defaults to the conf.d directory next to the config file.")
+	apiResources := flags.String("api-resources", "",
+		"Output of kubectl api-resources -o wide to resolve the watched kinds with, instead of the cluster of the "+
+			"current kubeconfig context.")
+	name := flags.String("name", "dynowatch-manager-role", "Name of the generated roles and bindings.")
+	serviceAccount := flags.String("service-account", "dynowatch-system/dynowatch-controller-manager",
+		"Service account, as namespace/name, that dynowatch runs as. Settings without a namespace default to "+
+			"its namespace.")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(opts)))
+	saNamespace, saName, ok := strings.Cut(*serviceAccount, "/")
+	if !ok || saNamespace == "" || saName == "" {
+		return fmt.Errorf("service account %q must be namespace/name", *serviceAccount)
+	}
+	if *file != "" {
+		appConfig.SetConfigFile(*file)
+	}
+	if *confDir != "" {
+		appConfig.SetConfDir(*confDir)
+	}
+	if err := appConfig.SafeReadInConfig(); err != nil {
+		return err
+	}
+	// Only the Secrets that settings are read from matter, not their values.
+	appConfig.SkipReferences()
+	settings, err := appConfig.Load()
+	if err != nil {
+		return err
+	}
+
+	generator := &rbac.Generator{
+		Name:            *name,
+		ServiceAccount:  types.NamespacedName{Namespace: saNamespace, Name: saName},
+		WatchNamespaces: settings.WatchNamespaces,
+	}
+	if *apiResources != "" {
+		f, err := os.Open(*apiResources)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		resources, err := rbac.ParseAPIResources(f)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", *apiResources, err)
+		}
+		generator.Mapper = resources.RESTMapper()
+		generator.Resources = resources
+	} else {
+		restConfig, err := ctrl.GetConfig()
+		if err != nil {
+			return fmt.Errorf("the cluster is required without --api-resources: %w", err)
+		}
+		kubeClient, err := client.New(restConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			return err
+		}
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+		if err != nil {
+			return err
+		}
+		generator.Mapper = kubeClient.RESTMapper()
+		generator.Resources = discoveryClient
+		generator.Reader = kubeClient
+	}
+	objects, err := generator.Generate(ctrl.SetupSignalHandler(), settings, appConfig.SecretReferences())
+	if err != nil {
+		return err
+	}
+	return printObjects(os.Stdout, objects)
+}
+
+// printObjects writes the objects as a multi-document YAML stream.
+func printObjects(w io.Writer, objects []client.Object) error {
+	for i, obj := range objects {
+		content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+		if err != nil {
+			return err
+		}
+		unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+		data, err := yaml.Marshal(content)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(w, "---")
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
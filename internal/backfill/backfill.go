@@ -0,0 +1,280 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/controller"
+	"github.com/kubearchive/dynowatch/internal/delivery"
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	defaultPageSize    = 500
+	defaultConcurrency = 16
+)
+
+var log = ctrl.Log.WithName("backfill")
+
+// progress is how far the backfill of a kind has got.
+type progress struct {
+	// Continue is the continue token of the next page to list.
+	Continue string `json:"continue,omitempty"`
+	// Objects is the number of objects emitted so far.
+	Objects int  `json:"objects"`
+	Done    bool `json:"done,omitempty"`
+}
+
+// Backfill emits an event for every existing object of the given kinds, once. Objects are listed
+// in pages of PageSize, and the events of a page are sent with up to Concurrency events in flight.
+//
+// Once every event of a page is delivered, the continue token of the next page is saved in
+// StateFile. If the backfill is interrupted, running it again resumes from the saved token, so
+// only the events of the page in progress are emitted twice. The state file is removed when the
+// backfill completes. If StateFile is empty, the backfill always starts from the beginning.
+//
+// If Namespaces is set, the objects are listed in each of them instead of across the cluster, so
+// that the backfill only needs namespaced Roles.
+type Backfill struct {
+	Reader      client.Reader
+	Sender      sink.Sender
+	Source      string
+	Target      string
+	PageSize    int64
+	Concurrency int
+	StateFile   string
+	Namespaces  []string
+}
+
+// Run emits the objects of each kind, and returns the number of events delivered.
+func (b *Backfill) Run(ctx context.Context, kinds []schema.GroupVersionKind) (int, error) {
+	state, err := b.loadState()
+	if err != nil {
+		return 0, err
+	}
+	namespaces := b.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	delivered := 0
+	for _, gvk := range kinds {
+		for _, namespace := range namespaces {
+			n, err := b.backfillKind(ctx, gvk, namespace, state)
+			delivered += n
+			if err != nil && namespace != "" {
+				return delivered, fmt.Errorf("backfilling %s in %s: %w", gvk.Kind, namespace, err)
+			}
+			if err != nil {
+				return delivered, fmt.Errorf("backfilling %s: %w", gvk.Kind, err)
+			}
+		}
+	}
+	if b.StateFile != "" {
+		if err := os.Remove(b.StateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+func (b *Backfill) backfillKind(ctx context.Context, gvk schema.GroupVersionKind, namespace string,
+	state map[string]*progress) (int, error) {
+	key := gvk.String()
+	if namespace != "" {
+		key = namespace + "/" + key
+	}
+	log := log.WithValues("kind", gvk.Kind)
+	if namespace != "" {
+		log = log.WithValues("namespace", namespace)
+	}
+	p := state[key]
+	if p == nil {
+		p = &progress{}
+		state[key] = p
+	}
+	if p.Done {
+		log.Info("Skipping kind already backfilled", "objects", p.Objects)
+		return 0, nil
+	}
+	if p.Continue != "" {
+		log.Info("Resuming backfill", "objects", p.Objects)
+	}
+
+	delivered := 0
+	for {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		opts := []client.ListOption{client.Limit(b.pageSize())}
+		if namespace != "" {
+			opts = append(opts, client.InNamespace(namespace))
+		}
+		if p.Continue != "" {
+			opts = append(opts, client.Continue(p.Continue))
+		}
+		err := b.Reader.List(ctx, list, opts...)
+		if apierrors.IsResourceExpired(err) && p.Continue != "" {
+			// Continue tokens expire after a few minutes. The kind is listed again from the start, so
+			// the objects emitted before are emitted again.
+			log.Info("Continue token expired, listing from the start")
+			p.Continue = ""
+			p.Objects = 0
+			continue
+		}
+		if err != nil {
+			return delivered, err
+		}
+
+		n, err := b.emit(ctx, gvk, list.Items)
+		delivered += n
+		if err != nil {
+			return delivered, err
+		}
+		p.Objects += len(list.Items)
+		p.Continue = list.GetContinue()
+		p.Done = p.Continue == ""
+		if err := b.saveState(state); err != nil {
+			return delivered, err
+		}
+		log.Info("Backfilled page", "objects", p.Objects)
+		if p.Done {
+			return delivered, nil
+		}
+	}
+}
+
+// emit sends an event for each object, and returns the number delivered. If any event is not
+// delivered, the first error is returned once the events in flight return.
+func (b *Backfill) emit(ctx context.Context, gvk schema.GroupVersionKind, items []unstructured.Unstructured) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ctx = cloudevents.ContextWithTarget(ctx, b.Target)
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		delivered int
+		firstErr  error
+	)
+	slots := make(chan struct{}, b.concurrency())
+	for i := range items {
+		item := &items[i]
+		event, err := controller.NewEvent(b.Source, gvk, types.NamespacedName{
+			Namespace: item.GetNamespace(),
+			Name:      item.GetName(),
+		})
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+			break
+		}
+		event.SetExtension(delivery.ObjectUIDExtension, string(item.GetUID()))
+		event.SetExtension(controller.ResourceVersionExtension, item.GetResourceVersion())
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := b.Sender.Send(ctx, event)
+			mu.Lock()
+			defer mu.Unlock()
+			if cloudevents.IsACK(result) {
+				delivered++
+			} else if firstErr == nil {
+				firstErr = result
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return delivered, firstErr
+}
+
+func (b *Backfill) loadState() (map[string]*progress, error) {
+	state := map[string]*progress{}
+	if b.StateFile == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(b.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("reading backfill state %s: %w", b.StateFile, err)
+	}
+	return state, nil
+}
+
+// saveState writes the state to a temporary file, then renames it, so that an interrupted backfill
+// does not leave a partially written state file.
+func (b *Backfill) saveState(state map[string]*progress) error {
+	if b.StateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.StateFile)
+}
+
+func (b *Backfill) pageSize() int64 {
+	if b.PageSize <= 0 {
+		return defaultPageSize
+	}
+	return b.PageSize
+}
+
+func (b *Backfill) concurrency() int {
+	if b.Concurrency <= 0 {
+		return defaultConcurrency
+	}
+	return b.Concurrency
+}
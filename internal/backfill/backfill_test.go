@@ -0,0 +1,174 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/delivery"
+)
+
+var jobGVK = schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+
+// pagedReader lists objects job-0 to job-<count-1>, in pages of the requested limit. Continue
+// tokens are the index of the next object. Tokens in expired return a ResourceExpired error the
+// first time they are used. Objects listed in a namespace have UIDs prefixed with it.
+type pagedReader struct {
+	client.Reader
+	count   int
+	expired map[string]bool
+}
+
+func (r *pagedReader) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if r.expired[listOpts.Continue] {
+		delete(r.expired, listOpts.Continue)
+		return apierrors.NewResourceExpired("continue token expired")
+	}
+	start := 0
+	if listOpts.Continue != "" {
+		start, _ = strconv.Atoi(listOpts.Continue)
+	}
+	end := start + int(listOpts.Limit)
+	if end >= r.count {
+		end = r.count
+	}
+	namespace, uidPrefix := "default", ""
+	if listOpts.Namespace != "" {
+		namespace, uidPrefix = listOpts.Namespace, listOpts.Namespace+"/"
+	}
+	items := list.(*unstructured.UnstructuredList)
+	for i := start; i < end; i++ {
+		item := unstructured.Unstructured{}
+		item.SetGroupVersionKind(jobGVK)
+		item.SetNamespace(namespace)
+		item.SetName(fmt.Sprintf("job-%d", i))
+		item.SetUID(types.UID(fmt.Sprintf("%suid-%d", uidPrefix, i)))
+		items.Items = append(items.Items, item)
+	}
+	if end < r.count {
+		items.SetContinue(strconv.Itoa(end))
+	}
+	return nil
+}
+
+// failingSender NACKs the events of the objects in fail, and records the UIDs of the others.
+type failingSender struct {
+	mu        sync.Mutex
+	fail      map[string]bool
+	delivered []string
+}
+
+func (s *failingSender) Send(_ context.Context, event cloudevents.Event) protocol.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uid, _ := event.Extensions()[delivery.ObjectUIDExtension].(string)
+	if s.fail[uid] {
+		return errors.New("target unavailable")
+	}
+	s.delivered = append(s.delivered, uid)
+	return nil
+}
+
+func TestBackfillResumes(t *testing.T) {
+	o := NewWithT(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	reader := &pagedReader{count: 10}
+	sender := &failingSender{fail: map[string]bool{"uid-5": true}}
+	b := &Backfill{Reader: reader, Sender: sender, PageSize: 4, StateFile: stateFile}
+
+	delivered, err := b.Run(context.Background(), []schema.GroupVersionKind{jobGVK})
+	o.Expect(err).To(MatchError(ContainSubstring("target unavailable")))
+	o.Expect(delivered).To(BeNumerically(">=", 4))
+	state, err := b.loadState()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(state).To(HaveKeyWithValue(jobGVK.String(), &progress{Continue: "4", Objects: 4}),
+		"the state points to the page that failed")
+
+	sender = &failingSender{}
+	b.Sender = sender
+	delivered, err = b.Run(context.Background(), []schema.GroupVersionKind{jobGVK})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(delivered).To(Equal(6))
+	o.Expect(sender.delivered).To(ConsistOf("uid-4", "uid-5", "uid-6", "uid-7", "uid-8", "uid-9"))
+	_, err = os.Stat(stateFile)
+	o.Expect(os.IsNotExist(err)).To(BeTrue(), "the state file is removed once the backfill completes")
+}
+
+func TestBackfillExpiredContinue(t *testing.T) {
+	o := NewWithT(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	o.Expect(os.WriteFile(stateFile, []byte(`{"batch/v1, Kind=Job":{"continue":"4","objects":4}}`), 0o600)).To(Succeed())
+	sender := &failingSender{}
+	b := &Backfill{
+		Reader:    &pagedReader{count: 6, expired: map[string]bool{"4": true}},
+		Sender:    sender,
+		PageSize:  4,
+		StateFile: stateFile,
+	}
+
+	delivered, err := b.Run(context.Background(), []schema.GroupVersionKind{jobGVK})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(delivered).To(Equal(6), "the kind is listed again from the start")
+}
+
+func TestBackfillNamespaces(t *testing.T) {
+	o := NewWithT(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	sender := &failingSender{fail: map[string]bool{"team-b/uid-1": true}}
+	b := &Backfill{
+		Reader:     &pagedReader{count: 2},
+		Sender:     sender,
+		PageSize:   1,
+		StateFile:  stateFile,
+		Namespaces: []string{"team-a", "team-b"},
+	}
+
+	_, err := b.Run(context.Background(), []schema.GroupVersionKind{jobGVK})
+	o.Expect(err).To(MatchError(ContainSubstring("backfilling Job in team-b")))
+	o.Expect(sender.delivered).To(ConsistOf("team-a/uid-0", "team-a/uid-1", "team-b/uid-0"))
+	state, err := b.loadState()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(state).To(HaveKeyWithValue("team-a/"+jobGVK.String(), &progress{Done: true, Objects: 2}))
+	o.Expect(state).To(HaveKeyWithValue("team-b/"+jobGVK.String(), &progress{Continue: "1", Objects: 1}),
+		"each namespace resumes from its own page")
+
+	sender = &failingSender{}
+	b.Sender = sender
+	delivered, err := b.Run(context.Background(), []schema.GroupVersionKind{jobGVK})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(delivered).To(Equal(1))
+	o.Expect(sender.delivered).To(ConsistOf("team-b/uid-1"))
+}
@@ -0,0 +1,422 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkpoint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	dataKey         = "checkpoint.json.gz"
+	shardsKey       = "shards"
+	defaultInterval = 10 * time.Second
+	// maxShards bounds the number of ConfigMaps of a checkpoint.
+	maxShards = 64
+)
+
+// maxShardBytes keeps each ConfigMap well below the 1 MiB size limit of Kubernetes objects.
+var maxShardBytes = 768 << 10
+
+var log = ctrl.Log.WithName("checkpoint")
+
+// Checkpoints are only written in the namespace of dynowatch. Other namespaces need the Role printed
+// by `rbac generate`.
+//+kubebuilder:rbac:groups="",namespace=system,resources=configmaps,verbs=get;create;update
+
+// Entry is the last delivered state of an object.
+type Entry struct {
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// Checkpoint records the resourceVersion of the last event delivered for each object of a watch,
+// by UID. It is persisted in a ConfigMap, so that objects whose state was already delivered are
+// not emitted again after a restart, and objects deleted while Dynowatch was down can be detected.
+//
+// Objects are spread by UID over as many ConfigMaps as needed to keep each of them within the size
+// limit of a Kubernetes object. The first one is named Name and records the number of shards, the
+// others are named Name-1, Name-2, and so on.
+//
+// The checkpoint is loaded when Start is called, and saved every Interval and when Start returns.
+// Start must only run on the leader, so that a single instance writes the ConfigMap. The ConfigMap
+// is read with Reader, which should not be backed by the cache, and written with Client.
+type Checkpoint struct {
+	Client    client.Client
+	Reader    client.Reader
+	Namespace string
+	Name      string
+	Interval  time.Duration
+
+	mu      sync.Mutex
+	entries map[types.UID]Entry
+	uids    map[types.NamespacedName]types.UID
+	loaded  map[types.UID]Entry
+	dirty   bool
+	resumed bool
+	ready   chan struct{}
+	err     error
+	shards  int
+	// saved is the data last written to each shard, by ConfigMap name. It is only used by Save.
+	saved map[string][]byte
+}
+
+// Start loads the checkpoint, then saves it periodically until ctx is cancelled.
+func (c *Checkpoint) Start(ctx context.Context) error {
+	if err := c.load(ctx); err != nil {
+		c.fail(err)
+		return err
+	}
+	ticker := time.NewTicker(c.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			return c.Save(saveCtx)
+		case <-ticker.C:
+			if err := c.Save(ctx); err != nil {
+				log.Error(err, "Failed to save checkpoint", "configMap", c.Name)
+			}
+		}
+	}
+}
+
+// Wait blocks until the checkpoint is loaded, or ctx is done. It returns the error of the load, if
+// it failed.
+func (c *Checkpoint) Wait(ctx context.Context) error {
+	select {
+	case <-c.readyChan():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Delivered reports whether the state of the object with the given UID and resourceVersion was
+// already delivered.
+func (c *Checkpoint) Delivered(uid types.UID, resourceVersion string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[uid]
+	return ok && entry.ResourceVersion == resourceVersion
+}
+
+// UID returns the UID of the object with the given key, if it is in the checkpoint.
+func (c *Checkpoint) UID(key types.NamespacedName) (types.UID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uid, ok := c.uids[key]
+	return uid, ok
+}
+
+// Loaded reports whether the checkpoint was loaded successfully, without waiting for it.
+func (c *Checkpoint) Loaded() bool {
+	select {
+	case <-c.readyChan():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err == nil
+	default:
+		return false
+	}
+}
+
+// Resumed reports whether the checkpoint was saved by a previous run of the watch. It is only
+// meaningful once the checkpoint is loaded.
+func (c *Checkpoint) Resumed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resumed
+}
+
+// Record records that the state of an object was delivered.
+func (c *Checkpoint) Record(uid types.UID, entry Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[uid] = entry
+	c.uids[types.NamespacedName{Namespace: entry.Namespace, Name: entry.Name}] = uid
+	c.dirty = true
+}
+
+// Remove removes a deleted object from the checkpoint.
+func (c *Checkpoint) Remove(uid types.UID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[uid]
+	if !ok {
+		return
+	}
+	delete(c.entries, uid)
+	key := types.NamespacedName{Namespace: entry.Namespace, Name: entry.Name}
+	if c.uids[key] == uid {
+		delete(c.uids, key)
+	}
+	c.dirty = true
+}
+
+// Missing returns the objects that were in the checkpoint when it was loaded, are still in it, and
+// are not in present. These objects were deleted while the checkpoint was not being updated.
+func (c *Checkpoint) Missing(present map[types.UID]bool) map[types.UID]Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	missing := map[types.UID]Entry{}
+	for uid, entry := range c.loaded {
+		if _, ok := c.entries[uid]; ok && !present[uid] {
+			missing[uid] = entry
+		}
+	}
+	return missing
+}
+
+// Save writes the checkpoint to its ConfigMaps, if it changed since it was last saved. Only the
+// shards whose content changed are written.
+func (c *Checkpoint) Save(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	shards, err := c.encodeShards()
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("saving checkpoint %s/%s: %w", c.Namespace, c.Name, err)
+	}
+
+	if c.saved == nil {
+		c.saved = map[string][]byte{}
+	}
+	// The first shard records the number of shards, so it is written last: a reader never expects a
+	// shard that was not written yet.
+	for i := len(shards) - 1; i >= 0; i-- {
+		name := c.shardName(i)
+		if i > 0 && bytes.Equal(c.saved[name], shards[i]) {
+			continue
+		}
+		if err := c.writeShard(ctx, name, shards[i], i == 0, len(shards)); err != nil {
+			c.mu.Lock()
+			c.dirty = true
+			c.mu.Unlock()
+			return fmt.Errorf("saving checkpoint %s/%s: %w", c.Namespace, name, err)
+		}
+		c.saved[name] = shards[i]
+	}
+	return nil
+}
+
+func (c *Checkpoint) writeShard(ctx context.Context, name string, data []byte, first bool, shards int) error {
+	cm := &corev1.ConfigMap{}
+	err := c.Reader.Get(ctx, types.NamespacedName{Namespace: c.Namespace, Name: name}, cm)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	notFound := err != nil
+	if notFound {
+		cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: c.Namespace, Name: name}}
+	}
+	cm.BinaryData = map[string][]byte{dataKey: data}
+	cm.Data = nil
+	if first {
+		cm.Data = map[string]string{shardsKey: strconv.Itoa(shards)}
+	}
+	if notFound {
+		return c.Client.Create(ctx, cm)
+	}
+	return c.Client.Update(ctx, cm)
+}
+
+// encodeShards encodes the entries in as many shards as needed to keep each of them below
+// maxShardBytes. The number of shards only grows, so that a UID stays in the same shard. c.mu must
+// be held.
+func (c *Checkpoint) encodeShards() ([][]byte, error) {
+	n := c.shards
+	if n == 0 {
+		n = 1
+	}
+	for ; n <= maxShards; n *= 2 {
+		parts := make([]map[types.UID]Entry, n)
+		for i := range parts {
+			parts[i] = map[types.UID]Entry{}
+		}
+		for uid, entry := range c.entries {
+			parts[shardOf(uid, n)][uid] = entry
+		}
+		shards := make([][]byte, n)
+		fits := true
+		for i, part := range parts {
+			data, err := encode(part)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > maxShardBytes {
+				fits = false
+				break
+			}
+			shards[i] = data
+		}
+		if fits {
+			c.shards = n
+			return shards, nil
+		}
+	}
+	return nil, fmt.Errorf("%d objects do not fit in %d ConfigMaps of %d bytes", len(c.entries), maxShards, maxShardBytes)
+}
+
+func (c *Checkpoint) load(ctx context.Context) error {
+	entries := map[types.UID]Entry{}
+	cm := &corev1.ConfigMap{}
+	err := c.Reader.Get(ctx, types.NamespacedName{Namespace: c.Namespace, Name: c.Name}, cm)
+	resumed := err == nil
+	shards := 1
+	saved := map[string][]byte{}
+	switch {
+	case errors.IsNotFound(err):
+	case err != nil:
+		return fmt.Errorf("loading checkpoint %s/%s: %w", c.Namespace, c.Name, err)
+	default:
+		if v, ok := cm.Data[shardsKey]; ok {
+			if shards, err = strconv.Atoi(v); err != nil || shards < 1 {
+				return fmt.Errorf("decoding checkpoint %s/%s: invalid number of shards %q", c.Namespace, c.Name, v)
+			}
+		}
+		for i := 0; i < shards; i++ {
+			name := c.shardName(i)
+			if i > 0 {
+				cm = &corev1.ConfigMap{}
+				if err := c.Reader.Get(ctx, types.NamespacedName{Namespace: c.Namespace, Name: name}, cm); err != nil {
+					return fmt.Errorf("loading checkpoint %s/%s: %w", c.Namespace, name, err)
+				}
+			}
+			part, err := decode(cm.BinaryData[dataKey])
+			if err != nil {
+				return fmt.Errorf("decoding checkpoint %s/%s: %w", c.Namespace, name, err)
+			}
+			for uid, entry := range part {
+				entries[uid] = entry
+			}
+			saved[name] = cm.BinaryData[dataKey]
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = entries
+	c.resumed = resumed
+	c.shards = shards
+	c.saved = saved
+	c.loaded = map[types.UID]Entry{}
+	c.uids = map[types.NamespacedName]types.UID{}
+	for uid, entry := range entries {
+		c.loaded[uid] = entry
+		c.uids[types.NamespacedName{Namespace: entry.Namespace, Name: entry.Name}] = uid
+	}
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	close(c.ready)
+	log.Info("Loaded checkpoint", "configMap", c.Name, "objects", len(entries), "shards", shards)
+	return nil
+}
+
+// fail records that the checkpoint could not be loaded, and unblocks Wait.
+func (c *Checkpoint) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	close(c.ready)
+}
+
+func (c *Checkpoint) shardName(i int) string {
+	if i == 0 {
+		return c.Name
+	}
+	return fmt.Sprintf("%s-%d", c.Name, i)
+}
+
+func shardOf(uid types.UID, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(uid))
+	return int(h.Sum32() % uint32(shards))
+}
+
+func (c *Checkpoint) readyChan() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	return c.ready
+}
+
+func (c *Checkpoint) interval() time.Duration {
+	if c.Interval == 0 {
+		return defaultInterval
+	}
+	return c.Interval
+}
+
+// encode returns the entries as gzip-compressed JSON.
+func encode(entries map[types.UID]Entry) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if err := json.NewEncoder(zw).Encode(entries); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte) (map[types.UID]Entry, error) {
+	entries := map[types.UID]Entry{}
+	if len(data) == 0 {
+		return entries, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	return entries, json.Unmarshal(raw, &entries)
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCheckpoint(t *testing.T) {
+	o := NewWithT(t)
+	kubeClient := fake.NewClientBuilder().Build()
+	newCheckpoint := func() *Checkpoint {
+		return &Checkpoint{
+			Client:    kubeClient,
+			Reader:    kubeClient,
+			Namespace: "dynowatch-system",
+			Name:      "dynowatch-checkpoint-jobs",
+			Interval:  time.Hour,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := newCheckpoint()
+	done := make(chan error)
+	go func() {
+		done <- first.Start(ctx)
+	}()
+	o.Expect(first.Wait(ctx)).To(Succeed())
+	first.Record("uid-1", Entry{Namespace: "default", Name: "job-1", ResourceVersion: "10"})
+	first.Record("uid-2", Entry{Namespace: "default", Name: "job-2", ResourceVersion: "11"})
+	first.Record("uid-3", Entry{Namespace: "default", Name: "job-3", ResourceVersion: "12"})
+	first.Remove("uid-3")
+	o.Expect(first.Delivered("uid-1", "10")).To(BeTrue())
+	o.Expect(first.Delivered("uid-1", "13")).To(BeFalse())
+	cancel()
+	o.Eventually(done).Should(Receive(BeNil()), "checkpoint is saved when stopped")
+
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{Namespace: "dynowatch-system", Name: "dynowatch-checkpoint-jobs"}
+	o.Expect(kubeClient.Get(context.Background(), key, cm)).To(Succeed())
+	o.Expect(cm.BinaryData).To(HaveKey(dataKey))
+
+	second := newCheckpoint()
+	o.Expect(second.load(context.Background())).To(Succeed())
+	o.Expect(second.Delivered("uid-1", "10")).To(BeTrue())
+	o.Expect(second.Delivered("uid-3", "12")).To(BeFalse())
+	uid, ok := second.UID(types.NamespacedName{Namespace: "default", Name: "job-2"})
+	o.Expect(ok).To(BeTrue())
+	o.Expect(uid).To(Equal(types.UID("uid-2")))
+
+	missing := second.Missing(map[types.UID]bool{"uid-1": true})
+	o.Expect(missing).To(Equal(map[types.UID]Entry{
+		"uid-2": {Namespace: "default", Name: "job-2", ResourceVersion: "11"},
+	}))
+	second.Remove("uid-2")
+	o.Expect(second.Missing(map[types.UID]bool{"uid-1": true})).To(BeEmpty())
+
+	second.Record("uid-4", Entry{Namespace: "default", Name: "job-4", ResourceVersion: "14"})
+	o.Expect(second.Save(context.Background())).To(Succeed(), "existing checkpoint is updated")
+	third := newCheckpoint()
+	o.Expect(third.load(context.Background())).To(Succeed())
+	o.Expect(third.Delivered("uid-4", "14")).To(BeTrue())
+	o.Expect(third.Delivered("uid-2", "11")).To(BeFalse())
+}
+
+func TestCheckpointShards(t *testing.T) {
+	o := NewWithT(t)
+	defer func(n int) { maxShardBytes = n }(maxShardBytes)
+	maxShardBytes = 4 << 10
+
+	kubeClient := fake.NewClientBuilder().Build()
+	newCheckpoint := func() *Checkpoint {
+		return &Checkpoint{
+			Client:    kubeClient,
+			Reader:    kubeClient,
+			Namespace: "dynowatch-system",
+			Name:      "dynowatch-checkpoint-jobs",
+		}
+	}
+
+	first := newCheckpoint()
+	o.Expect(first.load(context.Background())).To(Succeed())
+	for i := 0; i < 1000; i++ {
+		first.Record(types.UID(uuid.NewString()), Entry{Namespace: "default", Name: fmt.Sprintf("job-%d", i), ResourceVersion: strconv.Itoa(i)})
+	}
+	o.Expect(first.Save(context.Background())).To(Succeed())
+
+	cm := &corev1.ConfigMap{}
+	key := types.NamespacedName{Namespace: "dynowatch-system", Name: "dynowatch-checkpoint-jobs"}
+	o.Expect(kubeClient.Get(context.Background(), key, cm)).To(Succeed())
+	shards, err := strconv.Atoi(cm.Data[shardsKey])
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(shards).To(BeNumerically(">", 1))
+	for i := 1; i < shards; i++ {
+		key.Name = fmt.Sprintf("dynowatch-checkpoint-jobs-%d", i)
+		o.Expect(kubeClient.Get(context.Background(), key, cm)).To(Succeed())
+		o.Expect(len(cm.BinaryData[dataKey])).To(BeNumerically("<=", maxShardBytes))
+	}
+
+	second := newCheckpoint()
+	o.Expect(second.load(context.Background())).To(Succeed())
+	o.Expect(second.entries).To(Equal(first.entries))
+
+	maxShardBytes = 64
+	second.Record("uid-1", Entry{Namespace: "default", Name: "job-1", ResourceVersion: "1"})
+	o.Expect(second.Save(context.Background())).To(MatchError(ContainSubstring("do not fit in 64 ConfigMaps")))
+}
+
+func TestCheckpointWaitLoadError(t *testing.T) {
+	o := NewWithT(t)
+	kubeClient := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "dynowatch-system", Name: "dynowatch-checkpoint-jobs"},
+		Data:       map[string]string{shardsKey: "2"},
+	}).Build()
+	c := &Checkpoint{Client: kubeClient, Reader: kubeClient, Namespace: "dynowatch-system", Name: "dynowatch-checkpoint-jobs"}
+
+	o.Expect(c.Start(context.Background())).To(MatchError(ContainSubstring("dynowatch-checkpoint-jobs-1")))
+	o.Expect(c.Wait(context.Background())).To(MatchError(ContainSubstring("dynowatch-checkpoint-jobs-1")))
+}
@@ -27,12 +27,16 @@ type EventRecorder struct {
 	recordLock sync.Mutex
 	recording  *atomic.Bool
 	events     []cloudevents.Event
+	failNext   atomic.Int32
+	// failFor is the number of events still to reject for each object name.
+	failFor map[string]int
 }
 
 func NewEventRecorder() *EventRecorder {
 	return &EventRecorder{
 		events:    []cloudevents.Event{},
 		recording: &atomic.Bool{},
+		failFor:   map[string]int{},
 	}
 }
 
@@ -66,3 +70,38 @@ func (e *EventRecorder) Clear() {
 	defer e.recordLock.Unlock()
 	e.events = []cloudevents.Event{}
 }
+
+// takeFailure reports whether the events received in a request should be rejected, consuming one
+// pending failure.
+func (e *EventRecorder) takeFailure(events ...cloudevents.Event) bool {
+	if e.takeFailureFor(events) {
+		return true
+	}
+	for {
+		n := e.failNext.Load()
+		if n <= 0 {
+			return false
+		}
+		if e.failNext.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+// takeFailureFor reports whether one of the events is about an object with pending failures,
+// consuming one of them.
+func (e *EventRecorder) takeFailureFor(events []cloudevents.Event) bool {
+	e.recordLock.Lock()
+	defer e.recordLock.Unlock()
+	for _, event := range events {
+		data := map[string]string{}
+		if err := event.DataAs(&data); err != nil {
+			continue
+		}
+		if name := data["name"]; e.failFor[name] > 0 {
+			e.failFor[name]--
+			return true
+		}
+	}
+	return false
+}
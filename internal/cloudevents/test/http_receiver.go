@@ -18,10 +18,15 @@ package test
 
 import (
 	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
 	"net/http/httptest"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/cloudevents/sdk-go/v2/client"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/go-logr/logr"
 	ctrlLog "sigs.k8s.io/controller-runtime/pkg/log"
 )
@@ -39,7 +44,7 @@ func NewTestReceiver(ctx context.Context) (*TestReceiver, error) {
 	if err != nil {
 		return nil, err
 	}
-	server := httptest.NewUnstartedServer(handler)
+	server := httptest.NewUnstartedServer(newBatchHandler(recorder, handler))
 	return &TestReceiver{
 		Server:        server,
 		eventRecorder: recorder,
@@ -79,6 +84,58 @@ func (r *TestReceiver) GetEvents() []cloudevents.Event {
 	return r.eventRecorder.Events()
 }
 
+// FailNext rejects the next n events or batches received with a 503 Service Unavailable response.
+// Rejected events are not recorded.
+func (r *TestReceiver) FailNext(n int) {
+	r.eventRecorder.failNext.Store(int32(n))
+}
+
+// FailNextFor rejects the next n events about the object with the given name, or batches that
+// contain them, with a 503 Service Unavailable response. Rejected events are not recorded.
+func (r *TestReceiver) FailNextFor(name string, n int) {
+	r.eventRecorder.recordLock.Lock()
+	defer r.eventRecorder.recordLock.Unlock()
+	r.eventRecorder.failFor[name] = n
+}
+
+// PendingFailures returns the number of events that will still be rejected.
+func (r *TestReceiver) PendingFailures() int {
+	r.eventRecorder.recordLock.Lock()
+	defer r.eventRecorder.recordLock.Unlock()
+	pending := int(r.eventRecorder.failNext.Load())
+	for _, n := range r.eventRecorder.failFor {
+		pending += n
+	}
+	return pending
+}
+
+// newBatchHandler returns a handler that accepts batches of events sent with the CloudEvents
+// batch content mode, and passes other requests to next.
+func newBatchHandler(recorder *EventRecorder, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != cloudevents.ApplicationCloudEventsBatchJSON {
+			next.ServeHTTP(w, r)
+			return
+		}
+		events := []cloudevents.Event{}
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if recorder.takeFailure(events...) {
+			log.Info("rejected batch", "events", len(events))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		log.Info("received batch", "events", len(events))
+		for _, event := range events {
+			recorder.Record(event)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
 type eventHandler struct {
 	recorder *EventRecorder
 }
@@ -89,7 +146,12 @@ func newEventHandler(recorder *EventRecorder) *eventHandler {
 	}
 }
 
-func (e *eventHandler) handleEvent(ctx context.Context, event cloudevents.Event) {
+func (e *eventHandler) handleEvent(ctx context.Context, event cloudevents.Event) protocol.Result {
+	if e.recorder.takeFailure(event) {
+		log.Info("rejected event", "event", event)
+		return cehttp.NewResult(http.StatusServiceUnavailable, "rejected by test receiver")
+	}
 	log.Info("received event", "event", event)
 	e.recorder.Record(event)
+	return nil
 }
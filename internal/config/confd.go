@@ -0,0 +1,132 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// confDirName is the name of the directory of additional config files.
+const confDirName = "conf.d"
+
+// SetConfDir sets the directory of additional config files, instead of the conf.d directory next to
+// the config file.
+func (c *Config) SetConfDir(dir string) {
+	c.confDir = dir
+}
+
+// mergeConfDir merges the YAML files of the conf.d directory into the config, in lexical order of
+// their names. Settings of later files take precedence, except for watches, which are added to the
+// watches of the config file and the previous files. A watch whose name is already used is
+// reported as a conflict by Load, and ignored.
+func (c *Config) mergeConfDir() error {
+	c.sourceErrors = nil
+	dir := c.findConfDir()
+	if dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	ymlFiles, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return err
+	}
+	files = append(files, ymlFiles...)
+	sort.Strings(files)
+
+	// The file each watch was set in, by name.
+	sources := map[string]string{}
+	watches, _ := c.Get(ObjectWatchesKey).([]any)
+	for _, watch := range watches {
+		if name := watchName(watch); name != "" {
+			sources[name] = c.ConfigFileUsed()
+		}
+	}
+	for _, file := range files {
+		fileConfig := viper.New()
+		fileConfig.SetConfigFile(file)
+		fileConfig.SetConfigType("yaml")
+		if err := fileConfig.ReadInConfig(); err != nil {
+			return fmt.Errorf("reading %s: %w", file, err)
+		}
+		settings := fileConfig.AllSettings()
+		fileWatches, ok := settings[ObjectWatchesKey].([]any)
+		if !ok && settings[ObjectWatchesKey] != nil {
+			return fmt.Errorf("reading %s: %s must be a list", file, ObjectWatchesKey)
+		}
+		for _, watch := range fileWatches {
+			name := watchName(watch)
+			if source, ok := sources[name]; ok && name != "" {
+				c.sourceErrors = append(c.sourceErrors, &SettingError{
+					Key:     ObjectWatchesKey,
+					Message: fmt.Sprintf("watch %q is set in both %s and %s", name, source, file),
+				})
+				continue
+			}
+			sources[name] = file
+			watches = append(watches, watch)
+		}
+		if len(watches) > 0 {
+			settings[ObjectWatchesKey] = watches
+		}
+		if err := c.MergeConfigMap(settings); err != nil {
+			return fmt.Errorf("merging %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// findConfDir returns the directory of additional config files: the one set with SetConfDir, the
+// conf.d directory next to the config file, or the first conf.d directory in the search paths if no
+// config file was found. It returns an empty string if there is none.
+func (c *Config) findConfDir() string {
+	if c.confDir != "" {
+		return c.confDir
+	}
+	dirs := []string{}
+	if file := c.ConfigFileUsed(); file != "" {
+		dirs = append(dirs, filepath.Dir(file))
+	} else {
+		for _, path := range configPaths {
+			dirs = append(dirs, os.ExpandEnv(path))
+		}
+	}
+	for _, dir := range dirs {
+		dir = filepath.Join(dir, confDirName)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+func watchName(watch any) string {
+	fields, ok := watch.(map[string]any)
+	if !ok {
+		return ""
+	}
+	name, _ := fields["name"].(string)
+	return strings.TrimSpace(name)
+}
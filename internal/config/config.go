@@ -17,20 +17,81 @@ limitations under the License.
 package config
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"os"
+	"reflect"
+	"regexp"
 	"strings"
 	"sync"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
-	MetricsBindAddressKey       = "metrics.bind-address"
-	HealthzBindAddressKey       = "healthz.bind-address"
-	LeaderElectionKey           = "leader-election"
-	CloudEventsSourceURIKey     = "cloud-events.source-uri"
-	CloudEventsTargetAddressKey = "cloud-events.target-address"
-	ObjectWatchesKey            = "watches"
+	MetricsBindAddressKey        = "metrics.bind-address"
+	HealthzBindAddressKey        = "healthz.bind-address"
+	LeaderElectionKey            = "leader-election"
+	CloudEventsSourceURIKey      = "cloud-events.source-uri"
+	CloudEventsTargetAddressKey  = "cloud-events.target-address"
+	CloudEventsSinkRefKey        = "cloud-events.sink-ref"
+	CloudEventsOverridesKey      = "cloud-events.overrides"
+	CloudEventsAuthKey           = "cloud-events.auth"
+	CloudEventsRetryKey          = "cloud-events.retry"
+	CloudEventsTimeoutKey        = "cloud-events.timeout"
+	CloudEventsCircuitBreakerKey = "cloud-events.circuit-breaker"
+	CloudEventsDeadLetterKey     = "cloud-events.dead-letter"
+	CloudEventsOrderingKey       = "cloud-events.ordering"
+	CloudEventsBatchKey          = "cloud-events.batch"
+	CloudEventsRateLimitKey      = "cloud-events.rate-limit"
+	OutboxKey                    = "outbox"
+	DrainTimeoutKey              = "drain-timeout"
+	DiscoveryIntervalKey         = "discovery-interval"
+	ReferenceRefreshIntervalKey  = "reference-refresh-interval"
+	OnForbiddenKey               = "on-forbidden"
+	WatchNamespacesKey           = "watch-namespaces"
+	CheckpointKey                = "checkpoint"
+	ObjectWatchesKey             = "watches"
+)
+
+const (
+	// OrderingNone delivers events as soon as they are emitted, with no ordering guarantee.
+	OrderingNone = "none"
+	// OrderingPerObject delivers the events of each object in the order they were emitted.
+	OrderingPerObject = "per-object"
+
+	// InitialSyncEvents emits an event for each object that exists when a watch starts.
+	InitialSyncEvents = "events"
+	// InitialSyncNone only emits changes made after a watch starts.
+	InitialSyncNone = "none"
+	// InitialSyncSnapshot emits the objects that exist when a watch starts as a snapshot.
+	InitialSyncSnapshot = "snapshot"
+
+	// WildcardKind is the kind of a watch that applies to every kind of its group.
+	WildcardKind = "*"
+
+	// OnForbiddenFail stops dynowatch from starting if a watch is not allowed to access its
+	// resource.
+	OnForbiddenFail = "fail"
+	// OnForbiddenSkip does not start the controller of a watch that is not allowed to access its
+	// resource.
+	OnForbiddenSkip = "skip"
+	// OnForbiddenWait starts the controller of a watch once it is allowed to access its resource.
+	OnForbiddenWait = "wait"
+)
+
+const (
+	// KnativeSinkEnv is the environment variable a Knative SinkBinding uses to inject the resolved
+	// sink URI.
+	KnativeSinkEnv = "K_SINK"
+	// KnativeCEOverridesEnv is the environment variable a Knative SinkBinding uses to inject
+	// CloudEvent overrides, encoded as JSON.
+	KnativeCEOverridesEnv = "K_CE_OVERRIDES"
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 )
 
 // Config is a wrapper around the Viper configuration management system, with additional utility
@@ -39,6 +100,16 @@ type Config struct {
 	*viper.Viper
 	initialized bool
 	initOnce    sync.Once
+	// confDir is the directory of additional config files, which is looked up next to the config
+	// file if it is empty.
+	confDir string
+	// sourceErrors are the conflicts found while merging the config files.
+	sourceErrors []error
+	// references are the settings read from a reference, by key.
+	references   map[string]*reference
+	secretReader client.Reader
+	// skipReferences leaves the settings read from a reference unset, instead of reading them.
+	skipReferences bool
 }
 
 func NewConfig() *Config {
@@ -73,9 +144,17 @@ func (c *Config) initDefaults() {
 	c.SetDefault(LeaderElectionKey, false)
 	c.SetDefault(CloudEventsSourceURIKey, "localhost")
 	c.SetDefault(CloudEventsTargetAddressKey, "http://localhost:8082")
+	c.SetDefault(DrainTimeoutKey, "30s")
+	c.SetDefault(DiscoveryIntervalKey, "5m")
+	c.SetDefault(ReferenceRefreshIntervalKey, "1m")
+	c.SetDefault(OnForbiddenKey, OnForbiddenFail)
+	c.SetDefault(WatchNamespacesKey, []string{})
 	// TODO: defaults for zap?
 }
 
+// configPaths are the directories searched for the configuration file, in order.
+var configPaths = []string{"/etc/dynowatch", "$HOME/.dynowatch", "./config/manager"}
+
 // initiConfigPathSearch initializes the search path for the configuration file. By default, it
 // searches for a `dynowatch.yaml` in one of the following directories:
 //
@@ -85,15 +164,21 @@ func (c *Config) initDefaults() {
 func (c *Config) initConfigPathSearch() {
 	c.SetConfigName("dynowatch")
 	c.SetConfigType("yaml")
-	c.AddConfigPath("/etc/dynowatch")
-	c.AddConfigPath("$HOME/.dynowatch")
-	c.AddConfigPath("./config/manager")
+	for _, path := range configPaths {
+		c.AddConfigPath(path)
+	}
 }
 
+// initEnv sets up environment variable aliasing. Every key can be set with a `DYNOWATCH_` prefixed
+// variable, such as `DYNOWATCH_CLOUD_EVENTS_TARGET_ADDRESS`. The variables injected by a Knative
+// SinkBinding are honored as a fallback for the event target and overrides.
 func (c *Config) initEnv() {
 	c.SetEnvPrefix("DYNOWATCH")
-	c.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	c.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	c.AutomaticEnv()
+	// BindEnv only fails if no key is provided.
+	_ = c.BindEnv(CloudEventsTargetAddressKey, KnativeSinkEnv)
+	_ = c.BindEnv(CloudEventsOverridesKey, KnativeCEOverridesEnv)
 }
 
 func (c *Config) GetWatches() ([]Watch, error) {
@@ -102,16 +187,164 @@ func (c *Config) GetWatches() ([]Watch, error) {
 		return watches, nil
 	}
 	// Otherwise the data should be YAML-encoded, and we need to unmarshal...
-	err := c.UnmarshalKey(ObjectWatchesKey, &watches)
-	return watches, err
+	if err := c.unmarshalKey(ObjectWatchesKey, &watches); err != nil {
+		return watches, err
+	}
+	for _, watch := range watches {
+		if err := validateWatch(watch); err != nil {
+			return nil, err
+		}
+	}
+	return watches, nil
+}
+
+// Load resolves the settings read from a reference, then decodes every setting into a
+// DynowatchConfig and validates it. Unknown keys, such as misspelled ones, are rejected. The
+// returned ValidationError lists every unknown key, invalid setting, and reference that cannot be
+// read.
+func (c *Config) Load() (*DynowatchConfig, error) {
+	settings := &DynowatchConfig{}
+	var errs []error
+	if err := c.resolveReferences(context.TODO()); err != nil {
+		var joined interface{ Unwrap() []error }
+		if errors.As(err, &joined) {
+			errs = append(errs, joined.Unwrap()...)
+		} else {
+			errs = append(errs, err)
+		}
+	}
+	err := c.UnmarshalExact(settings, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "json"
+		dc.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			decodeOverrides,
+		)
+	})
+	if err != nil {
+		errs = append(errs, decodeErrors(err)...)
+	}
+	errs = append(errs, c.sourceErrors...)
+	for i := range settings.Watches {
+		if settings.Watches[i].OnForbidden == "" {
+			settings.Watches[i].OnForbidden = settings.OnForbidden
+		}
+	}
+	var validationErr *ValidationError
+	if err := settings.Validate(); errors.As(err, &validationErr) {
+		for _, err := range validationErr.Errors {
+			// Settings that were not read are not validated.
+			var settingErr *SettingError
+			if c.skipReferences && errors.As(err, &settingErr) && c.IsReference(settingErr.Key) {
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Errors: errs}
+	}
+	return settings, nil
 }
 
-// SafeReadInConfig reads in the config file from the default search locations. It does not return
-// an error if the config file is not found.
+// decodeStrict decodes input into output, matching fields by their JSON tags, and rejects unknown
+// keys.
+func decodeStrict(input any, output any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:     "json",
+		ErrorUnused: true,
+		Result:      output,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(input)
+}
+
+// decodeOverrides decodes CloudEvent overrides set as a JSON-encoded string, such as the
+// K_CE_OVERRIDES variable injected by a Knative SinkBinding.
+func decodeOverrides(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(CloudEventOverrides{}) {
+		return data, nil
+	}
+	overrides := CloudEventOverrides{}
+	if raw := data.(string); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+			return nil, err
+		}
+	}
+	return overrides, nil
+}
+
+// invalidKeys matches the error mapstructure reports for the unknown keys of a setting.
+var invalidKeys = regexp.MustCompile(`^'(.*)' has invalid keys: (.*)$`)
+
+// decodeErrors returns an error for each setting that could not be decoded, and for each unknown
+// key.
+func decodeErrors(err error) []error {
+	var decodeErr *mapstructure.Error
+	if !errors.As(err, &decodeErr) {
+		return []error{err}
+	}
+	var errs []error
+	for _, message := range decodeErr.Errors {
+		match := invalidKeys.FindStringSubmatch(message)
+		if match == nil {
+			errs = append(errs, errors.New(message))
+			continue
+		}
+		for _, key := range strings.Split(match[2], ", ") {
+			if match[1] != "" {
+				key = match[1] + "." + key
+			}
+			errs = append(errs, &SettingError{Key: key, Message: "unknown key"})
+		}
+	}
+	return errs
+}
+
+// IsDiscovered reports whether the kinds of a watch are discovered from the cluster, because it
+// applies to every kind of its group or to the kinds of the CustomResourceDefinitions it selects.
+func (w Watch) IsDiscovered() bool {
+	return w.Kind == WildcardKind || w.CRDSelector != ""
+}
+
+// unmarshalKey decodes the value at key into rawVal, matching fields by their JSON tags.
+func (c *Config) unmarshalKey(key string, rawVal any) error {
+	return c.UnmarshalKey(key, rawVal, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "json"
+	})
+}
+
+// SafeReadInConfig reads in the config file from the default search locations, or the file set
+// with SetConfigFile, then merges the files of the conf.d directory. It does not return an error
+// if the config file is not found.
 func (c *Config) SafeReadInConfig() error {
 	err := c.ReadInConfig()
-	if err != nil && errors.Is(err, viper.ConfigFileNotFoundError{}) {
-		return nil
+	if err != nil && !errors.As(err, &viper.ConfigFileNotFoundError{}) {
+		return err
+	}
+	return c.mergeConfDir()
+}
+
+// CurrentNamespace returns the namespace dynowatch runs in. The POD_NAMESPACE environment variable
+// takes precedence over the namespace of the mounted service account token.
+func CurrentNamespace() (string, error) {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// CurrentServiceAccount returns the name of the service account dynowatch runs as, which is
+// provided through the POD_SERVICE_ACCOUNT environment variable.
+func CurrentServiceAccount() (string, error) {
+	if sa := os.Getenv("POD_SERVICE_ACCOUNT"); sa != "" {
+		return sa, nil
 	}
-	return err
+	return "", errors.New("POD_SERVICE_ACCOUNT is not set")
 }
@@ -18,7 +18,13 @@ package config
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
 )
@@ -127,3 +133,476 @@ watches:
 	}
 	o.Expect(watches).To(BeEquivalentTo(expected))
 }
+
+func TestGetWatchesDebounce(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	watchYaml := `
+watches:
+  - name: jobs
+    group: batch
+    version: v1
+    kind: Job
+    debounce:
+      window: 2s
+      max-delay: 30s`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(watchYaml))).To(Succeed())
+	watches, err := config.GetWatches()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(watches).To(HaveLen(1))
+	o.Expect(watches[0].Debounce).To(Equal(&DebounceConfig{Window: 2 * time.Second, MaxDelay: 30 * time.Second}))
+}
+
+func TestKnativeSinkBinding(t *testing.T) {
+	o := NewWithT(t)
+	t.Setenv(KnativeSinkEnv, "http://broker-ingress.knative-eventing.svc.cluster.local/archive/default")
+	t.Setenv(KnativeCEOverridesEnv, `{"extensions":{"cluster":"prod-east"}}`)
+	config := NewConfig()
+	config.Init()
+
+	o.Expect(config.GetString(CloudEventsTargetAddressKey)).To(
+		Equal("http://broker-ingress.knative-eventing.svc.cluster.local/archive/default"))
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.Overrides).To(Equal(&CloudEventOverrides{
+		Extensions: map[string]string{"cluster": "prod-east"},
+	}))
+
+	t.Setenv("DYNOWATCH_CLOUD_EVENTS_TARGET_ADDRESS", "https://splunk.mycorp.com/events")
+	o.Expect(config.GetString(CloudEventsTargetAddressKey)).To(Equal("https://splunk.mycorp.com/events"))
+}
+
+func TestLoadSinkRef(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.SinkRef).To(BeNil())
+	o.Expect(settings.CloudEvents.Overrides).To(BeNil())
+	sinkYaml := `
+cloud-events:
+  sink-ref:
+    api-version: eventing.knative.dev/v1
+    kind: Broker
+    name: default
+    namespace: archive
+  overrides:
+    extensions:
+      cluster: prod-east`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(sinkYaml))).To(Succeed())
+	settings, err = config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.SinkRef).To(Equal(&SinkReference{
+		APIVersion: "eventing.knative.dev/v1",
+		Kind:       "Broker",
+		Name:       "default",
+		Namespace:  "archive",
+	}))
+	o.Expect(settings.CloudEvents.Overrides).To(Equal(&CloudEventOverrides{
+		Extensions: map[string]string{"cluster": "prod-east"},
+	}))
+}
+
+func TestLoadAuth(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.Auth).To(BeNil())
+	authYaml := `
+cloud-events:
+  auth:
+    oauth2:
+      token-url: https://sso.mycorp.com/oauth2/token
+      client-id: dynowatch
+      client-secret-file: /var/run/secrets/sink/client-secret
+      scopes:
+        - events.write
+    tls:
+      ca-file: /var/run/secrets/sink-tls/ca.crt`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(authYaml))).To(Succeed())
+	settings, err = config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.Auth).To(Equal(&AuthConfig{
+		OAuth2: &OAuth2Config{
+			TokenURL:         "https://sso.mycorp.com/oauth2/token",
+			ClientID:         "dynowatch",
+			ClientSecretFile: "/var/run/secrets/sink/client-secret",
+			Scopes:           []string{"events.write"},
+		},
+		TLS: &TLSConfig{
+			CAFile: "/var/run/secrets/sink-tls/ca.crt",
+		},
+	}))
+}
+
+func TestLoadDeliveryPolicy(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.Retry).To(BeNil())
+	o.Expect(settings.CloudEvents.CircuitBreaker).To(BeNil())
+	o.Expect(settings.CloudEvents.Batch).To(BeNil())
+	policyYaml := `
+cloud-events:
+  timeout: 10s
+  retry:
+    max-attempts: 5
+    initial-backoff: 500ms
+    max-backoff: 1m
+    jitter: 0.2
+  circuit-breaker:
+    failure-threshold: 3
+    open-duration: 45s
+  ordering: per-object
+  dead-letter:
+    target-address: https://dlq.mycorp.com/events
+    timeout: 5s
+    retry:
+      max-attempts: 2`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(policyYaml))).To(Succeed())
+	settings, err = config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	events := settings.CloudEvents
+	o.Expect(events.Timeout).To(Equal(10 * time.Second))
+	o.Expect(events.Retry).To(Equal(&RetryConfig{
+		MaxAttempts:    5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.2,
+	}))
+	o.Expect(events.CircuitBreaker).To(Equal(&CircuitBreakerConfig{
+		FailureThreshold: 3,
+		OpenDuration:     45 * time.Second,
+	}))
+	o.Expect(events.Ordering).To(Equal(OrderingPerObject))
+	o.Expect(events.DeadLetter).To(Equal(&DeadLetterConfig{
+		TargetAddress: "https://dlq.mycorp.com/events",
+		Timeout:       5 * time.Second,
+		Retry:         &RetryConfig{MaxAttempts: 2},
+	}))
+}
+
+func TestGetWatchLimits(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	limitsYaml := `
+watches:
+  - name: deployments
+    group: apps
+    version: v1
+    kind: Deployment
+    max-concurrent-reconciles: 4
+    events-per-second: 50
+    burst: 100
+    debounce:
+      window: 2s`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(limitsYaml))).To(Succeed())
+	watches, err := config.GetWatches()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(watches).To(Equal([]Watch{
+		{
+			Name:                    "deployments",
+			Group:                   "apps",
+			Version:                 "v1",
+			Kind:                    "Deployment",
+			Debounce:                &DebounceConfig{Window: 2 * time.Second},
+			MaxConcurrentReconciles: 4,
+			EventsPerSecond:         50,
+			Burst:                   100,
+		},
+	}))
+}
+
+func TestGetWatchInitialSync(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	watchYaml := `
+watches:
+  - name: jobs
+    group: batch
+    version: v1
+    kind: Job
+    initial-sync: snapshot
+    inventory:
+      interval: 1h
+      max-objects: 500`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(watchYaml))).To(Succeed())
+	watches, err := config.GetWatches()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(watches[0].InitialSync).To(Equal(InitialSyncSnapshot))
+	o.Expect(watches[0].Inventory).To(Equal(&InventoryConfig{Interval: time.Hour, MaxObjects: 500}))
+
+	o.Expect(config.ReadConfig(bytes.NewBufferString(
+		strings.Replace(watchYaml, "snapshot", "replay", 1)))).To(Succeed())
+	_, err = config.GetWatches()
+	o.Expect(err).To(MatchError(ContainSubstring("initial-sync of watch jobs")))
+
+	o.Expect(config.ReadConfig(bytes.NewBufferString(
+		strings.Replace(watchYaml, "interval: 1h", "interval: 0s", 1)))).To(Succeed())
+	_, err = config.GetWatches()
+	o.Expect(err).To(MatchError(ContainSubstring("inventory.interval of watch jobs")))
+}
+
+func TestGetWatchDiscovery(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	watchYaml := `
+watches:
+  - name: tekton
+    group: tekton.dev
+    kind: "*"
+  - name: labeled
+    crd-selector: kubearchive.dev/watch=true`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(watchYaml))).To(Succeed())
+	watches, err := config.GetWatches()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(watches[0].IsDiscovered()).To(BeTrue())
+	o.Expect(watches[1].CRDSelector).To(Equal("kubearchive.dev/watch=true"))
+	o.Expect(watches[1].IsDiscovered()).To(BeTrue())
+	o.Expect(config.GetDuration(DiscoveryIntervalKey)).To(Equal(5 * time.Minute))
+
+	o.Expect(config.ReadConfig(bytes.NewBufferString(
+		strings.Replace(watchYaml, "group: tekton.dev", "resource: pipelineruns.tekton.dev", 1)))).To(Succeed())
+	_, err = config.GetWatches()
+	o.Expect(err).To(MatchError("watch tekton of every kind must only set a group"))
+
+	o.Expect(config.ReadConfig(bytes.NewBufferString(
+		strings.Replace(watchYaml, "watch=true", "watch=(true", 1)))).To(Succeed())
+	_, err = config.GetWatches()
+	o.Expect(err).To(MatchError(ContainSubstring("crd-selector of watch labeled")))
+}
+
+func TestLoad(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	configYaml := `
+metrics:
+  bind-address: ":9000"
+leader-election: true
+cloud-events:
+  source-uri: https://github.com/kubearchive/dynowatch
+  target-address: https://splunk.mycorp.com/events
+  overrides: '{"extensions": {"cluster": "prod"}}'
+  retry:
+    max-attempts: 3
+    initial-backoff: 2s
+on-forbidden: wait
+watches:
+  - name: jobs
+    group: batch
+    version: v1
+    kind: Job
+  - name: pods
+    kind: Pod
+    on-forbidden: skip`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(configYaml))).To(Succeed())
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.Metrics.BindAddress).To(Equal(":9000"))
+	o.Expect(settings.Healthz.BindAddress).To(Equal(":8081"), "defaults are loaded")
+	o.Expect(settings.LeaderElection).To(BeTrue())
+	o.Expect(settings.DrainTimeout).To(Equal(30 * time.Second))
+	o.Expect(settings.CloudEvents.Overrides).To(Equal(&CloudEventOverrides{Extensions: map[string]string{"cluster": "prod"}}))
+	o.Expect(settings.CloudEvents.Retry).To(Equal(&RetryConfig{MaxAttempts: 3, InitialBackoff: 2 * time.Second}))
+	o.Expect(settings.Watches).To(Equal([]Watch{
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Job", OnForbidden: OnForbiddenWait},
+		{Name: "pods", Kind: "Pod", OnForbidden: OnForbiddenSkip},
+	}), "watches inherit on-forbidden")
+}
+
+func TestLoadInvalid(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+
+	configYaml := `
+metrics:
+  bind-address: "9000"
+cloudevents:
+  source-uri: https://github.com/kubearchive/dynowatch
+cloud-events:
+  target-address: splunk.mycorp.com
+  retry:
+    max-attempts: 3
+    jitter: 2
+  ordering: global
+  rate-limit:
+    events-per-second: 0
+watches:
+  - name: jobs
+    group: batch
+    knd: Job
+  - name: jobs
+    kind: Deployment
+    initial-sync: replay
+    on-forbidden: retry`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(configYaml))).To(Succeed())
+	_, err := config.Load()
+	o.Expect(err).To(HaveOccurred())
+	message := err.Error()
+	o.Expect(message).To(HavePrefix("invalid configuration:\n"))
+	var validationErr *ValidationError
+	o.Expect(errors.As(err, &validationErr)).To(BeTrue())
+	o.Expect(validationErr.Errors).To(ContainElement(&SettingError{Key: "cloudevents", Message: "unknown key"}))
+	for _, line := range []string{
+		"cloudevents: unknown key",
+		"watches[0].knd: unknown key",
+		`metrics.bind-address: must be an address such as :8080, or 0 to disable it, got "9000"`,
+		`cloud-events.target-address: must be an http or https URL, got "splunk.mycorp.com"`,
+		"cloud-events.retry.jitter: must be between 0 and 1, got 2",
+		`cloud-events.ordering: must be "none" or "per-object", got "global"`,
+		"cloud-events.rate-limit.events-per-second: must be greater than zero",
+		"watches[0]: a kind, resource, or crd-selector is required",
+		`watches[1].name: "jobs" is used by another watch`,
+		`watches[1]: initial-sync of watch jobs must be "events", "none", or "snapshot", got "replay"`,
+		`watches[1].on-forbidden: must be "fail", "skip", or "wait", got "retry"`,
+	} {
+		o.Expect(strings.Split(message, "\n")).To(ContainElement(line))
+	}
+}
+
+func TestLoadBatch(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+	configYaml := `
+cloud-events:
+  batch:
+    max-events: 50
+watches:
+  - name: jobs
+    group: batch
+    version: v1
+    kind: Job
+    max-concurrent-reconciles: 50
+  - name: pods
+    version: v1
+    kind: Pod`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(configYaml))).To(Succeed())
+	_, err := config.Load()
+	o.Expect(err).To(MatchError(ContainSubstring("cloud-events.batch: requires max-concurrent-reconciles " +
+		"greater than 1 on every watch, since only the events of concurrent reconciles are batched together, " +
+		"but watch pods reconciles one object at a time")))
+
+	config = NewConfig()
+	config.Init()
+	configYaml = `
+cloud-events:
+  batch:
+    max-events: 50
+outbox:
+  path: /var/lib/dynowatch/outbox.db
+watches:
+  - name: jobs
+    group: batch
+    version: v1
+    kind: Job
+    max-concurrent-reconciles: 50`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(configYaml))).To(Succeed())
+	_, err = config.Load()
+	o.Expect(err).To(MatchError(ContainSubstring(
+		"cloud-events.batch: cannot be used with outbox, which delivers events one at a time")))
+}
+
+func TestLoadWatchNamespaces(t *testing.T) {
+	o := NewWithT(t)
+	config := NewConfig()
+	config.Init()
+	configYaml := `
+watch-namespaces: [team-a, Team_B, team-a]
+watches:
+  - name: tekton
+    crd-selector: dynowatch.io/watch=true`
+	o.Expect(config.ReadConfig(bytes.NewBufferString(configYaml))).To(Succeed())
+	_, err := config.Load()
+	o.Expect(err).To(HaveOccurred())
+	message := err.Error()
+	for _, line := range []string{
+		`watch-namespaces[1]: "Team_B" is not a valid namespace: ` +
+			"a lowercase RFC 1123 label must consist of lower case alphanumeric characters or '-', " +
+			"and must start and end with an alphanumeric character " +
+			"(e.g. 'my-name',  or '123-abc', regex used for validation is '[a-z0-9]([-a-z0-9]*[a-z0-9])?')",
+		`watch-namespaces[2]: "team-a" is set more than once`,
+		"watches[0].crd-selector: cannot be used with watch-namespaces, since CustomResourceDefinitions are " +
+			"cluster-scoped",
+	} {
+		o.Expect(strings.Split(message, "\n")).To(ContainElement(line))
+	}
+
+	t.Setenv("DYNOWATCH_WATCH_NAMESPACES", "team-a,team-b")
+	config = NewConfig()
+	config.Init()
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.WatchNamespaces).To(Equal([]string{"team-a", "team-b"}))
+}
+
+func TestSafeReadInConfigConfDir(t *testing.T) {
+	o := NewWithT(t)
+	dir := t.TempDir()
+	confDir := filepath.Join(dir, "conf.d")
+	o.Expect(os.Mkdir(confDir, 0o755)).To(Succeed())
+	files := map[string]string{
+		filepath.Join(dir, "dynowatch.yaml"): `
+cloud-events:
+  target-address: https://splunk.mycorp.com/events
+watches:
+  - name: jobs
+    resource: jobs.batch`,
+		filepath.Join(confDir, "20-team-b.yaml"): `
+cloud-events:
+  source-uri: https://team-b.mycorp.com
+watches:
+  - name: jobs
+    resource: jobs.batch
+  - name: deployments
+    resource: deployments.apps`,
+		filepath.Join(confDir, "10-team-a.yml"): `
+cloud-events:
+  source-uri: https://team-a.mycorp.com
+watches:
+  - name: pipelineruns
+    resource: pipelineruns.tekton.dev`,
+		filepath.Join(confDir, "README.md"): "Not a config file",
+	}
+	for file, data := range files {
+		o.Expect(os.WriteFile(file, []byte(data), 0o600)).To(Succeed())
+	}
+
+	config := NewConfig()
+	config.Init()
+	config.SetConfigFile(filepath.Join(dir, "dynowatch.yaml"))
+	o.Expect(config.SafeReadInConfig()).To(Succeed())
+	o.Expect(config.GetString(CloudEventsTargetAddressKey)).To(Equal("https://splunk.mycorp.com/events"))
+	o.Expect(config.GetString(CloudEventsSourceURIKey)).To(Equal("https://team-b.mycorp.com"),
+		"later files take precedence")
+	watches, err := config.GetWatches()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(watches).To(Equal([]Watch{
+		{Name: "jobs", Resource: "jobs.batch"},
+		{Name: "pipelineruns", Resource: "pipelineruns.tekton.dev"},
+		{Name: "deployments", Resource: "deployments.apps"},
+	}))
+
+	_, err = config.Load()
+	o.Expect(err).To(MatchError(fmt.Sprintf("invalid configuration:\nwatches: watch \"jobs\" is set in both %s and %s",
+		filepath.Join(dir, "dynowatch.yaml"), filepath.Join(confDir, "20-team-b.yaml"))))
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// valueFromKey is the key of a setting whose value is read from a reference.
+const valueFromKey = "value-from"
+
+// Redacted replaces the value of settings read from a reference in logs.
+const Redacted = "<redacted>"
+
+// Reference is a string setting whose value is read from a file, an environment variable, or a
+// key of a Secret, instead of being set in the config file.
+type Reference struct {
+	ValueFrom ValueFrom `json:"value-from"`
+}
+
+// ValueFrom is the source of the value of a setting. Exactly one of its fields must be set.
+type ValueFrom struct {
+	File         string             `json:"file,omitempty"`
+	Env          string             `json:"env,omitempty"`
+	SecretKeyRef *SecretKeySelector `json:"secret-key-ref,omitempty"`
+}
+
+// SecretKeySelector selects a key of a Secret. The namespace defaults to the one dynowatch runs in.
+type SecretKeySelector struct {
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// reference is a setting read from a reference, along with the value it was resolved to.
+type reference struct {
+	valueFrom ValueFrom
+	value     string
+}
+
+// SetSecretReader sets the client that reads the Secrets of secret-key-ref references.
+func (c *Config) SetSecretReader(reader client.Reader) {
+	c.secretReader = reader
+}
+
+// SkipReferences makes Load leave the settings read from a reference unset instead of reading them,
+// for commands that do not need their values, such as rbac generate. These settings are not
+// validated.
+func (c *Config) SkipReferences() {
+	c.skipReferences = true
+}
+
+// IsReference reports whether the value of the setting at key, or of any setting below it, is read
+// from a reference.
+func (c *Config) IsReference(key string) bool {
+	for refKey := range c.references {
+		if refKey == key || strings.HasPrefix(refKey, key+".") || strings.HasPrefix(refKey, key+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact returns value, or Redacted if the setting at key is read from a reference, so that it can
+// be logged.
+func (c *Config) Redact(key string, value any) any {
+	if c.IsReference(key) {
+		return Redacted
+	}
+	return value
+}
+
+// SecretReferences returns the Secret keys that settings are read from, sorted by key of the
+// setting. It is only complete once the config is loaded.
+func (c *Config) SecretReferences() []SecretKeySelector {
+	keys := make([]string, 0, len(c.references))
+	for key, ref := range c.references {
+		if ref.valueFrom.SecretKeyRef != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	selectors := make([]SecretKeySelector, 0, len(keys))
+	for _, key := range keys {
+		selectors = append(selectors, *c.references[key].valueFrom.SecretKeyRef)
+	}
+	return selectors
+}
+
+// resolveReferences replaces the settings that are read from a reference with their value. The
+// settings keep their value until the config is read again, or WatchReferences finds that the
+// reference changed.
+func (c *Config) resolveReferences(ctx context.Context) error {
+	if c.references == nil {
+		c.references = map[string]*reference{}
+	}
+	var errs []error
+	for key, value := range c.AllSettings() {
+		resolved, changed, err := c.resolveValue(ctx, key, value)
+		errs = append(errs, err)
+		if changed {
+			c.Set(key, resolved)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolveValue returns value with the references it contains replaced by their value, and whether
+// any reference was replaced.
+func (c *Config) resolveValue(ctx context.Context, key string, value any) (any, bool, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		if ref, ok := v[valueFromKey]; ok && len(v) == 1 {
+			resolved, err := c.resolveReference(ctx, key, ref)
+			return resolved, true, err
+		}
+		resolved := make(map[string]any, len(v))
+		anyChanged := false
+		var errs []error
+		for k, item := range v {
+			r, changed, err := c.resolveValue(ctx, key+"."+k, item)
+			resolved[k] = r
+			anyChanged = anyChanged || changed
+			errs = append(errs, err)
+		}
+		return resolved, anyChanged, errors.Join(errs...)
+	case []any:
+		resolved := make([]any, len(v))
+		anyChanged := false
+		var errs []error
+		for i, item := range v {
+			r, changed, err := c.resolveValue(ctx, fmt.Sprintf("%s[%d]", key, i), item)
+			resolved[i] = r
+			anyChanged = anyChanged || changed
+			errs = append(errs, err)
+		}
+		return resolved, anyChanged, errors.Join(errs...)
+	default:
+		return value, false, nil
+	}
+}
+
+func (c *Config) resolveReference(ctx context.Context, key string, ref any) (string, error) {
+	valueFrom := ValueFrom{}
+	if err := decodeStrict(ref, &valueFrom); err != nil {
+		return "", &SettingError{Key: key + "." + valueFromKey, Message: err.Error()}
+	}
+	if c.skipReferences {
+		c.references[key] = &reference{valueFrom: valueFrom}
+		return "", nil
+	}
+	value, err := c.readReference(ctx, valueFrom)
+	if err != nil {
+		return "", &SettingError{Key: key + "." + valueFromKey, Message: err.Error()}
+	}
+	c.references[key] = &reference{valueFrom: valueFrom, value: value}
+	return value, nil
+}
+
+// readReference reads the current value of a reference.
+func (c *Config) readReference(ctx context.Context, valueFrom ValueFrom) (string, error) {
+	set := 0
+	for _, source := range []bool{valueFrom.File != "", valueFrom.Env != "", valueFrom.SecretKeyRef != nil} {
+		if source {
+			set++
+		}
+	}
+	if set != 1 {
+		return "", errors.New("exactly one of file, env, or secret-key-ref is required")
+	}
+	switch {
+	case valueFrom.File != "":
+		data, err := os.ReadFile(valueFrom.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case valueFrom.Env != "":
+		value, ok := os.LookupEnv(valueFrom.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", valueFrom.Env)
+		}
+		return value, nil
+	default:
+		ref := valueFrom.SecretKeyRef
+		if ref.Name == "" || ref.Key == "" {
+			return "", errors.New("secret-key-ref requires a name and key")
+		}
+		if c.secretReader == nil {
+			return "", fmt.Errorf("secret %s cannot be read without access to the cluster", ref.Name)
+		}
+		namespace := ref.Namespace
+		if namespace == "" {
+			var err error
+			if namespace, err = CurrentNamespace(); err != nil {
+				return "", fmt.Errorf("determining the namespace of secret %s: %w", ref.Name, err)
+			}
+		}
+		secret := &corev1.Secret{}
+		if err := c.secretReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+			return "", err
+		}
+		data, ok := secret.Data[ref.Key]
+		if !ok {
+			return "", fmt.Errorf("secret %s/%s has no key %s", namespace, ref.Name, ref.Key)
+		}
+		return string(data), nil
+	}
+}
+
+// WatchReferences reads the references again every interval until ctx is done. The settings whose
+// reference no longer has the value it was resolved to are set to the new value, so that Load
+// returns it, then changed is called with their keys.
+func (c *Config) WatchReferences(ctx context.Context, interval time.Duration, changed func(keys []string)) {
+	if len(c.references) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var keys []string
+		for key, ref := range c.references {
+			value, err := c.readReference(ctx, ref.valueFrom)
+			// A reference that cannot be read is kept, since it may be changing.
+			if err == nil && value != ref.value {
+				ref.value = value
+				c.Set(key, value)
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			changed(keys)
+		}
+	}
+}
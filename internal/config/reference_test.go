@@ -0,0 +1,142 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const referencesYaml = `
+cloud-events:
+  source-uri:
+    value-from:
+      env: DYNOWATCH_TEST_SOURCE
+  target-address:
+    value-from:
+      secret-key-ref:
+        name: splunk
+        key: url
+        namespace: dynowatch-system
+  auth:
+    oauth2:
+      token-url: https://auth.mycorp.com/token
+      client-id:
+        value-from:
+          file: %s
+      client-secret-file: /var/run/secrets/oauth2/client-secret`
+
+func newReferencesConfig(t *testing.T) (*Config, string) {
+	o := NewWithT(t)
+	clientIDFile := filepath.Join(t.TempDir(), "client-id")
+	o.Expect(os.WriteFile(clientIDFile, []byte("dynowatch\n"), 0o600)).To(Succeed())
+	t.Setenv("DYNOWATCH_TEST_SOURCE", "https://dynowatch.mycorp.com")
+
+	config := NewConfig()
+	config.Init()
+	o.Expect(config.ReadConfig(bytes.NewBufferString(strings.Replace(referencesYaml, "%s", clientIDFile, 1)))).
+		To(Succeed())
+	config.SetSecretReader(fake.NewClientBuilder().WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "splunk", Namespace: "dynowatch-system"},
+		Data:       map[string][]byte{"url": []byte("https://splunk.mycorp.com/events")},
+	}).Build())
+	return config, clientIDFile
+}
+
+func TestLoadReferences(t *testing.T) {
+	o := NewWithT(t)
+	config, _ := newReferencesConfig(t)
+
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.SourceURI).To(Equal("https://dynowatch.mycorp.com"))
+	o.Expect(settings.CloudEvents.TargetAddress).To(Equal("https://splunk.mycorp.com/events"))
+	o.Expect(settings.CloudEvents.Auth.OAuth2.ClientID).To(Equal("dynowatch"))
+
+	o.Expect(config.Redact(CloudEventsTargetAddressKey, settings.CloudEvents.TargetAddress)).To(Equal(Redacted))
+	o.Expect(config.Redact(CloudEventsAuthKey, settings.CloudEvents.Auth)).To(Equal(Redacted))
+	o.Expect(config.Redact(MetricsBindAddressKey, ":8080")).To(Equal(":8080"))
+}
+
+func TestLoadReferencesInvalid(t *testing.T) {
+	o := NewWithT(t)
+	config, clientIDFile := newReferencesConfig(t)
+	o.Expect(os.Remove(clientIDFile)).To(Succeed())
+	o.Expect(os.Unsetenv("DYNOWATCH_TEST_SOURCE")).To(Succeed())
+	config.SetSecretReader(nil)
+
+	_, err := config.Load()
+	o.Expect(err).To(HaveOccurred())
+	lines := strings.Split(err.Error(), "\n")
+	o.Expect(lines).To(ContainElement(
+		"cloud-events.source-uri.value-from: environment variable DYNOWATCH_TEST_SOURCE is not set"))
+	o.Expect(lines).To(ContainElement(
+		"cloud-events.target-address.value-from: secret splunk cannot be read without access to the cluster"))
+	o.Expect(lines).To(ContainElement(ContainSubstring("cloud-events.auth.oauth2.client-id.value-from: open ")))
+}
+
+func TestWatchReferences(t *testing.T) {
+	o := NewWithT(t)
+	config, clientIDFile := newReferencesConfig(t)
+	_, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan []string, 1)
+	go config.WatchReferences(ctx, 10*time.Millisecond, func(keys []string) {
+		changes <- keys
+	})
+	o.Consistently(changes, 50*time.Millisecond).ShouldNot(Receive())
+	o.Expect(os.WriteFile(clientIDFile, []byte("dynowatch-2"), 0o600)).To(Succeed())
+	o.Eventually(changes).Should(Receive(Equal([]string{"cloud-events.auth.oauth2.client-id"})))
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(settings.CloudEvents.Auth.OAuth2.ClientID).To(Equal("dynowatch-2"), "changes are loaded")
+
+	// References are still watched after a change.
+	o.Expect(os.WriteFile(clientIDFile, []byte("dynowatch-3"), 0o600)).To(Succeed())
+	o.Eventually(changes).Should(Receive(Equal([]string{"cloud-events.auth.oauth2.client-id"})))
+	o.Consistently(changes, 50*time.Millisecond).ShouldNot(Receive())
+}
+
+func TestLoadSkipReferences(t *testing.T) {
+	o := NewWithT(t)
+	config, _ := newReferencesConfig(t)
+	o.Expect(os.Unsetenv("DYNOWATCH_TEST_SOURCE")).To(Succeed())
+	config.SetSecretReader(nil)
+	config.SkipReferences()
+
+	settings, err := config.Load()
+	o.Expect(err).NotTo(HaveOccurred(), "references are neither read nor validated")
+	o.Expect(settings.CloudEvents.TargetAddress).To(BeEmpty())
+	o.Expect(settings.CloudEvents.Auth.OAuth2.TokenURL).To(Equal("https://auth.mycorp.com/token"))
+	o.Expect(config.SecretReferences()).To(Equal([]SecretKeySelector{
+		{Name: "splunk", Key: "url", Namespace: "dynowatch-system"},
+	}))
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// durationPattern matches the durations accepted by time.ParseDuration, such as 1m30s.
+const durationPattern = `^[-+]?(0|([0-9]+(\.[0-9]*)?|\.[0-9]+)(ns|us|µs|ms|s|m|h))+$`
+
+// schemaEnums are the values allowed for settings that are not free-form strings, by the type and
+// JSON name of their field.
+var schemaEnums = map[reflect.Type]map[string][]any{
+	reflect.TypeOf(CloudEventConfig{}): {"ordering": {OrderingNone, OrderingPerObject}},
+	reflect.TypeOf(DynowatchConfig{}):  {"on-forbidden": {OnForbiddenFail, OnForbiddenSkip, OnForbiddenWait}},
+	reflect.TypeOf(Watch{}): {
+		"initial-sync": {InitialSyncEvents, InitialSyncNone, InitialSyncSnapshot},
+		"on-forbidden": {OnForbiddenFail, OnForbiddenSkip, OnForbiddenWait},
+	},
+}
+
+// referenceTypes are the types of references, whose strings cannot be references themselves.
+var referenceTypes = map[reflect.Type]bool{
+	reflect.TypeOf(Reference{}):         true,
+	reflect.TypeOf(ValueFrom{}):         true,
+	reflect.TypeOf(SecretKeySelector{}): true,
+}
+
+// Schema returns a JSON Schema of the config file, generated from DynowatchConfig. Every struct
+// is defined once in $defs, objects do not allow unknown properties, and the fields without
+// omitempty in their JSON tag are required. String settings can be set with a Reference, unless
+// their values are enumerated.
+func Schema() map[string]any {
+	g := &schemaGenerator{defs: map[string]any{}}
+	root := g.object(reflect.TypeOf(DynowatchConfig{}))
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "dynowatch.yaml"
+	root["$defs"] = g.defs
+	return root
+}
+
+type schemaGenerator struct {
+	defs map[string]any
+}
+
+// schema returns the schema of a type. Strings can be set with a Reference, unless plain is true.
+func (g *schemaGenerator) schema(t reflect.Type, plain bool) map[string]any {
+	switch t {
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]any{"type": "string", "pattern": durationPattern}
+	case reflect.TypeOf(CloudEventOverrides{}):
+		// Overrides can also be set as JSON, like the K_CE_OVERRIDES variable of a SinkBinding.
+		return map[string]any{"anyOf": []any{g.ref(t), map[string]any{"type": "string"}}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem(), plain)
+	case reflect.Struct:
+		return g.ref(t)
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem(), plain)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem(), plain)}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		if plain {
+			return map[string]any{"type": "string"}
+		}
+		return map[string]any{"anyOf": []any{map[string]any{"type": "string"}, g.ref(reflect.TypeOf(Reference{}))}}
+	default:
+		return map[string]any{"type": "string"}
+	}
+}
+
+// ref returns a reference to the definition of a struct, which is added to the definitions the
+// first time it is referenced.
+func (g *schemaGenerator) ref(t reflect.Type) map[string]any {
+	if _, ok := g.defs[t.Name()]; !ok {
+		// The placeholder stops recursion for types that refer to themselves.
+		g.defs[t.Name()] = nil
+		g.defs[t.Name()] = g.object(t)
+	}
+	return map[string]any{"$ref": "#/$defs/" + t.Name()}
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		enum, enumerated := schemaEnums[t][name]
+		property := g.schema(field.Type, enumerated || referenceTypes[t])
+		if enumerated {
+			property["enum"] = enum
+		}
+		properties[name] = property
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	object := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
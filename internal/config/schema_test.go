@@ -0,0 +1,59 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSchema(t *testing.T) {
+	o := NewWithT(t)
+	schema := Schema()
+	defs := schema["$defs"].(map[string]any)
+
+	o.Expect(schema["additionalProperties"]).To(BeFalse())
+	o.Expect(schema["properties"]).To(HaveKeyWithValue("watches", map[string]any{
+		"type": "array", "items": map[string]any{"$ref": "#/$defs/Watch"},
+	}))
+	watch := defs["Watch"].(map[string]any)
+	o.Expect(watch["required"]).To(Equal([]any{"name"}))
+	o.Expect(watch["properties"]).To(HaveKeyWithValue("initial-sync", map[string]any{
+		"type": "string", "enum": []any{InitialSyncEvents, InitialSyncNone, InitialSyncSnapshot},
+	}))
+	o.Expect(defs["SinkReference"].(map[string]any)["required"]).To(Equal([]any{"api-version", "kind", "name"}))
+	o.Expect(defs["CloudEventConfig"].(map[string]any)["properties"]).To(HaveKey("overrides"))
+
+	durations := regexp.MustCompile(durationPattern)
+	for _, duration := range []string{"0", "30s", "1m30s", "1.5h", "100ms"} {
+		o.Expect(durations.MatchString(duration)).To(BeTrue(), duration)
+	}
+	o.Expect(durations.MatchString("30")).To(BeFalse())
+}
+
+func TestSchemaIsUpToDate(t *testing.T) {
+	o := NewWithT(t)
+	data, err := os.ReadFile("../../docs/dynowatch.schema.json")
+	o.Expect(err).NotTo(HaveOccurred())
+	generated, err := json.Marshal(Schema())
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(data).To(MatchJSON(generated), "docs/dynowatch.schema.json must be regenerated with make schema")
+}
@@ -16,17 +16,168 @@ limitations under the License.
 
 package config
 
+import "time"
+
 type DynowatchConfig struct {
-	CloudEvents    CloudEventConfig `json:"cloud-events,omitempty"`
-	Healthz        Healthz          `json:"healthz,omitempty"`
-	LeaderElection bool             `json:"leader-election,omitempty"`
-	Metrics        Metrics          `json:"metrics,omitempty"`
-	Watches        []Watch          `json:"watches,omitempty"`
+	Checkpoint        *CheckpointConfig `json:"checkpoint,omitempty"`
+	CloudEvents       CloudEventConfig  `json:"cloud-events,omitempty"`
+	DiscoveryInterval time.Duration     `json:"discovery-interval,omitempty"`
+	DrainTimeout      time.Duration     `json:"drain-timeout,omitempty"`
+	Healthz           Healthz           `json:"healthz,omitempty"`
+	LeaderElection    bool              `json:"leader-election,omitempty"`
+	Metrics           Metrics           `json:"metrics,omitempty"`
+	Outbox            *OutboxConfig     `json:"outbox,omitempty"`
+	Watches           []Watch           `json:"watches,omitempty"`
+	// ReferenceRefreshInterval is how often the settings read from a reference are checked for
+	// changes.
+	ReferenceRefreshInterval time.Duration `json:"reference-refresh-interval,omitempty"`
+	// OnForbidden is what happens to watches that are not allowed to access their resource:
+	// OnForbiddenFail, OnForbiddenSkip, or OnForbiddenWait. Watches can override it.
+	OnForbidden string `json:"on-forbidden,omitempty"`
+	// WatchNamespaces restricts the watches to these namespaces, so that dynowatch only needs
+	// namespaced Roles. Every namespace is watched if it is empty.
+	WatchNamespaces []string `json:"watch-namespaces,omitempty"`
 }
 
 type CloudEventConfig struct {
-	SourceURI     string `json:"source-uri,omitempty"`
-	TargetAddress string `json:"target-address,omitempty"`
+	SourceURI      string                `json:"source-uri,omitempty"`
+	TargetAddress  string                `json:"target-address,omitempty"`
+	SinkRef        *SinkReference        `json:"sink-ref,omitempty"`
+	Overrides      *CloudEventOverrides  `json:"overrides,omitempty"`
+	Auth           *AuthConfig           `json:"auth,omitempty"`
+	Retry          *RetryConfig          `json:"retry,omitempty"`
+	Timeout        time.Duration         `json:"timeout,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit-breaker,omitempty"`
+	DeadLetter     *DeadLetterConfig     `json:"dead-letter,omitempty"`
+	Ordering       string                `json:"ordering,omitempty"`
+	Batch          *BatchConfig          `json:"batch,omitempty"`
+	RateLimit      *RateLimitConfig      `json:"rate-limit,omitempty"`
+}
+
+// SinkReference refers to an Addressable object, such as a Knative Broker, Channel, or Service. The
+// target address of events is resolved from the object's `status.address.url`.
+type SinkReference struct {
+	APIVersion string `json:"api-version"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+// CloudEventOverrides are applied to every emitted CloudEvent. The JSON encoding matches the
+// `K_CE_OVERRIDES` variable injected by a Knative SinkBinding.
+type CloudEventOverrides struct {
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+// AuthConfig configures how requests to a sink are authenticated. At most one of the bearer token,
+// basic, OAuth2, or service account token methods can be set. TLS can be combined with any of them.
+// Credentials read from files are reloaded when the file changes.
+type AuthConfig struct {
+	BearerTokenFile     string                     `json:"bearer-token-file,omitempty"`
+	Basic               *BasicAuthConfig           `json:"basic,omitempty"`
+	OAuth2              *OAuth2Config              `json:"oauth2,omitempty"`
+	ServiceAccountToken *ServiceAccountTokenConfig `json:"service-account-token,omitempty"`
+	TLS                 *TLSConfig                 `json:"tls,omitempty"`
+}
+
+type BasicAuthConfig struct {
+	Username     string `json:"username"`
+	PasswordFile string `json:"password-file"`
+}
+
+// OAuth2Config configures the OAuth2 client credentials flow. Tokens are cached until they expire.
+type OAuth2Config struct {
+	TokenURL         string            `json:"token-url"`
+	ClientID         string            `json:"client-id"`
+	ClientSecretFile string            `json:"client-secret-file"`
+	Scopes           []string          `json:"scopes,omitempty"`
+	EndpointParams   map[string]string `json:"endpoint-params,omitempty"`
+}
+
+// ServiceAccountTokenConfig configures a ServiceAccount token requested through the TokenRequest
+// API. The service account and namespace default to the ones dynowatch runs as.
+type ServiceAccountTokenConfig struct {
+	Audience          string `json:"audience"`
+	ExpirationSeconds int64  `json:"expiration-seconds,omitempty"`
+	ServiceAccount    string `json:"service-account,omitempty"`
+	Namespace         string `json:"namespace,omitempty"`
+}
+
+// TLSConfig configures the client certificate and CA bundle used for HTTPS connections.
+type TLSConfig struct {
+	CertFile           string `json:"cert-file,omitempty"`
+	KeyFile            string `json:"key-file,omitempty"`
+	CAFile             string `json:"ca-file,omitempty"`
+	ServerName         string `json:"server-name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure-skip-verify,omitempty"`
+}
+
+// RetryConfig configures how many times delivery of an event is attempted before it fails, and how
+// long to wait between attempts. The delay starts at the initial backoff and doubles after every
+// attempt, up to the max backoff. Jitter adds a random delay of up to the given fraction of the
+// backoff. A longer delay requested by the target with a Retry-After header takes precedence.
+type RetryConfig struct {
+	MaxAttempts    int           `json:"max-attempts,omitempty"`
+	InitialBackoff time.Duration `json:"initial-backoff,omitempty"`
+	MaxBackoff     time.Duration `json:"max-backoff,omitempty"`
+	Jitter         float64       `json:"jitter,omitempty"`
+}
+
+// CircuitBreakerConfig configures a circuit breaker, which stops sending events to a sink after a
+// number of consecutive failures. Once the open duration has passed, a single event is sent to
+// probe the sink, and the circuit is closed again if it is delivered.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `json:"failure-threshold,omitempty"`
+	OpenDuration     time.Duration `json:"open-duration,omitempty"`
+}
+
+// DeadLetterConfig configures the dead-letter sink, which receives events that cannot be delivered
+// to the target. Exactly one of file, target-address, or sink-ref must be set.
+type DeadLetterConfig struct {
+	File           string                `json:"file,omitempty"`
+	TargetAddress  string                `json:"target-address,omitempty"`
+	SinkRef        *SinkReference        `json:"sink-ref,omitempty"`
+	Auth           *AuthConfig           `json:"auth,omitempty"`
+	Retry          *RetryConfig          `json:"retry,omitempty"`
+	Timeout        time.Duration         `json:"timeout,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit-breaker,omitempty"`
+	Batch          *BatchConfig          `json:"batch,omitempty"`
+	RateLimit      *RateLimitConfig      `json:"rate-limit,omitempty"`
+}
+
+// RateLimitConfig limits the rate events are sent to a sink with a token bucket, which allows
+// events-per-second events per second with bursts of up to burst events.
+type RateLimitConfig struct {
+	EventsPerSecond float64 `json:"events-per-second"`
+	Burst           int     `json:"burst,omitempty"`
+}
+
+// BatchConfig configures batch delivery. Events are accumulated and sent in a single request with
+// the CloudEvents batch content mode once max-events or max-bytes is reached, or max-delay has
+// passed since the first event of the batch.
+type BatchConfig struct {
+	MaxEvents int           `json:"max-events,omitempty"`
+	MaxBytes  int           `json:"max-bytes,omitempty"`
+	MaxDelay  time.Duration `json:"max-delay,omitempty"`
+}
+
+// OutboxConfig configures the durable outbox. When a path is set, events are persisted to the outbox
+// before a reconcile completes, and delivered in order by a background dispatcher.
+type OutboxConfig struct {
+	Path       string        `json:"path,omitempty"`
+	MaxBackoff time.Duration `json:"max-backoff,omitempty"`
+	// MaxAttempts is the number of times an event is attempted before it is moved to the poison
+	// file. If zero, events are retried until they are delivered.
+	MaxAttempts int `json:"max-attempts,omitempty"`
+}
+
+// CheckpointConfig configures the resume checkpoint. When enabled, the last delivered
+// resourceVersion of each object is saved in a ConfigMap per watch, so that objects are not emitted
+// again when Dynowatch restarts.
+type CheckpointConfig struct {
+	Enabled   bool          `json:"enabled,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	Interval  time.Duration `json:"interval,omitempty"`
 }
 
 type Healthz struct {
@@ -37,9 +188,44 @@ type Metrics struct {
 	BindAddress string `json:"bind-address,omitempty"`
 }
 
+// Watch is a kind of object to emit events for. The kind is set with Kind and Group, or with
+// Resource, such as jobs.batch. If Version is empty, the preferred version of the group is used.
 type Watch struct {
-	Name    string `json:"name"`
-	Group   string `json:"group"`
-	Version string `json:"version"`
-	Kind    string `json:"kind"`
+	Name     string          `json:"name"`
+	Group    string          `json:"group,omitempty"`
+	Version  string          `json:"version,omitempty"`
+	Kind     string          `json:"kind,omitempty"`
+	Resource string          `json:"resource,omitempty"`
+	Debounce *DebounceConfig `json:"debounce,omitempty"`
+	// CRDSelector is a label selector of CustomResourceDefinitions. The watch applies to the kind of
+	// each CustomResourceDefinition it selects.
+	CRDSelector string `json:"crd-selector,omitempty"`
+	// MaxConcurrentReconciles is the number of objects of the watch reconciled in parallel.
+	MaxConcurrentReconciles int `json:"max-concurrent-reconciles,omitempty"`
+	// EventsPerSecond limits the rate events are emitted for the watch, with bursts of up to
+	// Burst events.
+	EventsPerSecond float64 `json:"events-per-second,omitempty"`
+	Burst           int     `json:"burst,omitempty"`
+	// InitialSync is how the objects that exist when the watch starts are emitted: InitialSyncEvents,
+	// InitialSyncNone, or InitialSyncSnapshot.
+	InitialSync string `json:"initial-sync,omitempty"`
+	// Inventory periodically emits the UID and resourceVersion of every object of the watch.
+	Inventory *InventoryConfig `json:"inventory,omitempty"`
+	// OnForbidden overrides the on-forbidden setting for the watch.
+	OnForbidden string `json:"on-forbidden,omitempty"`
+}
+
+// InventoryConfig emits an inventory of the objects of a watch every interval, split into events of
+// up to max-objects objects each.
+type InventoryConfig struct {
+	Interval   time.Duration `json:"interval"`
+	MaxObjects int           `json:"max-objects,omitempty"`
+}
+
+// DebounceConfig collapses changes to an object into a single event with its latest state. The
+// event is emitted once the object has not changed for the window, or once max-delay has passed
+// since the first change that was not emitted.
+type DebounceConfig struct {
+	Window   time.Duration `json:"window"`
+	MaxDelay time.Duration `json:"max-delay,omitempty"`
 }
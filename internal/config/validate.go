@@ -0,0 +1,280 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// SettingError is an invalid setting, identified by its key, such as cloud-events.target-address
+// or watches[0].
+type SettingError struct {
+	Key     string
+	Message string
+}
+
+func (e *SettingError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// ValidationError lists every invalid setting of a configuration.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{"invalid configuration:"}
+	for _, err := range e.Errors {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks every setting, and returns a ValidationError listing all the invalid ones.
+func (c *DynowatchConfig) Validate() error {
+	v := &validator{}
+	v.address(MetricsBindAddressKey, c.Metrics.BindAddress)
+	v.address(HealthzBindAddressKey, c.Healthz.BindAddress)
+	v.nonNegative(DrainTimeoutKey, c.DrainTimeout)
+	if c.DiscoveryInterval <= 0 {
+		v.invalid(DiscoveryIntervalKey, "must be greater than zero")
+	}
+	if c.ReferenceRefreshInterval <= 0 {
+		v.invalid(ReferenceRefreshIntervalKey, "must be greater than zero")
+	}
+	v.onForbidden(OnForbiddenKey, c.OnForbidden)
+	namespaces := map[string]bool{}
+	for i, namespace := range c.WatchNamespaces {
+		key := fmt.Sprintf("%s[%d]", WatchNamespacesKey, i)
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			v.invalid(key, "%q is not a valid namespace: %s", namespace, strings.Join(errs, ", "))
+		} else if namespaces[namespace] {
+			v.invalid(key, "%q is set more than once", namespace)
+		}
+		namespaces[namespace] = true
+	}
+	if c.Checkpoint != nil {
+		v.nonNegative(CheckpointKey+".interval", c.Checkpoint.Interval)
+	}
+	if c.Outbox != nil {
+		v.nonNegative(OutboxKey+".max-backoff", c.Outbox.MaxBackoff)
+		if c.Outbox.MaxAttempts < 0 {
+			v.invalid(OutboxKey+".max-attempts", "must not be negative, got %d", c.Outbox.MaxAttempts)
+		}
+	}
+
+	events := c.CloudEvents
+	if events.SourceURI == "" {
+		v.invalid(CloudEventsSourceURIKey, "is required")
+	} else if _, err := url.Parse(events.SourceURI); err != nil {
+		v.invalid(CloudEventsSourceURIKey, "must be a URI reference: %v", err)
+	}
+	if events.SinkRef != nil {
+		v.sinkRef(CloudEventsSinkRefKey, events.SinkRef)
+	} else {
+		v.url(CloudEventsTargetAddressKey, events.TargetAddress)
+	}
+	switch events.Ordering {
+	case "", OrderingNone, OrderingPerObject:
+	default:
+		v.invalid(CloudEventsOrderingKey, "must be %q or %q, got %q", OrderingNone, OrderingPerObject, events.Ordering)
+	}
+	v.delivery("cloud-events", events.Retry, events.Timeout, events.RateLimit)
+	if deadLetter := events.DeadLetter; deadLetter != nil {
+		set := 0
+		for _, target := range []bool{deadLetter.File != "", deadLetter.TargetAddress != "", deadLetter.SinkRef != nil} {
+			if target {
+				set++
+			}
+		}
+		if set != 1 {
+			v.invalid(CloudEventsDeadLetterKey, "requires exactly one of file, target-address, or sink-ref")
+		}
+		if deadLetter.TargetAddress != "" {
+			v.url(CloudEventsDeadLetterKey+".target-address", deadLetter.TargetAddress)
+		}
+		if deadLetter.SinkRef != nil {
+			v.sinkRef(CloudEventsDeadLetterKey+".sink-ref", deadLetter.SinkRef)
+		}
+		v.delivery(CloudEventsDeadLetterKey, deadLetter.Retry, deadLetter.Timeout, deadLetter.RateLimit)
+		v.batch(CloudEventsDeadLetterKey+".batch", deadLetter.Batch, c)
+	}
+	v.batch(CloudEventsBatchKey, events.Batch, c)
+
+	names := map[string]bool{}
+	for i, watch := range c.Watches {
+		key := fmt.Sprintf("%s[%d]", ObjectWatchesKey, i)
+		switch {
+		case watch.Name == "":
+			v.invalid(key+".name", "is required")
+		case names[watch.Name]:
+			v.invalid(key+".name", "%q is used by another watch", watch.Name)
+		}
+		names[watch.Name] = true
+		if watch.Kind == "" && watch.Resource == "" && watch.CRDSelector == "" {
+			v.invalid(key, "a kind, resource, or crd-selector is required")
+		}
+		v.onForbidden(key+".on-forbidden", watch.OnForbidden)
+		if watch.CRDSelector != "" && len(c.WatchNamespaces) > 0 {
+			v.invalid(key+".crd-selector", "cannot be used with %s, since CustomResourceDefinitions are cluster-scoped",
+				WatchNamespacesKey)
+		}
+		if err := validateWatch(watch); err != nil {
+			v.invalid(key, "%s", err.Error())
+		}
+	}
+	return v.err()
+}
+
+// validateWatch checks the settings of a watch that do not depend on the cluster.
+func validateWatch(watch Watch) error {
+	switch watch.InitialSync {
+	case "", InitialSyncEvents, InitialSyncNone, InitialSyncSnapshot:
+	default:
+		return fmt.Errorf("initial-sync of watch %s must be %q, %q, or %q, got %q", watch.Name,
+			InitialSyncEvents, InitialSyncNone, InitialSyncSnapshot, watch.InitialSync)
+	}
+	if err := validateDiscovery(watch); err != nil {
+		return err
+	}
+	if watch.Inventory != nil && watch.Inventory.Interval <= 0 {
+		return fmt.Errorf("inventory.interval of watch %s must be greater than zero", watch.Name)
+	}
+	return nil
+}
+
+// validateDiscovery checks the settings of a watch whose kinds are discovered.
+func validateDiscovery(watch Watch) error {
+	switch {
+	case watch.Kind == WildcardKind && (watch.Group == "" || watch.Version != "" || watch.Resource != "" ||
+		watch.CRDSelector != ""):
+		return fmt.Errorf("watch %s of every kind must only set a group", watch.Name)
+	case watch.CRDSelector != "" && (watch.Group != "" || watch.Version != "" || watch.Kind != "" ||
+		watch.Resource != ""):
+		return fmt.Errorf("watch %s with a crd-selector must not set a group, version, kind, or resource", watch.Name)
+	case watch.CRDSelector != "":
+		if _, err := labels.Parse(watch.CRDSelector); err != nil {
+			return fmt.Errorf("crd-selector of watch %s: %w", watch.Name, err)
+		}
+	}
+	return nil
+}
+
+// validator collects the errors of invalid settings.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) invalid(key string, format string, args ...any) {
+	v.errs = append(v.errs, &SettingError{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// address checks that value is a host and port to listen on, or "0" to disable the endpoint.
+func (v *validator) address(key string, value string) {
+	if value == "0" {
+		return
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	if err != nil {
+		v.invalid(key, "must be an address such as :8080, or 0 to disable it, got %q", value)
+	}
+}
+
+// url checks that value is an absolute http or https URL.
+func (v *validator) url(key string, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.invalid(key, "must be an http or https URL, got %q", value)
+	}
+}
+
+func (v *validator) sinkRef(key string, ref *SinkReference) {
+	if ref.APIVersion == "" || ref.Kind == "" || ref.Name == "" {
+		v.invalid(key, "requires an api-version, kind, and name")
+	}
+}
+
+func (v *validator) onForbidden(key string, value string) {
+	switch value {
+	case "", OnForbiddenFail, OnForbiddenSkip, OnForbiddenWait:
+	default:
+		v.invalid(key, "must be %q, %q, or %q, got %q", OnForbiddenFail, OnForbiddenSkip, OnForbiddenWait, value)
+	}
+}
+
+func (v *validator) nonNegative(key string, value time.Duration) {
+	if value < 0 {
+		v.invalid(key, "must not be negative, got %s", value)
+	}
+}
+
+// delivery checks the delivery settings of a sink.
+func (v *validator) delivery(key string, retry *RetryConfig, timeout time.Duration, rateLimit *RateLimitConfig) {
+	v.nonNegative(key+".timeout", timeout)
+	if retry != nil {
+		if retry.MaxAttempts < 0 {
+			v.invalid(key+".retry.max-attempts", "must not be negative, got %d", retry.MaxAttempts)
+		}
+		v.nonNegative(key+".retry.initial-backoff", retry.InitialBackoff)
+		v.nonNegative(key+".retry.max-backoff", retry.MaxBackoff)
+		if retry.Jitter < 0 || retry.Jitter > 1 {
+			v.invalid(key+".retry.jitter", "must be between 0 and 1, got %g", retry.Jitter)
+		}
+	}
+	if rateLimit != nil && rateLimit.EventsPerSecond <= 0 {
+		v.invalid(key+".rate-limit.events-per-second", "must be greater than zero")
+	}
+}
+
+// batch checks that events are sent concurrently to a sink with batch delivery. Sending an event
+// blocks until the batch holding it is sent, so a batch only holds the events of concurrent
+// reconciles, and otherwise every event waits max-delay to be sent alone.
+func (v *validator) batch(key string, batch *BatchConfig, c *DynowatchConfig) {
+	if batch == nil {
+		return
+	}
+	if c.Outbox != nil && c.Outbox.Path != "" {
+		v.invalid(key, "cannot be used with %s, which delivers events one at a time", OutboxKey)
+		return
+	}
+	for _, watch := range c.Watches {
+		if watch.MaxConcurrentReconciles < 2 {
+			v.invalid(key, "requires max-concurrent-reconciles greater than 1 on every watch, since only the "+
+				"events of concurrent reconciles are batched together, but watch %s reconciles one object at a time",
+				watch.Name)
+			return
+		}
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errs}
+}
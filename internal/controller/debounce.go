@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// CoalescedExtension is the extension attribute holding the number of changes to an object that
+// were collapsed into an event. It is only set when the watch has a debounce window.
+const CoalescedExtension = "coalesced"
+
+// pendingChanges are the changes to an object that have not been emitted yet.
+type pendingChanges struct {
+	count int
+	first time.Time
+	last  time.Time
+}
+
+// debouncer tracks changes to objects, so that changes within the debounce window are emitted as
+// a single event. An object is emitted once no change was seen for window, or once maxDelay has
+// passed since its first pending change.
+type debouncer struct {
+	window   time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	pending map[types.NamespacedName]*pendingChanges
+	// flushing is set once the controller stops, so that pending changes are emitted right away.
+	flushing bool
+}
+
+func newDebouncer(window time.Duration, maxDelay time.Duration) *debouncer {
+	if maxDelay == 0 {
+		maxDelay = 10 * window
+	}
+	return &debouncer{
+		window:   window,
+		maxDelay: maxDelay,
+		pending:  map[types.NamespacedName]*pendingChanges{},
+	}
+}
+
+// observe records a change to the object with the given key.
+func (d *debouncer) observe(key types.NamespacedName, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changes := d.pending[key]
+	if changes == nil {
+		changes = &pendingChanges{first: now}
+		d.pending[key] = changes
+	}
+	changes.count++
+	changes.last = now
+}
+
+// wait returns how long to wait before emitting the object with the given key, and the number of
+// pending changes to it.
+func (d *debouncer) wait(key types.NamespacedName, now time.Time) (time.Duration, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changes := d.pending[key]
+	if changes == nil {
+		return 0, 0
+	}
+	if d.flushing {
+		return 0, changes.count
+	}
+	quiet := d.window - now.Sub(changes.last)
+	capped := d.maxDelay - now.Sub(changes.first)
+	if capped < quiet {
+		quiet = capped
+	}
+	if quiet < 0 {
+		quiet = 0
+	}
+	return quiet, changes.count
+}
+
+// emitted removes count changes to the object with the given key, once they have been emitted.
+// Changes seen after the event was created remain pending.
+func (d *debouncer) emitted(key types.NamespacedName, count int, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	changes := d.pending[key]
+	if changes == nil {
+		return
+	}
+	changes.count -= count
+	if changes.count <= 0 {
+		delete(d.pending, key)
+		return
+	}
+	changes.first = now
+}
+
+// flush returns the keys of the objects with pending changes, and stops holding them back, so that
+// they are emitted right away.
+func (d *debouncer) flush() []types.NamespacedName {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushing = true
+	keys := make([]types.NamespacedName, 0, len(d.pending))
+	for key := range d.pending {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// reserver is implemented by senders that count events as in flight before they are sent, such as
+// delivery.Graceful, so that events that are not sent in time are reported as dropped.
+type reserver interface {
+	Reserve(ctx context.Context) (context.Context, func(dropped bool))
+}
+
+// flushDebounced emits the objects with pending changes once ctx is done, without waiting for
+// their debounce window, so that the changes are not lost when the controller stops. The objects
+// are reconciled with a context that is not cancelled, since ctx is already done: a sender such as
+// delivery.Graceful bounds how long they are waited for.
+func (r *DynamicReconciler) flushDebounced(ctx context.Context) error {
+	<-ctx.Done()
+	keys := r.debouncer.flush()
+	if len(keys) == 0 {
+		return nil
+	}
+	// Every event is reserved before the first one is sent, so that the drain accounts for all of
+	// them.
+	contexts := make([]context.Context, len(keys))
+	releases := make([]func(bool), len(keys))
+	for i := range keys {
+		contexts[i], releases[i] = r.reserve(context.Background())
+	}
+	// Reconcile waits for the checkpoint and the initial sync, which will not complete anymore if
+	// they did not already.
+	ready := (r.Checkpoint == nil || r.Checkpoint.Loaded()) && (r.initial == nil || r.initial.isDone())
+	dropped := 0
+	for i, key := range keys {
+		if ready {
+			result, err := r.Reconcile(contexts[i], ctrl.Request{NamespacedName: key})
+			if err == nil && result.IsZero() {
+				releases[i](false)
+				continue
+			}
+		}
+		dropped++
+		releases[i](true)
+	}
+	log.FromContext(ctx).Info("Flushed debounced changes", "objects", len(keys), "dropped", dropped)
+	return nil
+}
+
+// reserve reserves an event with the events client, if it supports it.
+func (r *DynamicReconciler) reserve(ctx context.Context) (context.Context, func(bool)) {
+	if sender, ok := r.EventsClient.(reserver); ok {
+		return sender.Reserve(ctx)
+	}
+	return ctx, func(bool) {}
+}
+
+// predicate returns a predicate that records every change seen by the controller, and accepts all
+// of them.
+func (d *debouncer) predicate() predicate.Predicate {
+	observe := func(obj client.Object) bool {
+		d.observe(client.ObjectKeyFromObject(obj), time.Now())
+		return true
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return observe(e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return observe(e.ObjectNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return observe(e.Object) },
+		GenericFunc: func(e event.GenericEvent) bool { return observe(e.Object) },
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/delivery"
+)
+
+func TestDebouncer(t *testing.T) {
+	o := NewWithT(t)
+	d := newDebouncer(2*time.Second, 5*time.Second)
+	key := types.NamespacedName{Namespace: "default", Name: "rollout"}
+	start := time.Now()
+
+	delay, count := d.wait(key, start)
+	o.Expect(delay).To(BeZero(), "objects without pending changes are emitted right away")
+	o.Expect(count).To(BeZero())
+
+	d.observe(key, start)
+	d.observe(key, start.Add(time.Second))
+	delay, count = d.wait(key, start.Add(time.Second))
+	o.Expect(delay).To(Equal(2 * time.Second))
+	o.Expect(count).To(Equal(2))
+
+	// Changes keep arriving within the window, so the object is emitted after the max delay.
+	d.observe(key, start.Add(4*time.Second))
+	delay, _ = d.wait(key, start.Add(4*time.Second))
+	o.Expect(delay).To(Equal(time.Second))
+	delay, count = d.wait(key, start.Add(5*time.Second))
+	o.Expect(delay).To(BeZero())
+	o.Expect(count).To(Equal(3))
+
+	// A change seen while the event was being delivered remains pending.
+	d.observe(key, start.Add(5*time.Second))
+	d.emitted(key, 3, start.Add(5*time.Second))
+	_, count = d.wait(key, start.Add(5*time.Second))
+	o.Expect(count).To(Equal(1))
+	d.emitted(key, 1, start.Add(6*time.Second))
+	_, count = d.wait(key, start.Add(6*time.Second))
+	o.Expect(count).To(BeZero())
+}
+
+func TestDebouncerDefaultMaxDelay(t *testing.T) {
+	o := NewWithT(t)
+	o.Expect(newDebouncer(time.Second, 0).maxDelay).To(Equal(10 * time.Second))
+}
+
+func TestFlushDebounced(t *testing.T) {
+	o := NewWithT(t)
+	sender := &recordingSender{}
+	graceful := &delivery.Graceful{Sender: sender}
+	r := &DynamicReconciler{
+		Client:           newJobsClient(),
+		Name:             "jobs",
+		GroupVersionKind: jobGVK,
+		EventsSource:     "localhost",
+		EventsClient:     graceful,
+		debouncer:        newDebouncer(time.Hour, 0),
+	}
+	r.debouncer.observe(types.NamespacedName{Namespace: "default", Name: "job-1"}, time.Now())
+	r.debouncer.observe(types.NamespacedName{Namespace: "default", Name: "job-3"}, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	o.Expect(r.flushDebounced(ctx)).To(Succeed())
+	o.Expect(sender.events).To(HaveLen(2), "pending changes are emitted without waiting for the window")
+	o.Expect(graceful.Drain(context.Background())).To(BeZero())
+}
+
+func TestFlushDebouncedBeforeInitialSync(t *testing.T) {
+	o := NewWithT(t)
+	sender := &recordingSender{}
+	graceful := &delivery.Graceful{Sender: sender}
+	r := &DynamicReconciler{
+		Client:           newJobsClient(),
+		Name:             "jobs",
+		GroupVersionKind: jobGVK,
+		EventsSource:     "localhost",
+		EventsClient:     graceful,
+		InitialSync:      config.InitialSyncNone,
+		initial:          newInitialState(),
+		debouncer:        newDebouncer(time.Hour, 0),
+	}
+	r.debouncer.observe(types.NamespacedName{Namespace: "default", Name: "job-1"}, time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	o.Expect(r.flushDebounced(ctx)).To(Succeed())
+	o.Expect(sender.events).To(BeEmpty())
+	o.Expect(graceful.Drain(context.Background())).To(Equal(1), "changes that cannot be emitted are dropped")
+}
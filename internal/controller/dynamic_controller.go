@@ -19,6 +19,8 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -26,11 +28,31 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
-	cloudeventsclient "github.com/cloudevents/sdk-go/v2/client"
+	"golang.org/x/time/rate"
+
+	"github.com/kubearchive/dynowatch/internal/checkpoint"
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/delivery"
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	// ResourceVersionExtension is the extension attribute holding the resourceVersion of the object
+	// an event is about. It is not set on events for deleted objects.
+	ResourceVersionExtension = "resourceversion"
+	// ObservedLateExtension is set on delete events for objects that were deleted while Dynowatch
+	// was not running.
+	ObservedLateExtension = "observedlate"
 )
 
 // DynamicReconciler reconciles any object with the given GroupVersionKind. When an instance of the
@@ -43,43 +65,208 @@ type DynamicReconciler struct {
 	GroupVersionKind schema.GroupVersionKind
 	EventsSource     string
 	EventsTarget     string
-	EventsClient     cloudeventsclient.Client
+	EventsClient     sink.Sender
+	// DebounceWindow collapses changes to an object into a single event, emitted once the object
+	// has not changed for the window. Changes are emitted at least every DebounceMaxDelay.
+	DebounceWindow   time.Duration
+	DebounceMaxDelay time.Duration
+	// MaxConcurrentReconciles is the number of objects reconciled in parallel. If zero, objects
+	// are reconciled one at a time.
+	MaxConcurrentReconciles int
+	// Limiter limits the rate events are emitted. If nil, the rate is not limited.
+	Limiter *rate.Limiter
+	// Checkpoint records the objects whose state was delivered, so they are not emitted again
+	// after a restart. If nil, every object is emitted when the controller starts.
+	Checkpoint *checkpoint.Checkpoint
+	// InitialSync is how the objects that exist when the controller starts are emitted: one of
+	// config.InitialSyncEvents, config.InitialSyncNone, or config.InitialSyncSnapshot. If empty,
+	// they are emitted as events.
+	InitialSync string
+	// InventoryInterval is how often an inventory of every watched object is emitted, in events of
+	// up to InventoryChunkSize objects. If zero, no inventory is emitted.
+	InventoryInterval  time.Duration
+	InventoryChunkSize int
+	// Namespaces restricts the cache that Run watches objects with to these namespaces. If empty,
+	// objects of every namespace are watched.
+	Namespaces []string
+
+	debouncer *debouncer
+	initial   *initialState
+	// uids records the UID of each object that has been reconciled, by key.
+	uids sync.Map
 }
 
-//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
-//+kubebuilder:rbac:groups=batch,resources=jobs/status,verbs=get;update;patch
-//+kubebuilder:rbac:groups=batch,resources=jobs/finalizers,verbs=update
+// The default configuration watches Jobs. The rights needed by other configurations are printed by
+// the rbac generate command.
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
 
 // Reconcile receives events for the configured object, determines the object's state on the
 // cluster, and emits an appropriate CloudEvent. If the event is not delivered, it is retried via
 // a requeue.
 func (r *DynamicReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := log.FromContext(ctx)
-	eventCtx := cloudevents.ContextWithTarget(ctx, r.EventsTarget)
 
-	obj := r.reconcileTarget()
-	event, err := r.newEvent(req.NamespacedName, obj)
-	if err != nil {
-		log.Error(err, "Failed to create event")
-		return ctrl.Result{}, err
+	if r.Checkpoint != nil {
+		if err := r.Checkpoint.Wait(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
 	}
+	if r.initial != nil {
+		if err := r.initial.wait(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	obj := r.reconcileTarget()
+	found := true
 	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
 		// If not found, return error for requeue
 		if !errors.IsNotFound(err) {
 			return ctrl.Result{}, err
 		}
+		found = false
+	}
+	if found && r.alreadyEmitted(obj) {
+		log.V(1).Info("Skipping object already delivered", "resourceVersion", obj.GetResourceVersion())
+		if r.debouncer != nil {
+			_, coalesced := r.debouncer.wait(req.NamespacedName, time.Now())
+			r.debouncer.emitted(req.NamespacedName, coalesced, time.Now())
+		}
+		return ctrl.Result{}, nil
+	}
+	coalesced := 0
+	if r.debouncer != nil {
+		var delay time.Duration
+		delay, coalesced = r.debouncer.wait(req.NamespacedName, time.Now())
+		// Deletes are emitted right away, since the object will not change again.
+		if found && delay > 0 {
+			return ctrl.Result{RequeueAfter: delay}, nil
+		}
+	}
+	event, err := r.newEvent(req.NamespacedName, obj)
+	if err != nil {
+		log.Error(err, "Failed to create event")
+		return ctrl.Result{}, err
+	}
+	// Deleted objects no longer have a UID, so the UID last seen for the key is used instead.
+	uid := obj.GetUID()
+	if found {
+		r.uids.Store(req.NamespacedName, uid)
+		event.SetExtension(ResourceVersionExtension, obj.GetResourceVersion())
+	} else {
+		uid = r.lastSeenUID(req.NamespacedName)
+	}
+	if uid != "" {
+		event.SetExtension(delivery.ObjectUIDExtension, string(uid))
+	}
+	if coalesced > 0 {
+		event.SetExtension(CoalescedExtension, coalesced)
 	}
 
-	result := r.EventsClient.Send(eventCtx, event)
-	if cloudevents.IsUndelivered(result) {
-		log.Error(result, "Failed to deliver event")
-		return ctrl.Result{}, result
+	if err := r.send(ctx, event); err != nil {
+		log.Error(err, "Failed to deliver event")
+		return ctrl.Result{}, err
+	}
+	if !found {
+		r.uids.Delete(req.NamespacedName)
+	}
+	if r.Checkpoint != nil && found {
+		r.Checkpoint.Record(uid, checkpoint.Entry{
+			Namespace:       req.Namespace,
+			Name:            req.Name,
+			ResourceVersion: obj.GetResourceVersion(),
+		})
+	} else if r.Checkpoint != nil && uid != "" {
+		r.Checkpoint.Remove(uid)
+	}
+	if r.debouncer != nil {
+		r.debouncer.emitted(req.NamespacedName, coalesced, time.Now())
 	}
 	log.Info("Delivered event")
 
 	return ctrl.Result{}, nil
 }
 
+// alreadyEmitted reports whether the current state of obj was emitted by the initial sync, or
+// delivered before the controller restarted.
+func (r *DynamicReconciler) alreadyEmitted(obj client.Object) bool {
+	if r.initial != nil && r.initial.covers(obj.GetUID(), obj.GetResourceVersion()) {
+		return true
+	}
+	return r.Checkpoint != nil && r.Checkpoint.Delivered(obj.GetUID(), obj.GetResourceVersion())
+}
+
+// send emits the event to the events target, waiting for the rate limit if one is set.
+func (r *DynamicReconciler) send(ctx context.Context, event cloudevents.Event) error {
+	if r.Limiter != nil {
+		delay, err := delivery.Wait(ctx, r.Limiter)
+		if delay > 0 {
+			watchThrottled.WithLabelValues(r.Name).Inc()
+			watchThrottledSeconds.WithLabelValues(r.Name).Add(delay.Seconds())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	result := r.EventsClient.Send(cloudevents.ContextWithTarget(ctx, r.EventsTarget), event)
+	if !cloudevents.IsACK(result) {
+		return result
+	}
+	return nil
+}
+
+// lastSeenUID returns the UID of the object with the given key when it was last reconciled, or
+// recorded in the checkpoint.
+func (r *DynamicReconciler) lastSeenUID(key types.NamespacedName) types.UID {
+	if uid, ok := r.uids.Load(key); ok {
+		return uid.(types.UID)
+	}
+	if r.Checkpoint != nil {
+		if uid, ok := r.Checkpoint.UID(key); ok {
+			return uid
+		}
+	}
+	return ""
+}
+
+// emitLateDeletes emits a delete event for each object in the checkpoint that no longer exists
+// when the controller starts. These objects were deleted while Dynowatch was not running, so
+// their events carry the ObservedLateExtension.
+func (r *DynamicReconciler) emitLateDeletes(ctx context.Context) error {
+	if err := r.Checkpoint.Wait(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("waiting for checkpoint: %w", err)
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(r.GroupVersionKind.GroupVersion().WithKind(r.GroupVersionKind.Kind + "List"))
+	if err := r.List(ctx, list); err != nil {
+		return err
+	}
+	present := map[types.UID]bool{}
+	for _, item := range list.Items {
+		present[item.GetUID()] = true
+	}
+
+	log := ctrl.Log.WithName(r.Name)
+	for uid, entry := range r.Checkpoint.Missing(present) {
+		key := types.NamespacedName{Namespace: entry.Namespace, Name: entry.Name}
+		event, err := r.newEvent(key, r.reconcileTarget())
+		if err != nil {
+			return err
+		}
+		event.SetExtension(delivery.ObjectUIDExtension, string(uid))
+		event.SetExtension(ObservedLateExtension, true)
+		if err := r.send(ctx, event); err != nil {
+			log.Error(err, "Failed to deliver late delete event", "namespace", key.Namespace, "name", key.Name)
+			continue
+		}
+		r.Checkpoint.Remove(uid)
+		log.Info("Delivered late delete event", "namespace", key.Namespace, "name", key.Name)
+	}
+	return nil
+}
+
 // reconcileTarget returns an Unstructured instance of the target object to be reconciled, setting
 // the object's GroupVersionKind.
 func (r *DynamicReconciler) reconcileTarget() *unstructured.Unstructured {
@@ -89,23 +276,114 @@ func (r *DynamicReconciler) reconcileTarget() *unstructured.Unstructured {
 }
 
 func (r *DynamicReconciler) newEvent(key types.NamespacedName, obj client.Object) (cloudevents.Event, error) {
+	return NewEvent(r.EventsSource, obj.GetObjectKind().GroupVersionKind(), key)
+}
+
+// NewEvent returns the event emitted for the object of the given kind with the given key.
+func NewEvent(source string, gvk schema.GroupVersionKind, key types.NamespacedName) (cloudevents.Event, error) {
 	event := cloudevents.NewEvent()
-	event.SetSource(r.EventsSource)
+	event.SetSource(source)
 	event.SetType("dynowatch.kubearchive.dev")
 	err := event.SetData(cloudevents.ApplicationJSON, map[string]string{
-		"kind": obj.GetObjectKind().GroupVersionKind().Kind,
-		"apiVersion": fmt.Sprintf("%s/%s", obj.GetObjectKind().GroupVersionKind().Group,
-			obj.GetObjectKind().GroupVersionKind().Version),
-		"namespace": key.Namespace,
-		"name":      key.Name,
+		"kind":       gvk.Kind,
+		"apiVersion": fmt.Sprintf("%s/%s", gvk.Group, gvk.Version),
+		"namespace":  key.Namespace,
+		"name":       key.Name,
 	})
 	return event, err
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DynamicReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	runnables, predicates := r.prepare()
+	for _, runnable := range runnables {
+		if err := mgr.Add(runnable); err != nil {
+			return err
+		}
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(r.reconcileTarget()).
 		Named(r.Name).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		WithEventFilter(predicate.And(predicates...)).
 		Complete(r)
 }
+
+// Run runs the controller until ctx is done. Unlike SetupWithManager, the controller reads objects
+// from its own cache, which is stopped along with it, so it can be used for watches that start and
+// stop while the manager is running.
+func (r *DynamicReconciler) Run(ctx context.Context, mgr ctrl.Manager) error {
+	cacheOptions := cache.Options{Scheme: mgr.GetScheme(), Mapper: mgr.GetRESTMapper()}
+	if len(r.Namespaces) > 0 {
+		cacheOptions.DefaultNamespaces = map[string]cache.Config{}
+		for _, namespace := range r.Namespaces {
+			cacheOptions.DefaultNamespaces[namespace] = cache.Config{}
+		}
+	}
+	watchCache, err := cache.New(mgr.GetConfig(), cacheOptions)
+	if err != nil {
+		return err
+	}
+	r.Client, err = client.New(mgr.GetConfig(), client.Options{
+		Scheme: mgr.GetScheme(),
+		Mapper: mgr.GetRESTMapper(),
+		Cache:  &client.CacheOptions{Reader: watchCache},
+	})
+	if err != nil {
+		return err
+	}
+	runnables, predicates := r.prepare()
+	c, err := controller.NewUnmanaged(r.Name, mgr, controller.Options{
+		Reconciler:              r,
+		MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+	})
+	if err != nil {
+		return err
+	}
+	err = c.Watch(source.Kind(watchCache, r.reconcileTarget()), &handler.EnqueueRequestForObject{}, predicates...)
+	if err != nil {
+		return err
+	}
+	runnables = append([]manager.Runnable{watchCache, c}, runnables...)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(runnables))
+	for _, runnable := range runnables {
+		go func(runnable manager.Runnable) {
+			errs <- runnable.Start(ctx)
+		}(runnable)
+	}
+	var firstErr error
+	for range runnables {
+		// Some runnables return once their work is done; an error stops the others.
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+// prepare returns the runnables that must run along with the controller, and the predicates that
+// filter the changes it reconciles.
+func (r *DynamicReconciler) prepare() ([]manager.Runnable, []predicate.Predicate) {
+	var runnables []manager.Runnable
+	var predicates []predicate.Predicate
+	if r.Checkpoint != nil {
+		runnables = append(runnables, r.Checkpoint, manager.RunnableFunc(r.emitLateDeletes))
+	}
+	if r.InitialSync == config.InitialSyncNone || r.InitialSync == config.InitialSyncSnapshot {
+		r.initial = newInitialState()
+		runnables = append(runnables, manager.RunnableFunc(r.runInitialSync))
+	}
+	if r.InventoryInterval > 0 {
+		runnables = append(runnables, manager.RunnableFunc(r.emitInventories))
+	}
+	if r.DebounceWindow > 0 {
+		r.debouncer = newDebouncer(r.DebounceWindow, r.DebounceMaxDelay)
+		predicates = append(predicates, r.debouncer.predicate())
+		runnables = append(runnables, manager.RunnableFunc(r.flushDebounced))
+	}
+	return runnables, predicates
+}
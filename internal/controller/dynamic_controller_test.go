@@ -17,14 +17,20 @@ limitations under the License.
 package controller
 
 import (
+	"context"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	cloudevents "github.com/cloudevents/sdk-go/v2"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/kubearchive/dynowatch/internal/cloudevents/test"
+	"github.com/kubearchive/dynowatch/internal/delivery"
 )
 
 var _ = Describe("dynamic reconciler", func() {
@@ -86,8 +92,66 @@ var _ = Describe("dynamic reconciler", func() {
 		Expect(k8sClient.Delete(ctx, job)).Should(Succeed(), "delete job fixture")
 		Eventually(ctx, testServer.GetEvents).ShouldNot(BeEmpty())
 	})
+
+	It("delivers the events of a Job from concurrent reconciles in order", func(ctx SpecContext) {
+		By("starting two reconcilers of Jobs that share a sender delivering events in order")
+		orderedServer, err := test.NewTestReceiver(receiverCtx)
+		Expect(err).NotTo(HaveOccurred(), "create cloudevent receiver")
+		orderedServer.Start()
+		defer orderedServer.Close()
+		orderedServer.StartRecorder()
+		// The first event about the Job is rejected, and retried while the other reconciler sends
+		// its own event about the same Job.
+		orderedServer.FailNextFor("ordered-job", 1)
+		eventsClient, err := cloudevents.NewClientHTTP()
+		Expect(err).NotTo(HaveOccurred(), "setting up cloudEvents client")
+		ordered := &delivery.Ordered{Sender: eventsClient, InitialBackoff: time.Second}
+		runCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		for _, name := range []string{"ordered-jobs-a", "ordered-jobs-b"} {
+			reconciler := &DynamicReconciler{
+				Scheme:           k8sManager.GetScheme(),
+				Name:             name,
+				GroupVersionKind: schema.FromAPIVersionAndKind("batch/v1", "Job"),
+				EventsSource:     "test-source",
+				EventsTarget:     orderedServer.URL,
+				EventsClient:     ordered,
+			}
+			go func() {
+				defer GinkgoRecover()
+				Expect(reconciler.Run(runCtx, k8sManager)).To(Succeed(), "run ordered reconciler")
+			}()
+		}
+
+		By("creating a Job object")
+		job := createJobFixture("default", "ordered-job")
+		Expect(k8sClient.Create(ctx, job)).Should(Succeed(), "create job fixture")
+
+		jobEvents := func() []cloudevents.Event {
+			return eventsFor(orderedServer.GetEvents(), "ordered-job")
+		}
+		Eventually(ctx, jobEvents).Should(HaveLen(2))
+		Expect(orderedServer.PendingFailures()).To(BeZero(), "first send is rejected")
+		events := jobEvents()
+		Expect(events[0].Extensions()[delivery.ObjectUIDExtension]).To(Equal(string(job.UID)))
+		Expect(events[0].Extensions()[delivery.SequenceExtension].(string) <
+			events[1].Extensions()[delivery.SequenceExtension].(string)).To(BeTrue(),
+			"the rejected event is delivered before the later event of the other reconciler")
+	})
 })
 
+// eventsFor returns the events about the object with the given name.
+func eventsFor(events []cloudevents.Event, name string) []cloudevents.Event {
+	matching := []cloudevents.Event{}
+	for _, event := range events {
+		data := map[string]string{}
+		if err := event.DataAs(&data); err == nil && data["name"] == name {
+			matching = append(matching, event)
+		}
+	}
+	return matching
+}
+
 func createJobFixture(namespace string, name string) *batchv1.Job {
 	return &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
@@ -0,0 +1,207 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/kubearchive/dynowatch/internal/checkpoint"
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/delivery"
+)
+
+const (
+	// SnapshotBeginType is the type of the event that starts a snapshot.
+	SnapshotBeginType = "dynowatch.kubearchive.dev.snapshot.begin"
+	// SnapshotItemType is the type of the event emitted for each object in a snapshot.
+	SnapshotItemType = "dynowatch.kubearchive.dev.snapshot.item"
+	// SnapshotEndType is the type of the event that ends a snapshot, once every object in it was
+	// emitted.
+	SnapshotEndType = "dynowatch.kubearchive.dev.snapshot.end"
+	// SnapshotIDExtension is the extension attribute holding the ID of the snapshot an event
+	// belongs to.
+	SnapshotIDExtension = "snapshotid"
+)
+
+// initialState records the objects that were emitted, or deliberately not emitted, by the initial
+// sync of a watch, so that reconciling them when the controller starts does not emit them again.
+type initialState struct {
+	mu      sync.Mutex
+	covered map[types.UID]string
+	ready   chan struct{}
+}
+
+func newInitialState() *initialState {
+	return &initialState{ready: make(chan struct{})}
+}
+
+// wait blocks until the initial sync is done, or ctx is done.
+func (s *initialState) wait(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isDone reports whether the initial sync is done, without waiting for it.
+func (s *initialState) isDone() bool {
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// done records the resourceVersion of each object covered by the initial sync, by UID.
+func (s *initialState) done(covered map[types.UID]string) {
+	s.mu.Lock()
+	s.covered = covered
+	s.mu.Unlock()
+	close(s.ready)
+}
+
+// covers reports whether the initial sync covered the object with the given UID and
+// resourceVersion. Each object is only checked once, since any later change must be emitted.
+func (s *initialState) covers(uid types.UID, resourceVersion string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	covered, ok := s.covered[uid]
+	if ok {
+		delete(s.covered, uid)
+	}
+	return ok && covered == resourceVersion
+}
+
+// runInitialSync lists the objects that exist when the controller starts, and emits them according
+// to the InitialSync of the watch. Objects are not reconciled until it returns.
+func (r *DynamicReconciler) runInitialSync(ctx context.Context) error {
+	if r.Checkpoint != nil {
+		if err := r.Checkpoint.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("waiting for checkpoint: %w", err)
+		}
+	}
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(r.GroupVersionKind.GroupVersion().WithKind(r.GroupVersionKind.Kind + "List"))
+	if err := r.List(ctx, list); err != nil {
+		return err
+	}
+
+	log := ctrl.Log.WithName(r.Name)
+	covered := map[types.UID]string{}
+	switch {
+	case r.Checkpoint != nil && r.Checkpoint.Resumed():
+		// The watch was running before, so the consumer already has its objects. Changes made
+		// while it was not running are emitted as events.
+		log.Info("Skipped initial sync of resumed watch")
+	case r.InitialSync == config.InitialSyncNone:
+		for _, item := range list.Items {
+			covered[item.GetUID()] = item.GetResourceVersion()
+		}
+		log.Info("Skipped existing objects", "objects", len(list.Items))
+	default:
+		r.emitSnapshot(ctx, list.Items, covered)
+	}
+	r.initial.done(covered)
+	return nil
+}
+
+// emitSnapshot emits a snapshot.begin event, a snapshot.item event for each object, and a
+// snapshot.end event with the number of objects emitted. Objects whose item event was delivered
+// are added to covered; the others are emitted as events when they are reconciled.
+func (r *DynamicReconciler) emitSnapshot(ctx context.Context, items []unstructured.Unstructured,
+	covered map[types.UID]string) {
+	log := ctrl.Log.WithName(r.Name)
+	id := uuid.NewString()
+	begin := r.newSnapshotEvent(SnapshotBeginType, id, map[string]any{"objects": len(items)})
+	if err := r.send(ctx, begin); err != nil {
+		log.Error(err, "Failed to deliver snapshot begin event, emitting existing objects as events")
+		return
+	}
+
+	failed := 0
+	for i := range items {
+		item := &items[i]
+		key := types.NamespacedName{Namespace: item.GetNamespace(), Name: item.GetName()}
+		event, err := r.newEvent(key, item)
+		if err != nil {
+			log.Error(err, "Failed to create snapshot item event", "namespace", key.Namespace, "name", key.Name)
+			failed++
+			continue
+		}
+		event.SetType(SnapshotItemType)
+		event.SetExtension(SnapshotIDExtension, id)
+		event.SetExtension(delivery.ObjectUIDExtension, string(item.GetUID()))
+		event.SetExtension(ResourceVersionExtension, item.GetResourceVersion())
+		if err := r.send(ctx, event); err != nil {
+			log.Error(err, "Failed to deliver snapshot item event", "namespace", key.Namespace, "name", key.Name)
+			failed++
+			continue
+		}
+		r.uids.Store(key, item.GetUID())
+		covered[item.GetUID()] = item.GetResourceVersion()
+		if r.Checkpoint != nil {
+			r.Checkpoint.Record(item.GetUID(), checkpoint.Entry{
+				Namespace:       key.Namespace,
+				Name:            key.Name,
+				ResourceVersion: item.GetResourceVersion(),
+			})
+		}
+	}
+
+	end := r.newSnapshotEvent(SnapshotEndType, id, map[string]any{
+		"objects": len(items) - failed,
+		"failed":  failed,
+	})
+	if err := r.send(ctx, end); err != nil {
+		log.Error(err, "Failed to deliver snapshot end event", "snapshot", id)
+		return
+	}
+	log.Info("Delivered snapshot", "snapshot", id, "objects", len(items)-failed, "failed", failed)
+}
+
+// newSnapshotEvent returns a snapshot.begin or snapshot.end event, with the kind of the watched
+// objects and the given counts as its data.
+func (r *DynamicReconciler) newSnapshotEvent(eventType string, id string, counts map[string]any) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetSource(r.EventsSource)
+	event.SetType(eventType)
+	event.SetExtension(SnapshotIDExtension, id)
+	data := map[string]any{
+		"kind":       r.GroupVersionKind.Kind,
+		"apiVersion": fmt.Sprintf("%s/%s", r.GroupVersionKind.Group, r.GroupVersionKind.Version),
+	}
+	for name, count := range counts {
+		data[name] = count
+	}
+	// The data is a map of strings and ints, so it can always be encoded.
+	_ = event.SetData(cloudevents.ApplicationJSON, data)
+	return event
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// recordingSender ACKs every event, and records it.
+type recordingSender struct {
+	mu     sync.Mutex
+	events []cloudevents.Event
+}
+
+func (s *recordingSender) Send(_ context.Context, event cloudevents.Event) protocol.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// newJobsClient returns a client that serves the Jobs job-1 and job-2 in the default namespace.
+func newJobsClient() client.Client {
+	return fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job-1", UID: "uid-1"}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job-2", UID: "uid-2"}},
+	).Build()
+}
+
+var jobGVK = schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}
+
+func TestInitialSyncSnapshot(t *testing.T) {
+	o := NewWithT(t)
+	sender := &recordingSender{}
+	r := &DynamicReconciler{
+		Client:           newJobsClient(),
+		Name:             "jobs",
+		GroupVersionKind: jobGVK,
+		EventsSource:     "localhost",
+		EventsClient:     sender,
+		InitialSync:      config.InitialSyncSnapshot,
+		initial:          newInitialState(),
+	}
+
+	o.Expect(r.runInitialSync(context.Background())).To(Succeed())
+	o.Expect(r.initial.wait(context.Background())).To(Succeed())
+	o.Expect(sender.events).To(HaveLen(4))
+	eventTypes := []string{}
+	for _, event := range sender.events {
+		eventTypes = append(eventTypes, event.Type())
+		o.Expect(event.Extensions()).To(HaveKeyWithValue(SnapshotIDExtension, sender.events[0].Extensions()[SnapshotIDExtension]))
+	}
+	o.Expect(eventTypes).To(Equal([]string{SnapshotBeginType, SnapshotItemType, SnapshotItemType, SnapshotEndType}))
+	o.Expect(string(sender.events[3].Data())).To(MatchJSON(
+		`{"kind":"Job","apiVersion":"batch/v1","objects":2,"failed":0}`))
+
+	job := &batchv1.Job{}
+	o.Expect(r.Get(context.Background(), keyOf("job-1"), job)).To(Succeed())
+	o.Expect(r.initial.covers("uid-1", job.ResourceVersion)).To(BeTrue(), "snapshot items are not emitted again")
+	o.Expect(r.initial.covers("uid-1", job.ResourceVersion)).To(BeFalse(), "later reconciles are emitted")
+	o.Expect(r.initial.covers("uid-2", "changed")).To(BeFalse(), "objects changed since the snapshot are emitted")
+}
+
+func TestInitialSyncNone(t *testing.T) {
+	o := NewWithT(t)
+	sender := &recordingSender{}
+	r := &DynamicReconciler{
+		Client:           newJobsClient(),
+		Name:             "jobs",
+		GroupVersionKind: jobGVK,
+		EventsClient:     sender,
+		InitialSync:      config.InitialSyncNone,
+		initial:          newInitialState(),
+	}
+
+	o.Expect(r.runInitialSync(context.Background())).To(Succeed())
+	o.Expect(sender.events).To(BeEmpty())
+	job := &batchv1.Job{}
+	o.Expect(r.Get(context.Background(), keyOf("job-2"), job)).To(Succeed())
+	o.Expect(r.alreadyEmitted(job)).To(BeTrue())
+	o.Expect(r.initial.covers("uid-3", "1")).To(BeFalse(), "objects created later are emitted")
+}
+
+func keyOf(name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: "default", Name: name}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/google/uuid"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// InventoryType is the type of the events that list every object of a watch.
+	InventoryType = "dynowatch.kubearchive.dev.inventory"
+	// InventoryIDExtension is the extension attribute holding the ID of the inventory an event
+	// belongs to. Large inventories are split into several events with the same ID.
+	InventoryIDExtension = "inventoryid"
+
+	defaultInventoryChunkSize = 1000
+)
+
+// inventoryObject is an object listed in an inventory event.
+type inventoryObject struct {
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name"`
+	UID             string `json:"uid"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+// inventoryData is the data of an inventory event. Chunk is the index of the event within the
+// inventory, starting at zero, and Total is the number of objects in the whole inventory.
+type inventoryData struct {
+	Kind       string            `json:"kind"`
+	APIVersion string            `json:"apiVersion"`
+	Chunk      int               `json:"chunk"`
+	Chunks     int               `json:"chunks"`
+	Total      int               `json:"total"`
+	Objects    []inventoryObject `json:"objects"`
+}
+
+// emitInventories emits an inventory of the watched objects every InventoryInterval, until ctx is
+// cancelled.
+func (r *DynamicReconciler) emitInventories(ctx context.Context) error {
+	ticker := time.NewTicker(r.InventoryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.emitInventory(ctx); err != nil {
+				ctrl.Log.WithName(r.Name).Error(err, "Failed to deliver inventory")
+			}
+		}
+	}
+}
+
+// emitInventory lists the watched objects from the cache, and emits their UID and resourceVersion
+// in inventory events of up to InventoryChunkSize objects each.
+func (r *DynamicReconciler) emitInventory(ctx context.Context) error {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(r.GroupVersionKind.GroupVersion().WithKind(r.GroupVersionKind.Kind + "List"))
+	if err := r.List(ctx, list); err != nil {
+		return err
+	}
+	objects := make([]inventoryObject, 0, len(list.Items))
+	for _, item := range list.Items {
+		objects = append(objects, inventoryObject{
+			Namespace:       item.GetNamespace(),
+			Name:            item.GetName(),
+			UID:             string(item.GetUID()),
+			ResourceVersion: item.GetResourceVersion(),
+		})
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Namespace != objects[j].Namespace {
+			return objects[i].Namespace < objects[j].Namespace
+		}
+		return objects[i].Name < objects[j].Name
+	})
+
+	chunkSize := r.InventoryChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultInventoryChunkSize
+	}
+	// An empty inventory is still emitted, so consumers know that every object was deleted.
+	chunks := (len(objects) + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	id := uuid.NewString()
+	for chunk := 0; chunk < chunks; chunk++ {
+		start := chunk * chunkSize
+		end := start + chunkSize
+		if end > len(objects) {
+			end = len(objects)
+		}
+		event := cloudevents.NewEvent()
+		event.SetSource(r.EventsSource)
+		event.SetType(InventoryType)
+		event.SetExtension(InventoryIDExtension, id)
+		err := event.SetData(cloudevents.ApplicationJSON, inventoryData{
+			Kind:       r.GroupVersionKind.Kind,
+			APIVersion: fmt.Sprintf("%s/%s", r.GroupVersionKind.Group, r.GroupVersionKind.Version),
+			Chunk:      chunk,
+			Chunks:     chunks,
+			Total:      len(objects),
+			Objects:    objects[start:end],
+		})
+		if err != nil {
+			return err
+		}
+		if err := r.send(ctx, event); err != nil {
+			return err
+		}
+	}
+	ctrl.Log.WithName(r.Name).V(1).Info("Delivered inventory", "inventory", id, "objects", len(objects), "chunks", chunks)
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestEmitInventory(t *testing.T) {
+	o := NewWithT(t)
+	sender := &recordingSender{}
+	r := &DynamicReconciler{
+		Client:             newJobsClient(),
+		Name:               "jobs",
+		GroupVersionKind:   jobGVK,
+		EventsSource:       "localhost",
+		EventsClient:       sender,
+		InventoryChunkSize: 1,
+	}
+
+	o.Expect(r.emitInventory(context.Background())).To(Succeed())
+	o.Expect(sender.events).To(HaveLen(2))
+	for i, event := range sender.events {
+		o.Expect(event.Type()).To(Equal(InventoryType))
+		o.Expect(event.Extensions()).To(HaveKeyWithValue(InventoryIDExtension, sender.events[0].Extensions()[InventoryIDExtension]))
+		data := inventoryData{}
+		o.Expect(json.Unmarshal(event.Data(), &data)).To(Succeed())
+		o.Expect(data.Kind).To(Equal("Job"))
+		o.Expect(data.APIVersion).To(Equal("batch/v1"))
+		o.Expect(data.Chunk).To(Equal(i))
+		o.Expect(data.Chunks).To(Equal(2))
+		o.Expect(data.Total).To(Equal(2))
+		o.Expect(data.Objects).To(HaveLen(1))
+	}
+	data := inventoryData{}
+	o.Expect(json.Unmarshal(sender.events[1].Data(), &data)).To(Succeed())
+	o.Expect(data.Objects[0].Name).To(Equal("job-2"), "objects are sorted by namespace and name")
+	o.Expect(data.Objects[0].UID).To(Equal("uid-2"))
+	o.Expect(data.Objects[0].ResourceVersion).NotTo(BeEmpty())
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	watchThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynowatch_watch_throttled_events_total",
+		Help: "Total number of events delayed by the rate limit of a watch",
+	}, []string{"watch"})
+	watchThrottledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynowatch_watch_throttled_seconds_total",
+		Help: "Total time events waited for the rate limit of a watch",
+	}, []string{"watch"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(watchThrottled, watchThrottledSeconds)
+}
@@ -49,6 +49,7 @@ var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
 var testServer *test.TestReceiver
+var k8sManager ctrl.Manager
 var controllerCtx context.Context
 var controllerCancel context.CancelFunc
 var receiverCtx context.Context
@@ -106,7 +107,7 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred(), "create dynamic k8s client")
 	Expect(k8sClient).NotTo(BeNil(), "dynamic k8s client")
 
-	k8sManager, err := ctrl.NewManager(cfg, ctrl.Options{
+	k8sManager, err = ctrl.NewManager(cfg, ctrl.Options{
 		Scheme: scheme.Scheme,
 	})
 	Expect(err).NotTo(HaveOccurred(), "creating controller manager")
@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned when an event is not sent because the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitBreaker is a Sender that stops sending events after FailureThreshold consecutive
+// deliveries fail with a retryable error, such as a connection error or a 5xx response. While the
+// circuit is open, events fail immediately with ErrCircuitOpen. After OpenDuration, the circuit is
+// half-open and a single event is sent to probe the sink. The circuit is closed if the probe is
+// delivered, and opened again otherwise.
+type CircuitBreaker struct {
+	Sender           sink.Sender
+	Name             string
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *CircuitBreaker) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	if !b.allow(time.Now()) {
+		breakerRejected.WithLabelValues(b.Name).Inc()
+		return ErrCircuitOpen
+	}
+	result := b.Sender.Send(ctx, event)
+	b.record(result, ctx.Err() != nil, time.Now())
+	return result
+}
+
+// Check is a healthz.Checker that fails while the circuit is not closed.
+func (b *CircuitBreaker) Check(_ *http.Request) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitClosed {
+		return fmt.Errorf("circuit breaker for %s is open", b.Name)
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.openDuration() {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the state of the circuit with the result of a delivery. Non-retryable failures
+// mean the sink is reachable, so they count as successes. Deliveries cancelled by the caller are
+// not counted.
+func (b *CircuitBreaker) record(result protocol.Result, cancelled bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	failed := !cloudevents.IsACK(result) && IsRetryable(result)
+	switch {
+	case failed && cancelled:
+		return
+	case failed:
+		b.failures++
+		if b.state == circuitHalfOpen || b.failures >= b.failureThreshold() {
+			if b.state != circuitOpen {
+				log.Info("Circuit breaker opened", "sink", b.Name, "failures", b.failures)
+			}
+			b.state = circuitOpen
+			b.openedAt = now
+			breakerOpen.WithLabelValues(b.Name).Set(1)
+		}
+	default:
+		if b.state != circuitClosed {
+			log.Info("Circuit breaker closed", "sink", b.Name)
+		}
+		b.failures = 0
+		b.state = circuitClosed
+		breakerOpen.WithLabelValues(b.Name).Set(0)
+	}
+}
+
+func (b *CircuitBreaker) failureThreshold() int {
+	if b.FailureThreshold == 0 {
+		return defaultFailureThreshold
+	}
+	return b.FailureThreshold
+}
+
+func (b *CircuitBreaker) openDuration() time.Duration {
+	if b.OpenDuration == 0 {
+		return defaultOpenDuration
+	}
+	return b.OpenDuration
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	o := NewWithT(t)
+	unavailable := nack(http.StatusServiceUnavailable)
+	primary := &fakeSender{results: []protocol.Result{unavailable, unavailable, unavailable}}
+	breaker := &CircuitBreaker{Sender: primary, Name: "test", FailureThreshold: 2, OpenDuration: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	o.Expect(breaker.Send(ctx, newTestEvent("1"))).To(Equal(unavailable))
+	o.Expect(breaker.Check(nil)).To(Succeed())
+	o.Expect(breaker.Send(ctx, newTestEvent("2"))).To(Equal(unavailable))
+	o.Expect(breaker.Check(nil)).NotTo(Succeed(), "circuit opens after the failure threshold")
+
+	result := breaker.Send(ctx, newTestEvent("3"))
+	o.Expect(errors.Is(result, ErrCircuitOpen)).To(BeTrue())
+	o.Expect(primary.sent()).To(HaveLen(2), "events are not sent while the circuit is open")
+
+	time.Sleep(60 * time.Millisecond)
+	o.Expect(breaker.Send(ctx, newTestEvent("4"))).To(Equal(unavailable))
+	o.Expect(errors.Is(breaker.Send(ctx, newTestEvent("5")), ErrCircuitOpen)).To(BeTrue(),
+		"a failed probe opens the circuit again")
+
+	time.Sleep(60 * time.Millisecond)
+	o.Expect(cloudevents.IsACK(breaker.Send(ctx, newTestEvent("6")))).To(BeTrue())
+	o.Expect(breaker.Check(nil)).To(Succeed(), "a delivered probe closes the circuit")
+	o.Expect(primary.sent()).To(HaveLen(4))
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	o := NewWithT(t)
+	badRequest := nack(http.StatusBadRequest)
+	primary := &fakeSender{results: []protocol.Result{badRequest, badRequest}}
+	breaker := &CircuitBreaker{Sender: primary, FailureThreshold: 1}
+	o.Expect(breaker.Send(context.Background(), newTestEvent("1"))).To(Equal(badRequest))
+	o.Expect(breaker.Send(context.Background(), newTestEvent("2"))).To(Equal(badRequest))
+	o.Expect(breaker.Check(nil)).To(Succeed())
+}
+
+func TestRetryWithCircuitOpen(t *testing.T) {
+	o := NewWithT(t)
+	primary := &fakeSender{results: []protocol.Result{ErrCircuitOpen}}
+	retry := &Retry{Sender: primary, MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	result := retry.Send(context.Background(), newTestEvent("1"))
+	o.Expect(errors.Is(result, ErrCircuitOpen)).To(BeTrue())
+	o.Expect(primary.sent()).To(HaveLen(1), "events rejected by an open circuit are not retried")
+}
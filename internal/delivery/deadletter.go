@@ -0,0 +1,122 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+// Extension attributes set on events routed to a dead-letter sink.
+const (
+	DeadLetterReasonExtension   = "deadletterreason"
+	DeadLetterAttemptsExtension = "deadletterattempts"
+	DeadLetterTargetExtension   = "deadlettertarget"
+)
+
+var log = ctrl.Log.WithName("delivery")
+
+// DeadLetter is a Sender that routes events that could not be delivered to a dead-letter sink,
+// instead of failing. The event is annotated with extension attributes that describe the reason
+// of the failure, the number of attempts, and the original target. An error is only returned if
+// the event could not be delivered to the dead-letter sink either.
+type DeadLetter struct {
+	Sender     sink.Sender
+	DeadLetter sink.Sender
+}
+
+func (d *DeadLetter) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	result := d.Sender.Send(ctx, event)
+	// Events are not dead-lettered when they fail because dynowatch is shutting down, or because
+	// the sink is known to be unavailable.
+	if cloudevents.IsACK(result) || ctx.Err() != nil || errors.Is(result, ErrCircuitOpen) {
+		return result
+	}
+	attempts := 1
+	var deliveryErr *Error
+	if errors.As(result, &deliveryErr) {
+		attempts = deliveryErr.Attempts
+		result = deliveryErr.Result
+	}
+
+	deadLetter := event.Clone()
+	deadLetter.SetExtension(DeadLetterReasonExtension, result.Error())
+	deadLetter.SetExtension(DeadLetterAttemptsExtension, int32(attempts))
+	if target := cecontext.TargetFrom(ctx); target != nil {
+		deadLetter.SetExtension(DeadLetterTargetExtension, target.String())
+	}
+	if dlResult := d.DeadLetter.Send(ctx, deadLetter); !cloudevents.IsACK(dlResult) {
+		return fmt.Errorf("%w; sending to dead-letter sink: %v", result, dlResult)
+	}
+	deadLettered.Inc()
+	log.Info("Sent undeliverable event to dead-letter sink", "id", event.ID(), "attempts", attempts,
+		"reason", result.Error())
+	return nil
+}
+
+// Redrive sends the events in a dead-letter file written by sink.FileSender to sender again. The
+// dead-letter extension attributes are removed before the events are sent. The file is moved aside
+// while it is processed, so dynowatch can keep writing new dead-lettered events, and events that
+// fail again are appended back to it. Redrive returns the number of events that were delivered and
+// the number that failed.
+func Redrive(ctx context.Context, path string, sender sink.Sender) (int, int, error) {
+	work := path + ".redrive"
+	// A leftover work file means a previous redrive was interrupted, and is processed first.
+	if _, err := os.Stat(work); errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(path, work); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return 0, 0, nil
+			}
+			return 0, 0, err
+		}
+	}
+	events, err := sink.ReadEventsFile(work)
+	if err != nil {
+		return 0, 0, err
+	}
+	deadLetter, err := sink.NewFileSender(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	delivered, failed := 0, 0
+	for _, event := range events {
+		redriven := event.Clone()
+		redriven.SetExtension(DeadLetterReasonExtension, nil)
+		redriven.SetExtension(DeadLetterAttemptsExtension, nil)
+		redriven.SetExtension(DeadLetterTargetExtension, nil)
+		result := sender.Send(ctx, redriven)
+		if cloudevents.IsACK(result) {
+			delivered++
+			continue
+		}
+		failed++
+		event.SetExtension(DeadLetterReasonExtension, result.Error())
+		if result := deadLetter.Send(ctx, event); !cloudevents.IsACK(result) {
+			return delivered, failed, fmt.Errorf("writing event %s back to %s: %w", event.ID(), path, result)
+		}
+	}
+	return delivered, failed, os.Remove(work)
+}
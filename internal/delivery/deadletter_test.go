@@ -0,0 +1,153 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+// fakeSender returns the queued results in order, then ACKs. Every event it is asked to send is
+// recorded.
+type fakeSender struct {
+	mu      sync.Mutex
+	results []protocol.Result
+	events  []cloudevents.Event
+}
+
+func (f *fakeSender) Send(_ context.Context, event cloudevents.Event) protocol.Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	if len(f.results) == 0 {
+		return nil
+	}
+	result := f.results[0]
+	f.results = f.results[1:]
+	return result
+}
+
+func (f *fakeSender) sent() []cloudevents.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]cloudevents.Event{}, f.events...)
+}
+
+func newTestEvent(id string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetSource("test-source")
+	event.SetType("dynowatch.kubearchive.dev")
+	return event
+}
+
+func nack(status int) protocol.Result {
+	return cehttp.NewResult(status, "%w", protocol.ResultNACK)
+}
+
+func TestIsRetryable(t *testing.T) {
+	o := NewWithT(t)
+	o.Expect(IsRetryable(nil)).To(BeFalse())
+	o.Expect(IsRetryable(errors.New("connection refused"))).To(BeTrue())
+	o.Expect(IsRetryable(nack(http.StatusServiceUnavailable))).To(BeTrue())
+	o.Expect(IsRetryable(nack(http.StatusTooManyRequests))).To(BeTrue())
+	o.Expect(IsRetryable(nack(http.StatusBadRequest))).To(BeFalse())
+	o.Expect(IsRetryable(cloudevents.NewEvent().Validate())).To(BeFalse())
+}
+
+func TestRetry(t *testing.T) {
+	o := NewWithT(t)
+	primary := &fakeSender{results: []protocol.Result{nack(http.StatusServiceUnavailable)}}
+	retry := &Retry{Sender: primary, MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	o.Expect(cloudevents.IsACK(retry.Send(context.Background(), newTestEvent("1")))).To(BeTrue())
+	o.Expect(primary.sent()).To(HaveLen(2))
+
+	primary = &fakeSender{results: []protocol.Result{nack(http.StatusBadRequest)}}
+	retry = &Retry{Sender: primary, MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	result := retry.Send(context.Background(), newTestEvent("1"))
+	o.Expect(result).To(BeAssignableToTypeOf(&Error{}))
+	o.Expect(result.(*Error).Attempts).To(Equal(1), "4xx responses are not retried")
+}
+
+func TestDeadLetter(t *testing.T) {
+	o := NewWithT(t)
+	ctx := cloudevents.ContextWithTarget(context.Background(), "http://localhost:8082")
+	primary := &fakeSender{results: []protocol.Result{
+		nack(http.StatusServiceUnavailable),
+		nack(http.StatusServiceUnavailable),
+	}}
+	deadLetter := &fakeSender{}
+	sender := &DeadLetter{
+		Sender:     &Retry{Sender: primary, MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		DeadLetter: deadLetter,
+	}
+
+	o.Expect(cloudevents.IsACK(sender.Send(ctx, newTestEvent("1")))).To(BeTrue())
+	o.Expect(primary.sent()).To(HaveLen(2))
+	o.Expect(deadLetter.sent()).To(HaveLen(1))
+	extensions := deadLetter.sent()[0].Extensions()
+	o.Expect(extensions).To(HaveKeyWithValue(DeadLetterAttemptsExtension, int32(2)))
+	o.Expect(extensions).To(HaveKeyWithValue(DeadLetterTargetExtension, "http://localhost:8082"))
+	o.Expect(extensions).To(HaveKeyWithValue(DeadLetterReasonExtension, ContainSubstring("503")))
+
+	deadLetter.results = []protocol.Result{errors.New("disk full")}
+	primary.results = []protocol.Result{nack(http.StatusBadRequest)}
+	o.Expect(cloudevents.IsACK(sender.Send(ctx, newTestEvent("2")))).To(BeFalse(),
+		"fails if the dead-letter sink fails")
+}
+
+func TestRedrive(t *testing.T) {
+	o := NewWithT(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "dead-letter.jsonl")
+	fileSink, err := sink.NewFileSender(path)
+	o.Expect(err).NotTo(HaveOccurred())
+	primary := &fakeSender{results: []protocol.Result{
+		nack(http.StatusBadRequest),
+		nack(http.StatusBadRequest),
+		nack(http.StatusBadRequest),
+	}}
+	sender := &DeadLetter{Sender: &Retry{Sender: primary, MaxAttempts: 1}, DeadLetter: fileSink}
+	for _, id := range []string{"1", "2", "3"} {
+		o.Expect(cloudevents.IsACK(sender.Send(ctx, newTestEvent(id)))).To(BeTrue())
+	}
+
+	redriveTarget := &fakeSender{results: []protocol.Result{nil, nack(http.StatusBadRequest)}}
+	delivered, failed, err := Redrive(ctx, path, redriveTarget)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(delivered).To(Equal(2))
+	o.Expect(failed).To(Equal(1))
+	o.Expect(redriveTarget.sent()[0].Extensions()).NotTo(HaveKey(DeadLetterReasonExtension))
+
+	remaining, err := sink.ReadEventsFile(path)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(remaining).To(HaveLen(1))
+	o.Expect(remaining[0].ID()).To(Equal("2"))
+}
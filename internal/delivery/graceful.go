@@ -0,0 +1,158 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+// Graceful is a Sender that lets in-flight deliveries finish when the manager shuts down. Events
+// are sent with a context that keeps the values of the caller's context, but is not cancelled with
+// it, so that stopping the controllers does not abandon events that are being delivered. In-flight
+// deliveries are only cancelled if Drain runs out of time.
+//
+// Events that are about to be sent while shutting down, such as changes held back by a debounce
+// window, can be reserved with Reserve, so that Drain waits for them and counts them as dropped if
+// they are not sent in time.
+type Graceful struct {
+	Sender sink.Sender
+
+	initOnce sync.Once
+	abortCtx context.Context
+	abort    context.CancelFunc
+
+	mu       sync.Mutex
+	inflight int
+	// dropped counts the reserved events that were not sent.
+	dropped int
+	idle    chan struct{}
+}
+
+// reservationKey is the context key of the reservation of an event.
+type reservationKey struct{}
+
+// reservation is an event counted as in flight before it is sent.
+type reservation struct {
+	graceful *Graceful
+	// sent is set once the event is sent, from which point Send accounts for it.
+	sent bool
+	done bool
+}
+
+func (g *Graceful) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	g.init()
+	g.mu.Lock()
+	if r, ok := ctx.Value(reservationKey{}).(*reservation); ok && r.graceful == g && !r.sent && !r.done {
+		// The event was already counted as in flight when it was reserved.
+		r.sent = true
+	} else {
+		g.inflight++
+	}
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.doneLocked()
+	}()
+	return g.Sender.Send(&detachedContext{Context: g.abortCtx, values: ctx}, event)
+}
+
+// Reserve counts an event that is about to be sent as in flight, so that Drain waits for it. The
+// event must be sent with the returned context. release must be called once the event was sent, or
+// will not be sent; if dropped is true, the event is counted as dropped by Drain.
+func (g *Graceful) Reserve(ctx context.Context) (context.Context, func(dropped bool)) {
+	g.init()
+	r := &reservation{graceful: g}
+	g.mu.Lock()
+	g.inflight++
+	g.mu.Unlock()
+	return context.WithValue(ctx, reservationKey{}, r), func(dropped bool) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if r.done {
+			return
+		}
+		r.done = true
+		if dropped {
+			g.dropped++
+		}
+		if !r.sent {
+			g.doneLocked()
+		}
+	}
+}
+
+// doneLocked records that an event is no longer in flight. g.mu must be held.
+func (g *Graceful) doneLocked() {
+	g.inflight--
+	if g.inflight == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// Drain waits for in-flight deliveries to finish, including reserved events. If ctx is done first,
+// the remaining deliveries are cancelled. Drain returns the number of events that were dropped:
+// the remaining deliveries, and the reserved events that were not sent.
+func (g *Graceful) Drain(ctx context.Context) int {
+	g.init()
+	g.mu.Lock()
+	if g.inflight == 0 {
+		defer g.mu.Unlock()
+		return g.dropped
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.dropped
+	case <-ctx.Done():
+	}
+	g.mu.Lock()
+	dropped := g.inflight + g.dropped
+	g.mu.Unlock()
+	g.abort()
+	return dropped
+}
+
+func (g *Graceful) init() {
+	g.initOnce.Do(func() {
+		g.abortCtx, g.abort = context.WithCancel(context.Background())
+	})
+}
+
+// detachedContext carries the values of another context, without its deadline and cancellation.
+type detachedContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c *detachedContext) Value(key any) any {
+	return c.values.Value(key)
+}
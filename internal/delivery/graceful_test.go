@@ -0,0 +1,128 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+)
+
+// blockingSender blocks until release is closed or the context is done.
+type blockingSender struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSender) Send(ctx context.Context, _ cloudevents.Event) protocol.Result {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestGraceful(t *testing.T) {
+	o := NewWithT(t)
+	sender := &blockingSender{started: make(chan struct{}, 1), release: make(chan struct{})}
+	graceful := &Graceful{Sender: sender}
+	ctx, cancel := context.WithCancel(cloudevents.ContextWithTarget(context.Background(), "http://localhost"))
+
+	results := make(chan protocol.Result, 1)
+	go func() {
+		results <- graceful.Send(ctx, newTestEvent("1"))
+	}()
+	<-sender.started
+	cancel()
+	o.Consistently(results, 50*time.Millisecond).ShouldNot(Receive(), "delivery is not cancelled with the caller")
+
+	drained := make(chan int, 1)
+	go func() {
+		drained <- graceful.Drain(context.Background())
+	}()
+	close(sender.release)
+	o.Eventually(drained).Should(Receive(BeZero()))
+	o.Expect(cloudevents.IsACK(<-results)).To(BeTrue())
+}
+
+func TestGracefulDrainTimeout(t *testing.T) {
+	o := NewWithT(t)
+	sender := &blockingSender{started: make(chan struct{}, 2), release: make(chan struct{})}
+	graceful := &Graceful{Sender: sender}
+	o.Expect(graceful.Drain(context.Background())).To(BeZero())
+
+	results := make(chan protocol.Result, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- graceful.Send(context.Background(), newTestEvent("1"))
+		}()
+		<-sender.started
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	o.Expect(graceful.Drain(ctx)).To(Equal(2))
+	o.Expect(<-results).To(MatchError(context.Canceled), "remaining deliveries are cancelled")
+}
+
+func TestGracefulReserve(t *testing.T) {
+	o := NewWithT(t)
+	sender := &blockingSender{started: make(chan struct{}, 3), release: make(chan struct{})}
+	graceful := &Graceful{Sender: sender}
+	sentCtx, releaseSent := graceful.Reserve(context.Background())
+	_, releaseSkipped := graceful.Reserve(context.Background())
+	_, releaseFailed := graceful.Reserve(context.Background())
+	_, releaseWaiting := graceful.Reserve(context.Background())
+	defer releaseWaiting(true)
+
+	result := make(chan protocol.Result, 1)
+	go func() {
+		result <- graceful.Send(sentCtx, newTestEvent("1"))
+	}()
+	<-sender.started
+	releaseSkipped(false)
+	releaseFailed(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	o.Expect(graceful.Drain(ctx)).To(Equal(3),
+		"the event being sent, the reserved event not sent yet, and the failed event are dropped")
+	o.Expect(<-result).To(MatchError(context.Canceled))
+	releaseSent(true)
+}
+
+func TestGracefulReserveDrained(t *testing.T) {
+	o := NewWithT(t)
+	sender := &blockingSender{started: make(chan struct{}, 1), release: make(chan struct{})}
+	close(sender.release)
+	graceful := &Graceful{Sender: sender}
+	ctx, release := graceful.Reserve(context.Background())
+
+	drained := make(chan int, 1)
+	go func() {
+		drained <- graceful.Drain(context.Background())
+	}()
+	o.Consistently(drained, 50*time.Millisecond).ShouldNot(Receive(), "Drain waits for reserved events")
+	o.Expect(graceful.Send(ctx, newTestEvent("1"))).To(Succeed())
+	release(false)
+	o.Eventually(drained).Should(Receive(BeZero()))
+}
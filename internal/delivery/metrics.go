@@ -0,0 +1,58 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	deadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynowatch_dead_lettered_events_total",
+		Help: "Total number of events sent to the dead-letter sink",
+	})
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynowatch_delivery_retries_total",
+		Help: "Total number of retried attempts to deliver an event",
+	}, []string{"sink"})
+	breakerOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "dynowatch_circuit_breaker_open",
+		Help: "Whether the circuit breaker for a sink is open (1) or closed (0)",
+	}, []string{"sink"})
+	breakerRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynowatch_circuit_breaker_rejected_total",
+		Help: "Total number of events rejected because the circuit breaker for a sink is open",
+	}, []string{"sink"})
+	orderedBacklog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dynowatch_ordered_backlog",
+		Help: "Number of events waiting for earlier events of the same object to be delivered",
+	})
+	sinkThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynowatch_sink_throttled_events_total",
+		Help: "Total number of events delayed by the rate limit of a sink",
+	}, []string{"sink"})
+	sinkThrottledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynowatch_sink_throttled_seconds_total",
+		Help: "Total time events waited for the rate limit of a sink",
+	}, []string{"sink"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(deadLettered, retries, breakerOpen, breakerRejected, orderedBacklog,
+		sinkThrottled, sinkThrottledSeconds)
+}
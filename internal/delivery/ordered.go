@@ -0,0 +1,152 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	// ObjectUIDExtension is the extension attribute holding the UID of the object an event is
+	// about. Events with the same UID are delivered in order by Ordered.
+	ObjectUIDExtension = "objectuid"
+	// SequenceExtension is the CloudEvents sequence extension attribute set by Ordered.
+	SequenceExtension = "sequence"
+)
+
+// Ordered is a Sender that delivers the events of each object strictly in the order they were
+// sent. Send blocks until the event is delivered: events for the same object UID are delivered one
+// at a time, each waiting for the earlier events of the object, and a failed event is retried with
+// exponential backoff, including while the circuit breaker of the sink is open. Events for
+// different objects are delivered concurrently, and so are events without an object UID, which are
+// not ordered. Events that cannot be retried are not dropped; the failure is returned to the
+// caller, so the object is requeued.
+//
+// Since events wait in the goroutine that sent them, the number of waiting events is bounded by the
+// number of concurrent callers, and events that were not delivered are never reported as sent.
+//
+// Each event is given a sequence extension attribute, which consumers can use to order events for
+// the same object. Sequence values are seeded from the clock, so they keep increasing across
+// restarts.
+type Ordered struct {
+	Sender         sink.Sender
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	mu sync.Mutex
+	// tails holds, for each object UID, a channel that is closed once the last event sent for the
+	// object is no longer being delivered.
+	tails    map[string]chan struct{}
+	sequence uint64
+}
+
+// Send assigns the event a sequence number, waits for the earlier events of the same object, and
+// delivers the event. It returns once the event is delivered, it fails in a way that cannot be
+// retried, or ctx is done.
+func (o *Ordered) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	event = event.Clone()
+	key, _ := event.Extensions()[ObjectUIDExtension].(string)
+
+	o.mu.Lock()
+	if o.tails == nil {
+		o.tails = map[string]chan struct{}{}
+		o.sequence = uint64(time.Now().UnixNano())
+	}
+	o.sequence++
+	event.SetExtension(SequenceExtension, fmt.Sprintf("%020d", o.sequence))
+	if key == "" {
+		o.mu.Unlock()
+		return o.deliver(ctx, key, event)
+	}
+	previous := o.tails[key]
+	done := make(chan struct{})
+	o.tails[key] = done
+	orderedBacklog.Inc()
+	o.mu.Unlock()
+
+	defer func() {
+		// If the caller gave up while an earlier event is still being delivered, the next event
+		// keeps waiting for it.
+		go func() {
+			if previous != nil {
+				<-previous
+			}
+			o.mu.Lock()
+			if o.tails[key] == done {
+				delete(o.tails, key)
+			}
+			o.mu.Unlock()
+			close(done)
+		}()
+	}()
+
+	if previous != nil {
+		select {
+		case <-previous:
+		case <-ctx.Done():
+			orderedBacklog.Dec()
+			return ctx.Err()
+		}
+	}
+	orderedBacklog.Dec()
+	return o.deliver(ctx, key, event)
+}
+
+// deliver sends the event until it is delivered, it fails in a way that cannot be retried, or ctx
+// is done.
+func (o *Ordered) deliver(ctx context.Context, key string, event cloudevents.Event) protocol.Result {
+	backoff := o.initialBackoff()
+	for {
+		result := o.Sender.Send(ctx, event)
+		if cloudevents.IsACK(result) || !(IsRetryable(result) || errors.Is(result, ErrCircuitOpen)) {
+			return result
+		}
+		log.Error(result, "Failed to deliver event, retrying", "uid", key, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > o.maxBackoff() {
+			backoff = o.maxBackoff()
+		}
+	}
+}
+
+func (o *Ordered) initialBackoff() time.Duration {
+	if o.InitialBackoff == 0 {
+		return defaultInitialBackoff
+	}
+	return o.InitialBackoff
+}
+
+func (o *Ordered) maxBackoff() time.Duration {
+	if o.MaxBackoff == 0 {
+		return defaultMaxBackoff
+	}
+	return o.MaxBackoff
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+)
+
+// uidSender fails the first delivery of each event for one object UID, rejects the event with
+// rejectID as not retryable, and records delivered events.
+type uidSender struct {
+	failUID  string
+	rejectID string
+
+	mu        sync.Mutex
+	failed    map[string]bool
+	delivered []cloudevents.Event
+}
+
+func (s *uidSender) Send(_ context.Context, event cloudevents.Event) protocol.Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if event.ID() == s.rejectID {
+		return nack(http.StatusBadRequest)
+	}
+	if event.Extensions()[ObjectUIDExtension] == s.failUID && !s.failed[event.ID()] {
+		s.failed[event.ID()] = true
+		return nack(http.StatusServiceUnavailable)
+	}
+	s.delivered = append(s.delivered, event)
+	return nil
+}
+
+func (s *uidSender) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for _, event := range s.delivered {
+		ids = append(ids, event.ID())
+	}
+	return ids
+}
+
+// sendAsync sends the event in a new goroutine, and returns a channel that receives the result.
+func sendAsync(ctx context.Context, sender *Ordered, event cloudevents.Event) <-chan protocol.Result {
+	result := make(chan protocol.Result, 1)
+	go func() {
+		result <- sender.Send(ctx, event)
+	}()
+	return result
+}
+
+func newObjectEvent(id string) cloudevents.Event {
+	event := newTestEvent(id)
+	event.SetExtension(ObjectUIDExtension, id[:1])
+	return event
+}
+
+func (o *Ordered) waiting(key string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, ok := o.tails[key]
+	return ok
+}
+
+func TestOrdered(t *testing.T) {
+	o := NewWithT(t)
+	sender := &uidSender{failUID: "a", failed: map[string]bool{}}
+	ordered := &Ordered{Sender: sender, InitialBackoff: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	a1 := sendAsync(ctx, ordered, newObjectEvent("a1"))
+	o.Eventually(func() bool { return ordered.waiting("a") }).Should(BeTrue())
+	a2 := sendAsync(ctx, ordered, newObjectEvent("a2"))
+	o.Expect(ordered.Send(ctx, newObjectEvent("b1"))).To(Succeed(), "events for other objects are not blocked")
+	o.Expect(ordered.Send(ctx, newObjectEvent("b2"))).To(Succeed())
+	o.Eventually(a1).Should(Receive(BeNil()), "Send returns once the event is delivered")
+	o.Eventually(a2).Should(Receive(BeNil()))
+
+	ids := sender.ids()
+	o.Expect(ids[:2]).To(Equal([]string{"b1", "b2"}))
+	o.Expect(ids[2:]).To(Equal([]string{"a1", "a2"}), "a failed event is delivered before later events")
+	var sequences []string
+	for _, event := range sender.delivered[2:] {
+		sequences = append(sequences, event.Extensions()[SequenceExtension].(string))
+	}
+	o.Expect(sequences[0] < sequences[1]).To(BeTrue(), "sequence increases for each object")
+	o.Expect(ordered.waiting("a")).To(BeFalse())
+}
+
+func TestOrderedNotRetryable(t *testing.T) {
+	o := NewWithT(t)
+	sender := &uidSender{rejectID: "a1", failed: map[string]bool{}}
+	ordered := &Ordered{Sender: sender, InitialBackoff: time.Minute}
+	ctx := context.Background()
+	o.Expect(ordered.Send(ctx, newObjectEvent("a1"))).To(HaveOccurred(), "the failure is returned to the caller")
+	o.Expect(ordered.Send(ctx, newObjectEvent("a2"))).To(Succeed())
+	o.Expect(sender.ids()).To(Equal([]string{"a2"}))
+}
+
+func TestOrderedCancel(t *testing.T) {
+	o := NewWithT(t)
+	sender := &uidSender{failUID: "a", failed: map[string]bool{}}
+	ordered := &Ordered{Sender: sender, InitialBackoff: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	a1 := sendAsync(ctx, ordered, newObjectEvent("a1"))
+	o.Eventually(func() bool { return ordered.waiting("a") }).Should(BeTrue())
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer waitCancel()
+	o.Expect(ordered.Send(waitCtx, newObjectEvent("a2"))).To(MatchError(context.DeadlineExceeded),
+		"events waiting for an earlier event give up with their context")
+	cancel()
+	o.Eventually(a1).Should(Receive(HaveOccurred()))
+	o.Expect(sender.ids()).To(BeEmpty(), "events are not delivered after Send returns")
+	o.Eventually(func() bool { return ordered.waiting("a") }).Should(BeFalse())
+}
+
+// holdingSender holds the delivery of the event with blockID until release is closed, and records
+// delivered events.
+type holdingSender struct {
+	blockID string
+	release chan struct{}
+	blocked chan struct{}
+
+	mu        sync.Mutex
+	delivered []string
+}
+
+func (s *holdingSender) Send(_ context.Context, event cloudevents.Event) protocol.Result {
+	if event.ID() == s.blockID {
+		close(s.blocked)
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delivered = append(s.delivered, event.ID())
+	return nil
+}
+
+func (s *holdingSender) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.delivered...)
+}
+
+func TestOrderedBlockedSend(t *testing.T) {
+	o := NewWithT(t)
+	sender := &holdingSender{blockID: "a1", release: make(chan struct{}), blocked: make(chan struct{})}
+	ordered := &Ordered{Sender: sender}
+	ctx := context.Background()
+
+	a1 := sendAsync(ctx, ordered, newObjectEvent("a1"))
+	o.Eventually(sender.blocked).Should(BeClosed())
+	a2 := sendAsync(ctx, ordered, newObjectEvent("a2"))
+	o.Expect(ordered.Send(ctx, newObjectEvent("b1"))).To(Succeed())
+	o.Consistently(a2, 100*time.Millisecond).ShouldNot(Receive(), "a2 waits while a1 is being delivered")
+	o.Expect(sender.ids()).To(Equal([]string{"b1"}))
+
+	close(sender.release)
+	o.Eventually(a1).Should(Receive(BeNil()))
+	o.Eventually(a2).Should(Receive(BeNil()))
+	o.Expect(sender.ids()).To(Equal([]string{"b1", "a1", "a2"}))
+}
+
+func TestOrderedWithoutUID(t *testing.T) {
+	o := NewWithT(t)
+	sender := &holdingSender{blockID: "x1", release: make(chan struct{}), blocked: make(chan struct{})}
+	ordered := &Ordered{Sender: sender}
+	ctx := context.Background()
+
+	x1 := sendAsync(ctx, ordered, newTestEvent("x1"))
+	o.Eventually(sender.blocked).Should(BeClosed())
+	o.Expect(ordered.Send(ctx, newTestEvent("x2"))).To(Succeed(), "events without a UID do not wait for each other")
+	o.Expect(ordered.waiting("")).To(BeFalse())
+	close(sender.release)
+	o.Eventually(x1).Should(Receive(BeNil()))
+	o.Expect(sender.ids()).To(Equal([]string{"x2", "x1"}))
+}
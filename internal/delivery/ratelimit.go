@@ -0,0 +1,78 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"golang.org/x/time/rate"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+// NewLimiter returns a token bucket that allows eventsPerSecond events per second, with bursts of
+// up to burst events. If burst is zero, it allows bursts of one second's worth of events.
+func NewLimiter(eventsPerSecond float64, burst int) *rate.Limiter {
+	if burst == 0 {
+		burst = int(eventsPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return rate.NewLimiter(rate.Limit(eventsPerSecond), burst)
+}
+
+// Wait blocks until limiter allows an event, or ctx is done. It returns how long it waited.
+func Wait(ctx context.Context, limiter *rate.Limiter) (time.Duration, error) {
+	reservation := limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		reservation.Cancel()
+		return delay, ctx.Err()
+	case <-timer.C:
+		return delay, nil
+	}
+}
+
+// RateLimit is a Sender that limits the rate events are sent to a sink. Events over the limit wait
+// until the limiter allows them.
+type RateLimit struct {
+	Sender  sink.Sender
+	Name    string
+	Limiter *rate.Limiter
+}
+
+func (r *RateLimit) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	delay, err := Wait(ctx, r.Limiter)
+	if delay > 0 {
+		sinkThrottled.WithLabelValues(r.Name).Inc()
+		sinkThrottledSeconds.WithLabelValues(r.Name).Add(delay.Seconds())
+	}
+	if err != nil {
+		return err
+	}
+	return r.Sender.Send(ctx, event)
+}
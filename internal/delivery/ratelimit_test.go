@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+func TestRateLimit(t *testing.T) {
+	o := NewWithT(t)
+	primary := &fakeSender{}
+	limited := &RateLimit{Sender: primary, Name: "test", Limiter: NewLimiter(20, 1)}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		o.Expect(cloudevents.IsACK(limited.Send(context.Background(), newTestEvent("1")))).To(BeTrue())
+	}
+	o.Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+	o.Expect(primary.sent()).To(HaveLen(3))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limited = &RateLimit{Sender: primary, Name: "test", Limiter: NewLimiter(0.01, 1)}
+	o.Expect(cloudevents.IsACK(limited.Send(ctx, newTestEvent("2")))).To(BeTrue())
+	o.Expect(limited.Send(ctx, newTestEvent("3"))).To(MatchError(context.Canceled))
+	o.Expect(primary.sent()).To(HaveLen(4), "throttled events are not sent once the context is done")
+}
+
+func TestNewLimiter(t *testing.T) {
+	o := NewWithT(t)
+	o.Expect(NewLimiter(50, 0).Burst()).To(Equal(50))
+	o.Expect(NewLimiter(0.5, 0).Burst()).To(Equal(1))
+	o.Expect(NewLimiter(50, 5).Burst()).To(Equal(5))
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	// DefaultMaxAttempts is the retry budget used when a dead-letter sink is configured without
+	// a retry policy.
+	DefaultMaxAttempts    = 3
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = time.Minute
+)
+
+// Error is returned when an event could not be delivered. It records the number of attempts
+// that were made, and the result of the last attempt.
+type Error struct {
+	Attempts int
+	Result   protocol.Result
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("delivery failed after %d attempts: %v", e.Attempts, e.Result)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Result
+}
+
+// IsRetryable reports whether a failed delivery may succeed if it is attempted again. Invalid
+// events, and events rejected by the target with a 4xx status code are not retryable, except for
+// request timeouts and rate limiting. Events rejected by an open circuit breaker are not retried
+// either, so that the sink is not probed more often than the breaker allows.
+func IsRetryable(result protocol.Result) bool {
+	if cloudevents.IsACK(result) {
+		return false
+	}
+	if errors.Is(result, ErrCircuitOpen) {
+		return false
+	}
+	var validationErr event.ValidationError
+	if errors.As(result, &validationErr) {
+		return false
+	}
+	var httpResult *cehttp.Result
+	if errors.As(result, &httpResult) {
+		switch code := httpResult.StatusCode; {
+		case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+			return true
+		case code >= 400 && code < 500:
+			return false
+		}
+	}
+	return true
+}
+
+// Retry is a Sender that attempts to deliver an event up to MaxAttempts times. Events that are
+// not retryable fail after the first attempt. Between attempts, Retry waits for an exponential
+// backoff with optional jitter, or for the delay requested by the target with a Retry-After
+// header if it is longer. If delivery fails, an *Error is returned.
+type Retry struct {
+	Sender         sink.Sender
+	Name           string
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
+
+func (r *Retry) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	backoff := r.InitialBackoff
+	if backoff == 0 {
+		backoff = defaultInitialBackoff
+	}
+	maxBackoff := r.MaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		attemptCtx, retryAfter := sink.WithRetryAfter(ctx)
+		result := r.Sender.Send(attemptCtx, event)
+		if cloudevents.IsACK(result) {
+			return result
+		}
+		if attempt >= r.MaxAttempts || !IsRetryable(result) {
+			return &Error{Attempts: attempt, Result: result}
+		}
+		delay := backoff
+		if r.Jitter > 0 {
+			delay = wait.Jitter(backoff, r.Jitter)
+		}
+		if requested := retryAfter.Delay(); requested > delay {
+			delay = requested
+		}
+		retries.WithLabelValues(r.Name).Inc()
+		select {
+		case <-ctx.Done():
+			return &Error{Attempts: attempt, Result: ctx.Err()}
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Timeout is a Sender that cancels delivery of an event if it takes longer than Timeout.
+type Timeout struct {
+	Sender  sink.Sender
+	Timeout time.Duration
+}
+
+func (t *Timeout) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	return t.Sender.Send(ctx, event)
+}
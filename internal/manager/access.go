@@ -0,0 +1,240 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/controller"
+)
+
+// accessRetryInterval is how often the access of watches that are denied access is reviewed again.
+var accessRetryInterval = 30 * time.Second
+
+// preflightTimeout bounds the access reviews of the watches when their controllers are set up, so
+// that an unresponsive API server fails the setup instead of blocking it.
+var preflightTimeout = time.Minute
+
+// accessVerbs are the verbs the controller of a watch needs on its resource.
+var accessVerbs = []string{"get", "list", "watch"}
+
+var watchAccessDenied = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "dynowatch_watch_access_denied",
+	Help: "Whether a watch is denied access to its resource (1) or not (0), as last reviewed",
+}, []string{"watch"})
+
+func init() {
+	metrics.Registry.MustRegister(watchAccessDenied)
+}
+
+// accessReviewer reviews whether dynowatch is allowed to get, list, and watch the resources of
+// watches, with SelfSubjectAccessReviews, so that watches that are denied access do not retry
+// forever with forbidden errors.
+type accessReviewer struct {
+	client.Client
+	mapper meta.RESTMapper
+	// namespaces are the namespaces the watches are restricted to. Access to every namespace is
+	// reviewed if it is empty.
+	namespaces []string
+}
+
+// review returns the resource of a resolved watch, and the verbs that are denied on it, such as
+// list, or list in team-a if the watches are restricted to namespaces.
+func (a *accessReviewer) review(ctx context.Context, watch config.Watch) (schema.GroupResource, []string, error) {
+	gk := schema.GroupKind{Group: watch.Group, Kind: watch.Kind}
+	mapping, err := a.mapper.RESTMapping(gk, watch.Version)
+	if err != nil {
+		return schema.GroupResource{}, nil, err
+	}
+	namespaces := a.namespaces
+	if len(namespaces) == 0 || mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		namespaces = []string{""}
+	}
+	var denied []string
+	for _, namespace := range namespaces {
+		for _, verb := range accessVerbs {
+			review := &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: namespace,
+						Verb:      verb,
+						Group:     mapping.Resource.Group,
+						Version:   mapping.Resource.Version,
+						Resource:  mapping.Resource.Resource,
+					},
+				},
+			}
+			if err := a.Create(ctx, review); err != nil {
+				return schema.GroupResource{}, nil, fmt.Errorf("reviewing access to %s: %w",
+					mapping.Resource.GroupResource(), err)
+			}
+			if review.Status.Allowed {
+				continue
+			}
+			if namespace == "" {
+				denied = append(denied, verb)
+			} else {
+				denied = append(denied, verb+" in "+namespace)
+			}
+		}
+	}
+	if len(denied) > 0 {
+		watchAccessDenied.WithLabelValues(watch.Name).Set(1)
+	} else {
+		watchAccessDenied.WithLabelValues(watch.Name).Set(0)
+	}
+	return mapping.Resource.GroupResource(), denied, nil
+}
+
+// allowed reviews the access of a resolved watch, and returns an error describing the denied
+// verbs if it is not allowed to access its resource.
+func (a *accessReviewer) allowed(ctx context.Context, watch config.Watch) error {
+	resource, denied, err := a.review(ctx, watch)
+	if err != nil {
+		return err
+	}
+	if len(denied) > 0 {
+		return deniedError(resource, denied)
+	}
+	return nil
+}
+
+func deniedError(resource schema.GroupResource, denied []string) error {
+	return fmt.Errorf("not allowed to %s %s", strings.Join(denied, ", "), resource)
+}
+
+// preflight reviews the access of the resolved watches, and returns the ones that are allowed to
+// access their resource, and the ones that wait for it. Watches that are denied access fail the
+// setup, or are skipped, according to their on-forbidden setting.
+func (a *accessReviewer) preflight(ctx context.Context, watches []config.Watch) ([]config.Watch, []config.Watch,
+	error) {
+	allowed := make([]config.Watch, 0, len(watches))
+	var waiting []config.Watch
+	var errs []error
+	for _, watch := range watches {
+		resource, denied, err := a.review(ctx, watch)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(denied) == 0 {
+			allowed = append(allowed, watch)
+			continue
+		}
+		err = deniedError(resource, denied)
+		switch {
+		case watch.OnForbidden == config.OnForbiddenSkip:
+			log.Info("Skipping watch, it is denied access", "controller", watch.Name, "reason", err.Error())
+		case watch.OnForbidden == config.OnForbiddenWait:
+			log.Info("Watch waits until it is allowed access", "controller", watch.Name, "reason", err.Error())
+			waiting = append(waiting, watch)
+		default:
+			errs = append(errs, fmt.Errorf("watch %q: %w", watch.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%d watches are denied access:\n%w", len(errs), errors.Join(errs...))
+	}
+	return allowed, waiting, nil
+}
+
+// waitingWatches starts the controllers of watches that were denied access once they are allowed
+// access, reviewing it every accessRetryInterval.
+type waitingWatches struct {
+	reviewer      *accessReviewer
+	mgr           manager.Manager
+	newReconciler func(config.Watch) *controller.DynamicReconciler
+
+	mu      sync.Mutex
+	started bool
+	waiting []config.Watch
+}
+
+// Start reviews the access of the waiting watches every accessRetryInterval until ctx is done, then
+// waits for the controllers it started to stop. It only runs on the leader, along with the
+// controllers.
+func (w *waitingWatches) Start(ctx context.Context) error {
+	w.mu.Lock()
+	w.started = true
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ticker := time.NewTicker(accessRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		w.mu.Lock()
+		current := w.waiting
+		w.mu.Unlock()
+		var waiting []config.Watch
+		for _, watch := range current {
+			if err := w.reviewer.allowed(ctx, watch); err != nil {
+				log.V(1).Info("Watch is still denied access", "controller", watch.Name, "reason", err.Error())
+				waiting = append(waiting, watch)
+				continue
+			}
+			reconciler := w.newReconciler(watch)
+			wg.Add(1)
+			go func(watch config.Watch) {
+				defer wg.Done()
+				if err := reconciler.Run(ctx, w.mgr); err != nil && ctx.Err() == nil {
+					log.Error(err, "Controller stopped", "controller", watch.Name)
+				}
+			}(watch)
+			log.Info("Started controller, it is allowed access", "controller", watch.Name,
+				"controllerGroup", watch.Group, "controllerKind", watch.Kind)
+		}
+		w.mu.Lock()
+		w.waiting = waiting
+		w.mu.Unlock()
+	}
+}
+
+// Check is a readiness check that fails while any watch waits for access on the leader.
+func (w *waitingWatches) Check(_ *http.Request) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started || len(w.waiting) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(w.waiting))
+	for _, watch := range w.waiting {
+		names = append(names, watch.Name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("watches are denied access: %s", strings.Join(names, ", "))
+}
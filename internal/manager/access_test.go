@@ -0,0 +1,98 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// newAccessClient returns a client that allows every SelfSubjectAccessReview, except for the verbs
+// of resources in denied, such as "jobs/list", or "jobs/list/team-a" in a namespace.
+func newAccessClient(denied ...string) client.Client {
+	deny := map[string]bool{}
+	for _, d := range denied {
+		deny[d] = true
+	}
+	return fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+			if review, ok := obj.(*authorizationv1.SelfSubjectAccessReview); ok {
+				attributes := review.Spec.ResourceAttributes
+				key := attributes.Resource + "/" + attributes.Verb
+				if attributes.Namespace != "" {
+					key += "/" + attributes.Namespace
+				}
+				review.Status.Allowed = !deny[key]
+				return nil
+			}
+			return c.Create(ctx, obj, opts...)
+		},
+	}).Build()
+}
+
+func TestAccessReviewerPreflight(t *testing.T) {
+	o := NewWithT(t)
+	reviewer := &accessReviewer{Client: newAccessClient("jobs/watch", "deployments/list", "cronjobs/get"),
+		mapper: newTestMapper()}
+	watches := []config.Watch{
+		{Name: "pods", Version: "v1", Kind: "Pod"},
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Job", OnForbidden: config.OnForbiddenSkip},
+		{Name: "deployments", Group: "apps", Version: "v1", Kind: "Deployment", OnForbidden: config.OnForbiddenWait},
+	}
+
+	allowed, waiting, err := reviewer.preflight(context.Background(), watches)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(allowed).To(Equal(watches[:1]))
+	o.Expect(waiting).To(Equal(watches[2:]))
+	o.Expect(testutil.ToFloat64(watchAccessDenied.WithLabelValues("jobs"))).To(Equal(1.0))
+	o.Expect(testutil.ToFloat64(watchAccessDenied.WithLabelValues("pods"))).To(Equal(0.0))
+
+	watches = append(watches, config.Watch{Name: "cronjobs", Group: "batch", Version: "v1", Kind: "CronJob",
+		OnForbidden: config.OnForbiddenFail})
+	_, _, err = reviewer.preflight(context.Background(), watches)
+	o.Expect(err).To(MatchError("1 watches are denied access:\n" +
+		`watch "cronjobs": not allowed to get cronjobs.batch`))
+}
+
+func TestAccessReviewerNamespaces(t *testing.T) {
+	o := NewWithT(t)
+	reviewer := &accessReviewer{Client: newAccessClient("jobs/list/team-b", "jobs/watch/team-b"),
+		mapper: newTestMapper(), namespaces: []string{"team-a", "team-b"}}
+
+	o.Expect(reviewer.allowed(context.Background(), config.Watch{Name: "jobs", Group: "batch", Version: "v1",
+		Kind: "Job"})).To(MatchError("not allowed to list in team-b, watch in team-b jobs.batch"))
+}
+
+func TestWaitingWatchesCheck(t *testing.T) {
+	o := NewWithT(t)
+	w := &waitingWatches{waiting: []config.Watch{{Name: "jobs"}, {Name: "deployments"}}}
+	o.Expect(w.Check(nil)).To(Succeed(), "watches are not reported before the leader starts them")
+	w.started = true
+	o.Expect(w.Check(nil)).To(MatchError("watches are denied access: deployments, jobs"))
+	w.waiting = nil
+	o.Expect(w.Check(nil)).To(Succeed())
+}
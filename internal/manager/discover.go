@@ -0,0 +1,311 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/controller"
+)
+
+// discoveredWatch is the controller of a kind matched by a watch whose kinds are discovered.
+type discoveredWatch struct {
+	watch config.Watch
+	// cancel stops the controller, and done is closed once it stopped.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// discoveredWatches starts a controller for every kind matched by the watches of every kind in a
+// group, or of the kinds of the CustomResourceDefinitions selected by a label selector. Kinds are
+// discovered again every interval, so that the controllers of new kinds are started, and the ones
+// of kinds that are no longer served are stopped.
+type discoveredWatches struct {
+	client.Reader
+	mgr           manager.Manager
+	resources     discovery.ServerResourcesInterface
+	newReconciler func(config.Watch) *controller.DynamicReconciler
+	interval      time.Duration
+	watches       []config.Watch
+	// excluded are the kinds and resources set by other watches, which are not watched again.
+	excludedKinds     map[schema.GroupKind]bool
+	excludedResources map[schema.GroupResource]bool
+
+	// namespaced skips the kinds that are cluster-scoped, when the watches are restricted to
+	// namespaces.
+	namespaced bool
+
+	running map[schema.GroupKind]*discoveredWatch
+	// reviewer reviews the access of the discovered kinds before their controllers start, unless
+	// it is nil.
+	reviewer *accessReviewer
+
+	// denied are the discovered kinds that are denied access. They are only reviewed again if their
+	// watch waits for access.
+	denied map[schema.GroupKind]bool
+}
+
+// DiscoverWatches returns the watches, with the ones whose kinds are discovered replaced by a watch
+// for each kind they match on the cluster. If namespaced is true, cluster-scoped kinds are not
+// matched.
+func DiscoverWatches(ctx context.Context, reader client.Reader, resources discovery.ServerResourcesInterface,
+	watches []config.Watch, namespaced bool) ([]config.Watch, error) {
+	var discovered []config.Watch
+	explicit := []config.Watch{}
+	for _, watch := range watches {
+		if watch.IsDiscovered() {
+			discovered = append(discovered, watch)
+		} else {
+			explicit = append(explicit, watch)
+		}
+	}
+	if len(discovered) == 0 {
+		return explicit, nil
+	}
+	d := newDiscoveredWatches(reader, resources, discovered, explicit)
+	d.namespaced = namespaced
+	expanded, _, err := d.expand(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(explicit, expanded...), nil
+}
+
+// newDiscoveredWatches returns the discovered watches for watches, which skip the kinds and
+// resources of the others.
+func newDiscoveredWatches(reader client.Reader, resources discovery.ServerResourcesInterface,
+	watches []config.Watch, others []config.Watch) *discoveredWatches {
+	d := &discoveredWatches{
+		Reader:            reader,
+		resources:         resources,
+		watches:           watches,
+		excludedKinds:     map[schema.GroupKind]bool{},
+		excludedResources: map[schema.GroupResource]bool{},
+		running:           map[schema.GroupKind]*discoveredWatch{},
+		denied:            map[schema.GroupKind]bool{},
+	}
+	for _, watch := range others {
+		if watch.Kind != "" {
+			d.excludedKinds[schema.GroupKind{Group: watch.Group, Kind: watch.Kind}] = true
+		}
+		if watch.Resource != "" {
+			gr := schema.ParseGroupResource(watch.Resource)
+			if gr.Group == "" {
+				gr.Group = watch.Group
+			}
+			d.excludedResources[gr] = true
+		}
+	}
+	return d
+}
+
+// Start discovers the kinds of the watches every interval until ctx is done, then waits for their
+// controllers to stop. It only runs on the leader, along with the controllers.
+func (d *discoveredWatches) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.discover(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, dw := range d.running {
+				<-dw.done
+			}
+			return nil
+		}
+	}
+}
+
+// discover starts the controllers of the kinds that are matched by the watches, and stops the ones
+// of kinds that are no longer served.
+func (d *discoveredWatches) discover(ctx context.Context) {
+	watches, failedGroups, err := d.expand(ctx)
+	if err != nil {
+		log.Error(err, "Unable to discover watched kinds")
+		return
+	}
+	discovered := map[schema.GroupKind]bool{}
+	for _, watch := range watches {
+		gk := schema.GroupKind{Group: watch.Group, Kind: watch.Kind}
+		discovered[gk] = true
+		if dw, ok := d.running[gk]; ok {
+			select {
+			case <-dw.done:
+				// The controller stopped on its own, so it is started again.
+			default:
+				continue
+			}
+		}
+		// Kinds that are denied access are skipped while they are served, unless their watch waits
+		// for access, in which case they are reviewed again at the next discovery.
+		if d.reviewer != nil {
+			if d.denied[gk] && watch.OnForbidden != config.OnForbiddenWait {
+				continue
+			}
+			if err := d.reviewer.allowed(ctx, watch); err != nil {
+				if !d.denied[gk] {
+					log.Info("Discovered kind is not watched, it is denied access", "controller", watch.Name,
+						"onForbidden", watch.OnForbidden, "reason", err.Error())
+				}
+				d.denied[gk] = true
+				continue
+			}
+		}
+		delete(d.denied, gk)
+		d.start(ctx, watch)
+	}
+	for gk := range d.denied {
+		if !discovered[gk] && !failedGroups[gk.Group] {
+			delete(d.denied, gk)
+		}
+	}
+	for gk, dw := range d.running {
+		// Kinds of groups that could not be discovered may still be served.
+		if discovered[gk] || failedGroups[gk.Group] {
+			continue
+		}
+		log.Info("Stopping controller, its kind is no longer served", "controller", dw.watch.Name)
+		dw.cancel()
+		<-dw.done
+		delete(d.running, gk)
+	}
+}
+
+func (d *discoveredWatches) start(ctx context.Context, watch config.Watch) {
+	ctx, cancel := context.WithCancel(ctx)
+	dw := &discoveredWatch{watch: watch, cancel: cancel, done: make(chan struct{})}
+	d.running[schema.GroupKind{Group: watch.Group, Kind: watch.Kind}] = dw
+	reconciler := d.newReconciler(watch)
+	go func() {
+		defer close(dw.done)
+		if err := reconciler.Run(ctx, d.mgr); err != nil && ctx.Err() == nil {
+			log.Error(err, "Controller stopped", "controller", watch.Name)
+		}
+	}()
+	log.Info("Started discovered controller", "controller", watch.Name, "controllerGroup", watch.Group,
+		"controllerKind", watch.Kind)
+}
+
+// expand returns a watch for every kind matched by the watches, along with the groups that could not
+// be discovered. Each watch is named after the watch that matched it and the resource of its kind,
+// such as tekton-pipelineruns.tekton.dev. A kind matched by several watches is only watched by the
+// first of them.
+func (d *discoveredWatches) expand(ctx context.Context) ([]config.Watch, map[string]bool, error) {
+	// The resources selected by each watch with a crd-selector.
+	selected := make([]map[schema.GroupResource]bool, len(d.watches))
+	for i, watch := range d.watches {
+		if watch.CRDSelector == "" {
+			continue
+		}
+		var err error
+		if selected[i], err = d.selectCRDs(ctx, watch.CRDSelector); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	failedGroups := map[string]bool{}
+	lists, err := d.resources.ServerPreferredResources()
+	if err != nil {
+		// Discovery returns the resources of the groups it found along with an error for the
+		// groups that failed.
+		var groupErr *discovery.ErrGroupDiscoveryFailed
+		if !errors.As(err, &groupErr) {
+			return nil, nil, err
+		}
+		for gv := range groupErr.Groups {
+			failedGroups[gv.Group] = true
+		}
+		log.Info("Unable to discover some groups", "reason", err.Error())
+	}
+
+	var watches []config.Watch
+	seen := map[schema.GroupKind]bool{}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			gk := gv.WithKind(resource.Kind).GroupKind()
+			gr := gv.WithResource(resource.Name).GroupResource()
+			if strings.Contains(resource.Name, "/") || !watchable(resource) || seen[gk] ||
+				d.excludedKinds[gk] || d.excludedResources[gr] || (d.namespaced && !resource.Namespaced) {
+				continue
+			}
+			for i, template := range d.watches {
+				matches := (template.Kind == config.WildcardKind && template.Group == gv.Group) ||
+					(template.CRDSelector != "" && selected[i][gr])
+				if !matches {
+					continue
+				}
+				watch := template
+				watch.Name = template.Name + "-" + gr.String()
+				watch.Group = gv.Group
+				watch.Version = gv.Version
+				watch.Kind = resource.Kind
+				watch.CRDSelector = ""
+				watches = append(watches, watch)
+				seen[gk] = true
+				break
+			}
+		}
+	}
+	return watches, failedGroups, nil
+}
+
+// selectCRDs returns the resources of the CustomResourceDefinitions matching selector.
+func (d *discoveredWatches) selectCRDs(ctx context.Context, selector string) (map[schema.GroupResource]bool, error) {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	crds := &unstructured.UnstructuredList{}
+	crds.SetGroupVersionKind(crdGVK.GroupVersion().WithKind(crdGVK.Kind + "List"))
+	if err := d.List(ctx, crds, client.MatchingLabelsSelector{Selector: parsed}); err != nil {
+		return nil, err
+	}
+	resources := map[schema.GroupResource]bool{}
+	for _, crd := range crds.Items {
+		group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+		plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+		resources[schema.GroupResource{Group: group, Resource: plural}] = true
+	}
+	return resources, nil
+}
+
+// watchable reports whether the objects of resource can be listed and watched.
+func watchable(resource metav1.APIResource) bool {
+	var list, watch bool
+	for _, verb := range resource.Verbs {
+		list = list || verb == "list"
+		watch = watch || verb == "watch"
+	}
+	return list && watch
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+var watchVerbs = metav1.Verbs{"get", "list", "watch"}
+
+// discoveryResources serves lists through discovery, along with err.
+type discoveryResources struct {
+	discovery.ServerResourcesInterface
+	lists []*metav1.APIResourceList
+	err   error
+}
+
+func (r discoveryResources) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return r.lists, r.err
+}
+
+func newDiscoveryTest(resources discoveryResources, watches []config.Watch, others []config.Watch) *discoveredWatches {
+	labeled := newCRD(true)
+	labeled.SetLabels(map[string]string{"kubearchive.dev/watch": "true"})
+	return newDiscoveredWatches(fake.NewClientBuilder().WithObjects(labeled).Build(), resources, watches, others)
+}
+
+func TestDiscoveredWatchesExpand(t *testing.T) {
+	o := NewWithT(t)
+	resources := discoveryResources{lists: []*metav1.APIResourceList{
+		{
+			GroupVersion: "batch/v1",
+			APIResources: []metav1.APIResource{{Name: "jobs", Kind: "Job", Verbs: watchVerbs}},
+		},
+		{
+			GroupVersion: "tekton.dev/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "pipelineruns", Kind: "PipelineRun", Verbs: watchVerbs},
+				{Name: "pipelineruns/status", Kind: "PipelineRun", Verbs: watchVerbs},
+				{Name: "taskruns", Kind: "TaskRun", Verbs: watchVerbs},
+				{Name: "tasks", Kind: "Task", Verbs: watchVerbs},
+				{Name: "runevents", Kind: "RunEvent", Verbs: metav1.Verbs{"create"}},
+			},
+		},
+	}}
+	watches := []config.Watch{
+		{Name: "labeled", CRDSelector: "kubearchive.dev/watch=true", InitialSync: config.InitialSyncNone},
+		{Name: "tekton", Group: "tekton.dev", Kind: config.WildcardKind, MaxConcurrentReconciles: 2},
+	}
+	others := []config.Watch{{Name: "tasks", Group: "tekton.dev", Version: "v1", Kind: "Task"}}
+	d := newDiscoveryTest(resources, watches, others)
+
+	expanded, failedGroups, err := d.expand(context.Background())
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(failedGroups).To(BeEmpty())
+	o.Expect(expanded).To(Equal([]config.Watch{
+		{Name: "labeled-pipelineruns.tekton.dev", Group: "tekton.dev", Version: "v1", Kind: "PipelineRun",
+			InitialSync: config.InitialSyncNone},
+		{Name: "tekton-taskruns.tekton.dev", Group: "tekton.dev", Version: "v1", Kind: "TaskRun",
+			MaxConcurrentReconciles: 2},
+	}), "kinds are watched by the first watch matching them, unless they are watched explicitly")
+}
+
+func TestDiscoveredWatchesExpandNamespaced(t *testing.T) {
+	o := NewWithT(t)
+	resources := discoveryResources{lists: []*metav1.APIResourceList{{
+		GroupVersion: "tekton.dev/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "pipelineruns", Kind: "PipelineRun", Namespaced: true, Verbs: watchVerbs},
+			{Name: "clustertasks", Kind: "ClusterTask", Verbs: watchVerbs},
+		},
+	}}}
+	d := newDiscoveryTest(resources, []config.Watch{
+		{Name: "tekton", Group: "tekton.dev", Kind: config.WildcardKind},
+	}, nil)
+	d.namespaced = true
+
+	expanded, _, err := d.expand(context.Background())
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(expanded).To(Equal([]config.Watch{
+		{Name: "tekton-pipelineruns.tekton.dev", Group: "tekton.dev", Version: "v1", Kind: "PipelineRun"},
+	}), "cluster-scoped kinds are skipped")
+}
+
+func TestDiscoveredWatchesExpandFailedGroups(t *testing.T) {
+	o := NewWithT(t)
+	resources := discoveryResources{
+		lists: []*metav1.APIResourceList{{
+			GroupVersion: "tekton.dev/v1",
+			APIResources: []metav1.APIResource{{Name: "taskruns", Kind: "TaskRun", Verbs: watchVerbs}},
+		}},
+		err: &discovery.ErrGroupDiscoveryFailed{Groups: map[schema.GroupVersion]error{
+			{Group: "triggers.tekton.dev", Version: "v1beta1"}: errors.New("the server is currently unable to handle the request"),
+		}},
+	}
+	d := newDiscoveryTest(resources, []config.Watch{
+		{Name: "tekton", Group: "tekton.dev", Kind: config.WildcardKind},
+	}, nil)
+
+	expanded, failedGroups, err := d.expand(context.Background())
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(failedGroups).To(Equal(map[string]bool{"triggers.tekton.dev": true}))
+	o.Expect(expanded).To(HaveLen(1))
+
+	d.resources = discoveryResources{err: errors.New("connection refused")}
+	_, _, err = d.expand(context.Background())
+	o.Expect(err).To(MatchError("connection refused"))
+}
+
+// countingClient counts the access reviews it creates.
+type countingClient struct {
+	client.Client
+	reviews int
+}
+
+func (c *countingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.reviews++
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestDiscoveredWatchesDenied(t *testing.T) {
+	o := NewWithT(t)
+	resources := discoveryResources{lists: []*metav1.APIResourceList{{
+		GroupVersion: "tekton.dev/v1",
+		APIResources: []metav1.APIResource{{Name: "pipelineruns", Kind: "PipelineRun", Verbs: watchVerbs}},
+	}}}
+	for _, onForbidden := range []string{config.OnForbiddenSkip, config.OnForbiddenWait} {
+		reviews := &countingClient{Client: newAccessClient("pipelineruns/list")}
+		watches := []config.Watch{{Name: "tekton", Group: "tekton.dev", Kind: config.WildcardKind, OnForbidden: onForbidden}}
+		d := newDiscoveryTest(resources, watches, nil)
+		d.reviewer = &accessReviewer{Client: reviews, mapper: newTestMapper()}
+
+		d.discover(context.Background())
+		o.Expect(d.running).To(BeEmpty())
+		o.Expect(reviews.reviews).To(Equal(len(accessVerbs)))
+		d.discover(context.Background())
+		o.Expect(d.running).To(BeEmpty())
+		if onForbidden == config.OnForbiddenWait {
+			o.Expect(reviews.reviews).To(Equal(2*len(accessVerbs)), "kinds that wait for access are reviewed again")
+		} else {
+			o.Expect(reviews.reviews).To(Equal(len(accessVerbs)), "skipped kinds are not reviewed again")
+		}
+
+		d.resources = discoveryResources{}
+		d.discover(context.Background())
+		o.Expect(d.denied).To(BeEmpty(), "kinds that are no longer served are forgotten")
+	}
+}
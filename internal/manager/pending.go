@@ -0,0 +1,242 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/controller"
+)
+
+//+kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch
+
+var crdGVK = schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"}
+
+var watchPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "dynowatch_watch_pending",
+	Help: "Whether a watch is pending until its CustomResourceDefinition is established (1) or not (0)",
+}, []string{"watch"})
+
+func init() {
+	metrics.Registry.MustRegister(watchPending)
+}
+
+// pendingWatch is a watch whose kind was not served when the manager started.
+type pendingWatch struct {
+	watch config.Watch
+	// crd is the name of the CustomResourceDefinition serving the kind, once it was seen.
+	crd string
+	// cancel stops the controller of the watch, and done is closed once it stopped. Both are nil
+	// while the watch is pending.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// pendingWatches watches CustomResourceDefinitions, and starts the controller of a pending watch
+// once the CustomResourceDefinition serving its kind is established. The controller is stopped,
+// and the watch is pending again, if the CustomResourceDefinition is removed.
+type pendingWatches struct {
+	client.Client
+	mgr           manager.Manager
+	newReconciler func(config.Watch) *controller.DynamicReconciler
+	// reviewer reviews the access of the watches before their controllers start, unless it is nil.
+	reviewer *accessReviewer
+
+	mu      sync.Mutex
+	ctx     context.Context
+	started chan struct{}
+	watches []*pendingWatch
+}
+
+func newPendingWatches(mgr manager.Manager, watches []config.Watch,
+	newReconciler func(config.Watch) *controller.DynamicReconciler) *pendingWatches {
+	p := &pendingWatches{
+		Client:        mgr.GetClient(),
+		mgr:           mgr,
+		newReconciler: newReconciler,
+		started:       make(chan struct{}),
+	}
+	for _, watch := range watches {
+		p.watches = append(p.watches, &pendingWatch{watch: watch})
+	}
+	return p
+}
+
+// SetupWithManager sets up a controller for the CustomResourceDefinitions in the groups of the
+// pending watches.
+func (p *pendingWatches) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(p); err != nil {
+		return err
+	}
+	groups := map[string]bool{}
+	for _, pw := range p.watches {
+		groups[watchGroup(pw.watch)] = true
+	}
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(crdGVK)
+	return ctrl.NewControllerManagedBy(mgr).
+		For(crd).
+		Named("pending-watches").
+		WithEventFilter(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			group, _, _ := unstructured.NestedString(obj.(*unstructured.Unstructured).Object, "spec", "group")
+			return groups[group]
+		})).
+		Complete(p)
+}
+
+// Start records the context the controllers of the watches run with, and stops them when it is
+// done. It only runs on the leader, along with the controllers.
+func (p *pendingWatches) Start(ctx context.Context) error {
+	p.mu.Lock()
+	p.ctx = ctx
+	close(p.started)
+	for _, pw := range p.watches {
+		if pw.cancel == nil {
+			watchPending.WithLabelValues(pw.watch.Name).Set(1)
+		}
+	}
+	p.mu.Unlock()
+
+	<-ctx.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pw := range p.watches {
+		if pw.done != nil {
+			<-pw.done
+		}
+	}
+	return nil
+}
+
+// Reconcile starts or stops the controllers of the pending watches served by a
+// CustomResourceDefinition.
+func (p *pendingWatches) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	select {
+	case <-p.started:
+	case <-ctx.Done():
+		return ctrl.Result{}, ctx.Err()
+	}
+	crd := &unstructured.Unstructured{}
+	crd.SetGroupVersionKind(crdGVK)
+	err := p.Get(ctx, req.NamespacedName, crd)
+	if err != nil && !errors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	served := err == nil && crd.GetDeletionTimestamp() == nil && established(crd)
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	kind, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "kind")
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := ctrl.Result{}
+	for _, pw := range p.watches {
+		matches := pw.crd == req.Name
+		if !matches && group != "" && watchGroup(pw.watch) == group {
+			gr := schema.ParseGroupResource(pw.watch.Resource)
+			matches = pw.watch.Kind == kind || gr.Resource == plural
+		}
+		if !matches {
+			continue
+		}
+		pw.crd = req.Name
+		switch {
+		case served && pw.cancel == nil:
+			if !p.startLocked(ctx, pw) {
+				// Watches that are denied access are reviewed again later.
+				result.RequeueAfter = accessRetryInterval
+			}
+		case !served && pw.cancel != nil:
+			log.Info("Stopping controller, its CustomResourceDefinition was removed", "controller", pw.watch.Name,
+				"crd", req.Name)
+			pw.cancel()
+			<-pw.done
+			pw.cancel = nil
+			pw.done = nil
+			watchPending.WithLabelValues(pw.watch.Name).Set(1)
+		}
+	}
+	return result, nil
+}
+
+// startLocked starts the controller of a pending watch, if its kind can be resolved. It returns
+// false if the watch is denied access to its resource.
+func (p *pendingWatches) startLocked(ctx context.Context, pw *pendingWatch) bool {
+	resolved, err := ResolveWatches(p.mgr.GetRESTMapper(), nil, []config.Watch{pw.watch})
+	if err != nil {
+		log.Info("Watch is still pending", "controller", pw.watch.Name, "reason", err.Error())
+		return true
+	}
+	watch := resolved[0]
+	if p.reviewer != nil {
+		if err := p.reviewer.allowed(ctx, watch); err != nil {
+			log.Info("Watch is still pending, it is denied access", "controller", watch.Name, "reason", err.Error())
+			return false
+		}
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	done := make(chan struct{})
+	pw.cancel = cancel
+	pw.done = done
+	reconciler := p.newReconciler(watch)
+	go func() {
+		err := reconciler.Run(ctx, p.mgr)
+		close(done)
+		if ctx.Err() != nil {
+			return
+		}
+		// The controller stopped on its own, so the watch is pending until its
+		// CustomResourceDefinition changes again.
+		log.Error(err, "Controller stopped", "controller", watch.Name)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if pw.done == done {
+			cancel()
+			pw.cancel = nil
+			pw.done = nil
+			watchPending.WithLabelValues(pw.watch.Name).Set(1)
+		}
+	}()
+	watchPending.WithLabelValues(pw.watch.Name).Set(0)
+	log.Info("Started pending controller", "controller", watch.Name, "controllerGroup", watch.Group,
+		"controllerKind", watch.Kind)
+	return true
+}
+
+// established reports whether the Established condition of a CustomResourceDefinition is true.
+func established(crd *unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == "Established" && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
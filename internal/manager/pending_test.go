@@ -0,0 +1,113 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/controller"
+)
+
+func newCRD(established bool) *unstructured.Unstructured {
+	crd := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"group": "tekton.dev",
+			"names": map[string]interface{}{"kind": "PipelineRun", "plural": "pipelineruns"},
+		},
+	}}
+	crd.SetGroupVersionKind(crdGVK)
+	crd.SetName("pipelineruns.tekton.dev")
+	if established {
+		_ = unstructured.SetNestedSlice(crd.Object, []interface{}{
+			map[string]interface{}{"type": "Established", "status": "True"},
+		}, "status", "conditions")
+	}
+	return crd
+}
+
+func TestPendingWatches(t *testing.T) {
+	o := NewWithT(t)
+	mgr, err := ctrl.NewManager(&rest.Config{Host: "http://127.0.0.1:1"}, ctrl.Options{
+		MapperProvider: func(*rest.Config, *http.Client) (meta.RESTMapper, error) {
+			return newTestMapper(), nil
+		},
+	})
+	o.Expect(err).NotTo(HaveOccurred())
+	watches := []config.Watch{{Name: "pipelineruns", Resource: "pipelineruns.tekton.dev"}}
+	var started []config.Watch
+	p := newPendingWatches(mgr, watches, func(watch config.Watch) *controller.DynamicReconciler {
+		started = append(started, watch)
+		return &controller.DynamicReconciler{Name: watch.Name, GroupVersionKind: schema.GroupVersionKind{
+			Group: watch.Group, Version: watch.Version, Kind: watch.Kind,
+		}}
+	})
+	kubeClient := fake.NewClientBuilder().WithObjects(newCRD(false)).Build()
+	p.Client = kubeClient
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- p.Start(ctx)
+	}()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "pipelineruns.tekton.dev"}}
+
+	_, err = p.Reconcile(ctx, req)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(started).To(BeEmpty(), "watches wait for the CustomResourceDefinition to be established")
+	o.Expect(testutil.ToFloat64(watchPending.WithLabelValues("pipelineruns"))).To(Equal(1.0))
+
+	o.Expect(kubeClient.Delete(ctx, newCRD(false))).To(Succeed())
+	o.Expect(kubeClient.Create(ctx, newCRD(true))).To(Succeed())
+	_, err = p.Reconcile(ctx, req)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(started).To(Equal([]config.Watch{
+		{Name: "pipelineruns", Group: "tekton.dev", Version: "v1", Kind: "PipelineRun", Resource: "pipelineruns.tekton.dev"},
+	}))
+	o.Expect(testutil.ToFloat64(watchPending.WithLabelValues("pipelineruns"))).To(Equal(0.0))
+
+	o.Expect(kubeClient.Delete(ctx, newCRD(true))).To(Succeed())
+	_, err = p.Reconcile(ctx, req)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(testutil.ToFloat64(watchPending.WithLabelValues("pipelineruns"))).To(Equal(1.0),
+		"the controller stops with its CRD")
+
+	cancel()
+	o.Eventually(stopped).Should(Receive(BeNil()))
+}
+
+func TestIsCustomGroup(t *testing.T) {
+	o := NewWithT(t)
+	o.Expect(isCustomGroup("tekton.dev")).To(BeTrue())
+	o.Expect(isCustomGroup("cluster.x-k8s.io")).To(BeTrue())
+	o.Expect(isCustomGroup("")).To(BeFalse())
+	o.Expect(isCustomGroup("batch")).To(BeFalse())
+	o.Expect(isCustomGroup("networking.k8s.io")).To(BeFalse())
+}
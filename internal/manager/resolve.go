@@ -0,0 +1,296 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// maxSuggestions is the number of similar kinds or resources suggested for an invalid watch.
+const maxSuggestions = 3
+
+// ResolveWatches returns the watches with their group, version and kind resolved with mapper.
+// Watches can name a kind, or a resource such as jobs.batch, and can omit the version to use the
+// preferred version of the group. Every invalid watch is reported in the returned error, with
+// suggestions of similar kinds or resources served by the cluster.
+func ResolveWatches(mapper meta.RESTMapper, resources discovery.ServerResourcesInterface,
+	watches []config.Watch) ([]config.Watch, error) {
+	resolved, _, err := resolveWatches(mapper, resources, watches, false)
+	return resolved, err
+}
+
+// ResolveWatchesAllowingPending resolves the watches like the manager does. Watches of custom
+// resources that are not served by the cluster are returned as pending instead of invalid, since
+// their CustomResourceDefinition may be installed later.
+func ResolveWatchesAllowingPending(mapper meta.RESTMapper, resources discovery.ServerResourcesInterface,
+	watches []config.Watch) ([]config.Watch, []config.Watch, error) {
+	return resolveWatches(mapper, resources, watches, true)
+}
+
+// ValidateNamespacedWatches checks that the kinds of the resolved watches are namespaced, since
+// cluster-scoped kinds cannot be watched when the watches are restricted to namespaces.
+func ValidateNamespacedWatches(mapper meta.RESTMapper, watches []config.Watch) error {
+	var errs []error
+	for _, watch := range watches {
+		mapping, err := mapper.RESTMapping(schema.GroupKind{Group: watch.Group, Kind: watch.Kind}, watch.Version)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("watch %q: %w", watch.Name, err))
+			continue
+		}
+		if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+			errs = append(errs, fmt.Errorf("watch %q: %s is cluster-scoped, so it cannot be watched when %s is set",
+				watch.Name, mapping.Resource.GroupResource(), config.WatchNamespacesKey))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d invalid watches:\n%w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// resolveWatches resolves the watches like ResolveWatches. If allowPending is true, watches of
+// custom resources that are not served by the cluster are returned as pending instead of invalid,
+// since their CustomResourceDefinition may be installed later.
+func resolveWatches(mapper meta.RESTMapper, resources discovery.ServerResourcesInterface,
+	watches []config.Watch, allowPending bool) ([]config.Watch, []config.Watch, error) {
+	resolved := make([]config.Watch, 0, len(watches))
+	var pending []config.Watch
+	var errs []error
+	var candidates []candidate
+	for _, watch := range watches {
+		if watch.Kind == "" && watch.Resource == "" {
+			errs = append(errs, fmt.Errorf("watch %q: a kind or resource is required", watch.Name))
+			continue
+		}
+		gvk, err := resolveWatch(mapper, watch)
+		if err != nil {
+			if candidates == nil {
+				candidates = serverCandidates(resources)
+			}
+			if suggestions := suggest(watch, candidates); len(suggestions) > 0 {
+				err = fmt.Errorf("%w; did you mean %s?", err, strings.Join(suggestions, ", "))
+			}
+			if allowPending && isCustomGroup(watchGroup(watch)) && !servedLike(watch, candidates) {
+				log.Info("Watch is pending until its CustomResourceDefinition is installed", "controller", watch.Name,
+					"reason", err.Error())
+				pending = append(pending, watch)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("watch %q: %w", watch.Name, err))
+			continue
+		}
+		if watch.Resource != "" && watch.Kind != "" && watch.Kind != gvk.Kind {
+			errs = append(errs, fmt.Errorf("watch %q: resource %s is of kind %s, not %s", watch.Name,
+				watch.Resource, gvk.Kind, watch.Kind))
+			continue
+		}
+		watch.Group = gvk.Group
+		watch.Version = gvk.Version
+		watch.Kind = gvk.Kind
+		resolved = append(resolved, watch)
+	}
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%d invalid watches:\n%w", len(errs), errors.Join(errs...))
+	}
+	return resolved, pending, nil
+}
+
+func resolveWatch(mapper meta.RESTMapper, watch config.Watch) (schema.GroupVersionKind, error) {
+	switch {
+	case watch.Resource != "":
+		gr := schema.ParseGroupResource(watch.Resource)
+		if gr.Group == "" {
+			gr.Group = watch.Group
+		}
+		// Kinds are returned in order of preference, so the first is in the preferred version when
+		// the version is omitted.
+		gvks, err := mapper.KindsFor(gr.WithVersion(watch.Version))
+		if err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+		return gvks[0], nil
+	default:
+		gk := schema.GroupKind{Group: watch.Group, Kind: watch.Kind}
+		var versions []string
+		if watch.Version != "" {
+			versions = append(versions, watch.Version)
+		}
+		mapping, err := mapper.RESTMapping(gk, versions...)
+		if err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+		return mapping.GroupVersionKind, nil
+	}
+}
+
+// watchGroup returns the API group of a watch, as set by its group or resource.
+func watchGroup(watch config.Watch) string {
+	if watch.Resource != "" {
+		if gr := schema.ParseGroupResource(watch.Resource); gr.Group != "" {
+			return gr.Group
+		}
+	}
+	return watch.Group
+}
+
+// isCustomGroup reports whether group can be served by a CustomResourceDefinition. The groups of
+// built-in kinds have no dots, or end in .k8s.io, while custom resources must be in a group with a
+// dot.
+func isCustomGroup(group string) bool {
+	return strings.Contains(group, ".") && !strings.HasSuffix(group, ".k8s.io")
+}
+
+// servedLike reports whether the group of a watch serves its kind or resource in another version,
+// or a similar one. Such a watch names a wrong version or misspells its kind or resource, so it is
+// invalid rather than waiting for its CustomResourceDefinition.
+func servedLike(watch config.Watch, candidates []candidate) bool {
+	group := watchGroup(watch)
+	var inGroup []candidate
+	for _, c := range candidates {
+		if c.group == group {
+			inGroup = append(inGroup, c)
+		}
+	}
+	return len(suggest(watch, inGroup)) > 0
+}
+
+// candidate is a kind served by the cluster, along with its resource name.
+type candidate struct {
+	group    string
+	kind     string
+	resource string
+}
+
+// serverCandidates returns the kinds served by the cluster. If they cannot be discovered, no
+// suggestions are made.
+func serverCandidates(resources discovery.ServerResourcesInterface) []candidate {
+	candidates := []candidate{}
+	if resources == nil {
+		return candidates
+	}
+	// Discovery returns the resources it found along with an error for the groups that failed.
+	lists, _ := resources.ServerPreferredResources()
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			if strings.Contains(resource.Name, "/") {
+				continue
+			}
+			candidates = append(candidates, candidate{group: gv.Group, kind: resource.Kind, resource: resource.Name})
+		}
+	}
+	return candidates
+}
+
+// suggest returns the kinds or resources served by the cluster that are most similar to the ones of
+// the watch, as they would be written in the watch.
+func suggest(watch config.Watch, candidates []candidate) []string {
+	type scored struct {
+		name     string
+		distance int
+	}
+	var matches []scored
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		var name string
+		var distance int
+		if watch.Resource != "" {
+			gr := schema.ParseGroupResource(watch.Resource)
+			name = schema.GroupResource{Group: c.group, Resource: c.resource}.String()
+			distance = similarity(gr.Resource, c.resource, gr.Group, c.group)
+		} else {
+			name = schema.GroupKind{Group: c.group, Kind: c.kind}.String()
+			distance = similarity(watch.Kind, c.kind, watch.Group, c.group)
+		}
+		if distance < 0 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		matches = append(matches, scored{name: name, distance: distance})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+	suggestions := []string{}
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, matches[i].name)
+	}
+	return suggestions
+}
+
+// similarity scores how close a candidate name and group are to the ones of a watch, where lower is
+// closer. It returns -1 if the candidate is not similar enough to be suggested.
+func similarity(name string, candidateName string, group string, candidateGroup string) int {
+	distance := editDistance(strings.ToLower(name), strings.ToLower(candidateName))
+	// Allow roughly one typo for every four characters.
+	if distance > 1+len(name)/4 {
+		return -1
+	}
+	if group != candidateGroup {
+		distance++
+	}
+	return distance
+}
+
+// editDistance returns the number of insertions, deletions, substitutions, and transpositions of
+// adjacent characters needed to turn a into b.
+func editDistance(a string, b string) int {
+	// distances[i][j] is the distance between the first i characters of a and the first j of b.
+	distances := make([][]int, len(a)+1)
+	for i := range distances {
+		distances[i] = make([]int, len(b)+1)
+		distances[i][0] = i
+	}
+	for j := range distances[0] {
+		distances[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := distances[i-1][j-1] + cost
+			if distances[i-1][j]+1 < d {
+				d = distances[i-1][j] + 1
+			}
+			if distances[i][j-1]+1 < d {
+				d = distances[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && distances[i-2][j-2]+1 < d {
+				d = distances[i-2][j-2] + 1
+			}
+			distances[i][j] = d
+		}
+	}
+	return distances[len(a)][len(b)]
+}
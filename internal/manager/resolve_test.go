@@ -0,0 +1,181 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+var testResources = []*metav1.APIResourceList{
+	{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "pods", Kind: "Pod"},
+			{Name: "pods/log", Kind: "Pod"},
+		},
+	},
+	{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment"}},
+	},
+	{
+		GroupVersion: "batch/v1",
+		APIResources: []metav1.APIResource{
+			{Name: "jobs", Kind: "Job"},
+			{Name: "cronjobs", Kind: "CronJob"},
+		},
+	},
+	{
+		GroupVersion: "tekton.dev/v1",
+		APIResources: []metav1.APIResource{{Name: "pipelineruns", Kind: "PipelineRun"}},
+	},
+}
+
+// newTestMapper returns a RESTMapper for testResources. batch/v1 is the preferred version of Job,
+// and batch/v1beta1 also serves it.
+func newTestMapper() meta.RESTMapper {
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{
+		{Version: "v1"}, {Group: "apps", Version: "v1"}, {Group: "batch", Version: "v1"},
+		{Group: "batch", Version: "v1beta1"}, {Group: "tekton.dev", Version: "v1"},
+	})
+	for _, list := range testResources {
+		gv, _ := schema.ParseGroupVersion(list.GroupVersion)
+		for _, resource := range list.APIResources {
+			mapper.Add(gv.WithKind(resource.Kind), meta.RESTScopeNamespace)
+		}
+	}
+	mapper.Add(schema.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "Job"}, meta.RESTScopeNamespace)
+	return mapper
+}
+
+// fakeResources serves testResources through discovery.
+type fakeResources struct {
+	discovery.ServerResourcesInterface
+}
+
+func (fakeResources) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return testResources, nil
+}
+
+func TestResolveWatches(t *testing.T) {
+	o := NewWithT(t)
+	watches := []config.Watch{
+		{Name: "jobs", Resource: "jobs.batch"},
+		{Name: "pods", Version: "v1", Kind: "Pod"},
+		{Name: "deployments", Group: "apps", Kind: "Deployment"},
+		{Name: "old-jobs", Group: "batch", Version: "v1beta1", Kind: "Job"},
+	}
+	resolved, err := ResolveWatches(newTestMapper(), fakeResources{}, watches)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(resolved).To(Equal([]config.Watch{
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Job", Resource: "jobs.batch"},
+		{Name: "pods", Version: "v1", Kind: "Pod"},
+		{Name: "deployments", Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Name: "old-jobs", Group: "batch", Version: "v1beta1", Kind: "Job"},
+	}))
+}
+
+func TestResolveWatchesInvalid(t *testing.T) {
+	o := NewWithT(t)
+	watches := []config.Watch{
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Jbo"},
+		{Name: "deployments", Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Name: "cronjobs", Resource: "cronjbos.batch"},
+		{Name: "pipelineruns", Group: "tekton.dev", Version: "v2", Kind: "PipelineRun"},
+		{Name: "pods", Resource: "pods", Kind: "Job"},
+		{Name: "empty", Group: "apps"},
+	}
+	_, err := ResolveWatches(newTestMapper(), fakeResources{}, watches)
+	o.Expect(err).To(HaveOccurred())
+	message := err.Error()
+	o.Expect(message).To(HavePrefix("5 invalid watches:"))
+	o.Expect(message).To(ContainSubstring(`watch "jobs": `))
+	o.Expect(message).To(ContainSubstring("did you mean Job.batch?"))
+	o.Expect(message).To(ContainSubstring("did you mean cronjobs.batch?"))
+	o.Expect(message).To(ContainSubstring(`watch "pipelineruns": `))
+	o.Expect(message).To(ContainSubstring(`watch "pods": resource pods is of kind Pod, not Job` + "\n"))
+	o.Expect(message).To(ContainSubstring(`watch "empty": a kind or resource is required`))
+	o.Expect(message).NotTo(ContainSubstring(`watch "deployments"`))
+}
+
+func TestResolveWatchesAllowingPending(t *testing.T) {
+	o := NewWithT(t)
+	watches := []config.Watch{
+		{Name: "jobs", Resource: "jobs.batch"},
+		{Name: "taskruns", Group: "tekton.dev", Kind: "TaskRun"},
+		{Name: "widgets", Resource: "widgets.example.com"},
+	}
+	resolved, pending, err := ResolveWatchesAllowingPending(newTestMapper(), fakeResources{}, watches)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(resolved).To(Equal([]config.Watch{
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Job", Resource: "jobs.batch"},
+	}))
+	o.Expect(pending).To(Equal([]config.Watch{
+		{Name: "taskruns", Group: "tekton.dev", Kind: "TaskRun"},
+		{Name: "widgets", Resource: "widgets.example.com"},
+	}), "watches whose kind is not served wait for their CustomResourceDefinition")
+
+	watches = []config.Watch{
+		{Name: "pipelineruns", Group: "tekton.dev", Version: "v2", Kind: "PipelineRun"},
+		{Name: "typo", Group: "tekton.dev", Kind: "PipelinRun"},
+		{Name: "resource-typo", Resource: "pipelinerns.tekton.dev"},
+		{Name: "cronjobs", Group: "batch", Kind: "Cronjob"},
+	}
+	_, _, err = ResolveWatchesAllowingPending(newTestMapper(), fakeResources{}, watches)
+	o.Expect(err).To(HaveOccurred(), "watches of a group that serves a similar kind are invalid")
+	message := err.Error()
+	o.Expect(message).To(HavePrefix("4 invalid watches:"))
+	o.Expect(message).To(ContainSubstring(`watch "pipelineruns": `))
+	o.Expect(message).To(ContainSubstring("did you mean PipelineRun.tekton.dev?"))
+	o.Expect(message).To(ContainSubstring("did you mean pipelineruns.tekton.dev?"))
+}
+
+func TestValidateNamespacedWatches(t *testing.T) {
+	o := NewWithT(t)
+	mapper := newTestMapper().(*meta.DefaultRESTMapper)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	o.Expect(ValidateNamespacedWatches(mapper, []config.Watch{
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Job"},
+		{Name: "pods", Version: "v1", Kind: "Pod"},
+	})).To(Succeed())
+
+	err := ValidateNamespacedWatches(mapper, []config.Watch{
+		{Name: "jobs", Group: "batch", Version: "v1", Kind: "Job"},
+		{Name: "namespaces", Version: "v1", Kind: "Namespace"},
+	})
+	o.Expect(err).To(MatchError("1 invalid watches:\n" + `watch "namespaces": namespaces is cluster-scoped, ` +
+		"so it cannot be watched when watch-namespaces is set"))
+}
+
+func TestEditDistance(t *testing.T) {
+	o := NewWithT(t)
+	o.Expect(editDistance("job", "job")).To(Equal(0))
+	o.Expect(editDistance("jbo", "job")).To(Equal(1))
+	o.Expect(editDistance("deploymnet", "deployment")).To(Equal(1))
+	o.Expect(editDistance("cronjob", "job")).To(Equal(4))
+	o.Expect(editDistance("", "pod")).To(Equal(3))
+}
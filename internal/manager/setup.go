@@ -17,38 +17,176 @@ limitations under the License.
 package manager
 
 import (
-	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"context"
+	"fmt"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
+	"github.com/kubearchive/dynowatch/internal/checkpoint"
 	"github.com/kubearchive/dynowatch/internal/config"
 	"github.com/kubearchive/dynowatch/internal/controller"
+	"github.com/kubearchive/dynowatch/internal/delivery"
+	"github.com/kubearchive/dynowatch/internal/sink"
 )
 
 var log = ctrl.Log.WithName("manager")
 
-func SetupControllers(mgr manager.Manager, client cloudevents.Client, watches []config.Watch, eventsSource string, eventsTarget string) error {
-	for _, watchObj := range watches {
-		gvk := schema.GroupVersionKind{
-			Group:   watchObj.Group,
-			Version: watchObj.Version,
-			Kind:    watchObj.Kind,
-		}
-		reconciler := &controller.DynamicReconciler{
-			Client:           mgr.GetClient(),
-			Scheme:           mgr.GetScheme(),
-			Name:             watchObj.Name,
-			GroupVersionKind: gvk,
-			EventsSource:     eventsSource,
-			EventsTarget:     eventsTarget,
-			EventsClient:     client,
-		}
-		if err := reconciler.SetupWithManager(mgr); err != nil {
+// Options configures the controllers set up by SetupControllers.
+type Options struct {
+	// Sender delivers the events of every controller.
+	Sender sink.Sender
+	// EventsSource is the source of the events.
+	EventsSource string
+	// EventsTarget is the resolved address the events are delivered to.
+	EventsTarget string
+	// Watches are the objects to watch with a controller.
+	Watches []config.Watch
+	// Checkpoint is the resume checkpoint of the watches. It is only used if it is enabled, and is
+	// kept in the namespace dynowatch runs in unless it sets one.
+	Checkpoint *config.CheckpointConfig
+	// DiscoveryInterval is how often the kinds of discovered watches are discovered again.
+	DiscoveryInterval time.Duration
+	// WatchNamespaces restricts the watches to these namespaces. Every namespace is watched if it is
+	// empty.
+	WatchNamespaces []string
+}
+
+// SetupControllers resolves the watches, then sets up a controller for each of them with mgr. No
+// controller is set up if any watch is invalid. Watches of custom resources that are not installed
+// yet are pending, and their controllers start once the CustomResourceDefinition is established.
+// The kinds of watches of every kind in a group, or of the CustomResourceDefinitions matching a
+// selector, are discovered every DiscoveryInterval. The access of every watch to its resource is
+// reviewed before its controller starts, and watches that are denied access fail the setup, are
+// skipped, or wait until they are allowed access, according to their on-forbidden setting.
+//
+// If WatchNamespaces is set, the watches only see the objects of these namespaces, which the cache
+// of mgr must be restricted to as well. Cluster-scoped kinds are invalid, and watches of custom
+// resources cannot be pending, since CustomResourceDefinitions are cluster-scoped.
+func SetupControllers(mgr manager.Manager, opts Options) error {
+	if opts.Checkpoint != nil && !opts.Checkpoint.Enabled {
+		opts.Checkpoint = nil
+	}
+	if opts.Checkpoint != nil && opts.Checkpoint.Namespace == "" {
+		namespace, err := config.CurrentNamespace()
+		if err != nil {
+			return fmt.Errorf("determining checkpoint namespace: %w", err)
+		}
+		checkpointConfig := *opts.Checkpoint
+		checkpointConfig.Namespace = namespace
+		opts.Checkpoint = &checkpointConfig
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		return err
+	}
+	var discovered []config.Watch
+	explicit := make([]config.Watch, 0, len(opts.Watches))
+	for _, watchObj := range opts.Watches {
+		if watchObj.IsDiscovered() {
+			discovered = append(discovered, watchObj)
+		} else {
+			explicit = append(explicit, watchObj)
+		}
+	}
+	var watches, pending []config.Watch
+	if len(opts.WatchNamespaces) > 0 {
+		watches, err = ResolveWatches(mgr.GetRESTMapper(), discoveryClient, explicit)
+		if err == nil {
+			err = ValidateNamespacedWatches(mgr.GetRESTMapper(), watches)
+		}
+	} else {
+		watches, pending, err = ResolveWatchesAllowingPending(mgr.GetRESTMapper(), discoveryClient, explicit)
+	}
+	if err != nil {
+		return err
+	}
+	reviewer := &accessReviewer{Client: mgr.GetClient(), mapper: mgr.GetRESTMapper(), namespaces: opts.WatchNamespaces}
+	preflightCtx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	allowed, waiting, err := reviewer.preflight(preflightCtx, watches)
+	if err != nil {
+		return err
+	}
+	newReconciler := func(watchObj config.Watch) *controller.DynamicReconciler {
+		return newDynamicReconciler(mgr, opts, watchObj)
+	}
+	if len(discovered) > 0 {
+		others := append(append([]config.Watch{}, watches...), pending...)
+		discoveredWatches := newDiscoveredWatches(mgr.GetAPIReader(), discoveryClient, discovered, others)
+		discoveredWatches.mgr = mgr
+		discoveredWatches.interval = opts.DiscoveryInterval
+		discoveredWatches.newReconciler = newReconciler
+		discoveredWatches.reviewer = reviewer
+		discoveredWatches.namespaced = len(opts.WatchNamespaces) > 0
+		if err := mgr.Add(discoveredWatches); err != nil {
+			return err
+		}
+	}
+	for _, watchObj := range allowed {
+		if err := newReconciler(watchObj).SetupWithManager(mgr); err != nil {
 			return err
 		}
 		log.Info("Setup controller", "controller", watchObj.Name, "controllerGroup", watchObj.Group, "controllerKind", watchObj.Kind)
 	}
-	return nil
+	if len(waiting) > 0 {
+		waitingWatches := &waitingWatches{reviewer: reviewer, mgr: mgr, newReconciler: newReconciler, waiting: waiting}
+		if err := mgr.Add(waitingWatches); err != nil {
+			return err
+		}
+		if err := mgr.AddReadyzCheck("forbidden-watches", waitingWatches.Check); err != nil {
+			return err
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	pendingWatches := newPendingWatches(mgr, pending, newReconciler)
+	pendingWatches.reviewer = reviewer
+	return pendingWatches.SetupWithManager(mgr)
+}
+
+// newDynamicReconciler returns the reconciler of a watch.
+func newDynamicReconciler(mgr manager.Manager, opts Options, watchObj config.Watch) *controller.DynamicReconciler {
+	gvk := schema.GroupVersionKind{
+		Group:   watchObj.Group,
+		Version: watchObj.Version,
+		Kind:    watchObj.Kind,
+	}
+	reconciler := &controller.DynamicReconciler{
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Name:                    watchObj.Name,
+		GroupVersionKind:        gvk,
+		EventsSource:            opts.EventsSource,
+		EventsTarget:            opts.EventsTarget,
+		EventsClient:            opts.Sender,
+		MaxConcurrentReconciles: watchObj.MaxConcurrentReconciles,
+		InitialSync:             watchObj.InitialSync,
+		Namespaces:              opts.WatchNamespaces,
+	}
+	if watchObj.EventsPerSecond > 0 {
+		reconciler.Limiter = delivery.NewLimiter(watchObj.EventsPerSecond, watchObj.Burst)
+	}
+	if opts.Checkpoint != nil {
+		reconciler.Checkpoint = &checkpoint.Checkpoint{
+			Client:    mgr.GetClient(),
+			Reader:    mgr.GetAPIReader(),
+			Namespace: opts.Checkpoint.Namespace,
+			Name:      "dynowatch-checkpoint-" + watchObj.Name,
+			Interval:  opts.Checkpoint.Interval,
+		}
+	}
+	if watchObj.Inventory != nil {
+		reconciler.InventoryInterval = watchObj.Inventory.Interval
+		reconciler.InventoryChunkSize = watchObj.Inventory.MaxObjects
+	}
+	if watchObj.Debounce != nil {
+		reconciler.DebounceWindow = watchObj.Debounce.Window
+		reconciler.DebounceMaxDelay = watchObj.Debounce.MaxDelay
+	}
+	return reconciler
 }
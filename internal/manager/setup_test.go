@@ -17,12 +17,17 @@ limitations under the License.
 package manager
 
 import (
+	"net/http"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
 
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/kubearchive/dynowatch/internal/config"
 )
@@ -44,7 +49,92 @@ func TestSetupControllers(t *testing.T) {
 		},
 	}
 	restConfig := &rest.Config{}
-	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{})
+	options := newTestOptions()
+	mgr, err := ctrl.NewManager(restConfig, options)
 	o.Expect(err).NotTo(HaveOccurred())
-	o.Expect(SetupControllers(mgr, nil, watches, "localhost", "https://splunk.mycompany.com")).To(Succeed())
+	o.Expect(SetupControllers(mgr, newSetupOptions(watches))).To(Succeed())
+
+	mgr, err = ctrl.NewManager(restConfig, options)
+	o.Expect(err).NotTo(HaveOccurred())
+	setupOptions := newSetupOptions(watches)
+	setupOptions.Checkpoint = &config.CheckpointConfig{Enabled: true, Namespace: "dynowatch-system"}
+	o.Expect(SetupControllers(mgr, setupOptions)).To(Succeed())
+}
+
+func TestSetupControllersInvalidWatch(t *testing.T) {
+	o := NewWithT(t)
+	mgr, err := ctrl.NewManager(&rest.Config{}, newTestOptions())
+	o.Expect(err).NotTo(HaveOccurred())
+	watches := []config.Watch{{Name: "deployments", Group: "apps", Version: "v1", Kind: "Deploymnet"}}
+	o.Expect(SetupControllers(mgr, newSetupOptions(watches))).To(
+		MatchError(ContainSubstring(`watch "deployments"`)))
+}
+
+func TestSetupControllersForbiddenWatch(t *testing.T) {
+	o := NewWithT(t)
+	watches := []config.Watch{
+		{Name: "deployments", Group: "apps", Version: "v1", Kind: "Deployment", OnForbidden: config.OnForbiddenFail},
+	}
+	mgr, err := ctrl.NewManager(&rest.Config{}, newTestOptions("deployments/watch"))
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(SetupControllers(mgr, newSetupOptions(watches))).To(
+		MatchError(ContainSubstring(`watch "deployments": not allowed to watch deployments.apps`)))
+
+	watches[0].OnForbidden = config.OnForbiddenWait
+	mgr, err = ctrl.NewManager(&rest.Config{}, newTestOptions("deployments/watch"))
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(SetupControllers(mgr, newSetupOptions(watches))).To(
+		Succeed())
+}
+
+func TestSetupControllersWatchNamespaces(t *testing.T) {
+	o := NewWithT(t)
+	options := newTestOptions()
+	options.MapperProvider = func(*rest.Config, *http.Client) (meta.RESTMapper, error) {
+		mapper := newTestMapper().(*meta.DefaultRESTMapper)
+		mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+		return mapper, nil
+	}
+	watches := []config.Watch{{Name: "deployments", Group: "apps", Version: "v1", Kind: "Deployment"}}
+	namespaces := []string{"team-a", "team-b"}
+	setupOptions := newSetupOptions(watches)
+	setupOptions.WatchNamespaces = namespaces
+	mgr, err := ctrl.NewManager(&rest.Config{}, options)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(SetupControllers(mgr, setupOptions)).To(Succeed())
+
+	setupOptions.Watches = append(watches, config.Watch{Name: "namespaces", Version: "v1", Kind: "Namespace"})
+	mgr, err = ctrl.NewManager(&rest.Config{}, options)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(SetupControllers(mgr, setupOptions)).To(
+		MatchError(ContainSubstring(`watch "namespaces": namespaces is cluster-scoped`)))
+
+	setupOptions.Watches = []config.Watch{{Name: "runs", Group: "tekton.dev", Version: "v1", Kind: "TaskRun"}}
+	mgr, err = ctrl.NewManager(&rest.Config{}, options)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(SetupControllers(mgr, setupOptions)).To(MatchError(ContainSubstring(`watch "runs"`)),
+		"watches cannot be pending")
+}
+
+// newSetupOptions returns the options of SetupControllers for the watches.
+func newSetupOptions(watches []config.Watch) Options {
+	return Options{
+		EventsSource:      "localhost",
+		EventsTarget:      "https://splunk.mycompany.com",
+		Watches:           watches,
+		DiscoveryInterval: time.Minute,
+	}
+}
+
+// newTestOptions returns manager options with the test RESTMapper, and a client that allows every
+// access review except the denied ones.
+func newTestOptions(denied ...string) ctrl.Options {
+	return ctrl.Options{
+		MapperProvider: func(*rest.Config, *http.Client) (meta.RESTMapper, error) {
+			return newTestMapper(), nil
+		},
+		NewClient: func(*rest.Config, client.Options) (client.Client, error) {
+			return newAccessClient(denied...), nil
+		},
+	}
 }
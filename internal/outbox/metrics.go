@@ -0,0 +1,45 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outbox
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	backlog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "dynowatch_outbox_backlog",
+		Help: "Number of events in the outbox that have not been delivered",
+	})
+	delivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynowatch_outbox_delivered_total",
+		Help: "Total number of events delivered from the outbox",
+	})
+	deliveryFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynowatch_outbox_delivery_failures_total",
+		Help: "Total number of failed attempts to deliver an event from the outbox",
+	})
+	poisoned = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "dynowatch_outbox_poisoned_total",
+		Help: "Total number of events moved from the outbox to the poison file",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(backlog, delivered, deliveryFailures, poisoned)
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/kubearchive/dynowatch/internal/delivery"
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+const (
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+var (
+	log          = ctrl.Log.WithName("outbox")
+	eventsBucket = []byte("events")
+)
+
+// record is an event persisted in the outbox, along with the address it is sent to.
+type record struct {
+	Target string            `json:"target,omitempty"`
+	Event  cloudevents.Event `json:"event"`
+}
+
+// Outbox is a write-ahead log of CloudEvents backed by a bbolt database. Send persists an event and
+// returns once it is on disk; a dispatcher started with Start delivers persisted events to the
+// target in the order they were written. Delivered events are removed from the outbox once the
+// target acknowledges them. Undelivered events survive restarts and are delivered when the
+// dispatcher starts again.
+//
+// An event that the target rejects as not retryable, or that fails MaxAttempts times, is moved to
+// the poison file next to the database, so that it does not block the events written after it.
+// The poison file can be re-driven like a dead-letter file.
+type Outbox struct {
+	// MaxAttempts is the number of times an event is attempted before it is moved to the poison
+	// file. If zero, events that may succeed later are retried until they are delivered.
+	MaxAttempts int
+
+	db             *bolt.DB
+	sender         sink.Sender
+	poison         sink.Sender
+	poisonPath     string
+	notify         chan struct{}
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	// attempts is the number of failed attempts to deliver the event at attemptsKey.
+	attempts    int
+	attemptsKey []byte
+}
+
+// PoisonPath returns the path of the poison file of the outbox database at path.
+func PoisonPath(path string) string {
+	return path + ".poison.jsonl"
+}
+
+// Open opens or creates the outbox database at path. Events are delivered with sender. If maxBackoff
+// is zero, failed deliveries are retried with a backoff of at most 30 seconds.
+func Open(path string, sender sink.Sender, maxBackoff time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening outbox %s: %w", path, err)
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	poison, err := sink.NewFileSender(PoisonPath(path))
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	o := &Outbox{
+		db:             db,
+		sender:         sender,
+		poison:         poison,
+		poisonPath:     PoisonPath(path),
+		notify:         make(chan struct{}, 1),
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     maxBackoff,
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(eventsBucket)
+		if err != nil {
+			return err
+		}
+		backlog.Set(float64(b.Stats().KeyN))
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+// Send persists the event to the outbox. The target set on ctx is persisted with the event. Events
+// without an ID are assigned one before they are persisted, so that every attempt to deliver them,
+// including after a restart, has the same ID and receivers can deduplicate them.
+func (o *Outbox) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	if event.ID() == "" {
+		event = event.Clone()
+		event.SetID(uuid.NewString())
+	}
+	rec := record{Event: event}
+	if target := cecontext.TargetFrom(ctx); target != nil {
+		rec.Target = target.String()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(sequenceKey(seq), data)
+	})
+	if err != nil {
+		return fmt.Errorf("writing event to outbox: %w", err)
+	}
+	backlog.Inc()
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of undelivered events in the outbox.
+func (o *Outbox) Len() (int, error) {
+	n := 0
+	err := o.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(eventsBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Start runs the dispatcher until ctx is cancelled. Events are delivered one at a time, in order.
+// If an event is not acknowledged, delivery is retried with exponential backoff before any later
+// event is sent, unless the event is moved to the poison file.
+func (o *Outbox) Start(ctx context.Context) error {
+	backoff := o.initialBackoff
+	for {
+		wait := o.notify
+		var retry <-chan time.Time
+		if err := o.dispatch(ctx); err != nil {
+			log.Error(err, "Failed to deliver event from outbox", "backoff", backoff)
+			retry = time.After(backoff)
+			wait = nil
+			backoff *= 2
+			if backoff > o.maxBackoff {
+				backoff = o.maxBackoff
+			}
+		} else {
+			backoff = o.initialBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wait:
+		case <-retry:
+		}
+	}
+}
+
+// NeedLeaderElection returns false, so that events persisted while this instance was the leader
+// are still delivered after it loses leadership.
+func (o *Outbox) NeedLeaderElection() bool {
+	return false
+}
+
+// Close closes the outbox database.
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// dispatch delivers persisted events in order until the outbox is empty, or an event fails.
+func (o *Outbox) dispatch(ctx context.Context) error {
+	for ctx.Err() == nil {
+		key, rec, err := o.next()
+		if err != nil || key == nil {
+			return err
+		}
+		sendCtx := ctx
+		if rec.Target != "" {
+			sendCtx = cloudevents.ContextWithTarget(ctx, rec.Target)
+		}
+		if result := o.sender.Send(sendCtx, rec.Event); !cloudevents.IsACK(result) {
+			deliveryFailures.Inc()
+			if ctx.Err() != nil || !o.isPoison(key, result) {
+				return result
+			}
+			if err := o.movePoison(key, rec, result); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := o.remove(key); err != nil {
+			return err
+		}
+		delivered.Inc()
+		backlog.Dec()
+	}
+	return nil
+}
+
+// isPoison records a failed attempt to deliver the event at key, and reports whether the event
+// should be moved to the poison file instead of being attempted again. Events rejected by an open
+// circuit breaker were not attempted, and are kept.
+func (o *Outbox) isPoison(key []byte, result protocol.Result) bool {
+	if errors.Is(result, delivery.ErrCircuitOpen) {
+		return false
+	}
+	if !bytes.Equal(key, o.attemptsKey) {
+		o.attemptsKey, o.attempts = key, 0
+	}
+	o.attempts++
+	return !delivery.IsRetryable(result) || (o.MaxAttempts > 0 && o.attempts >= o.MaxAttempts)
+}
+
+// movePoison writes the event at key to the poison file, annotated like a dead-lettered event, and
+// removes it from the outbox.
+func (o *Outbox) movePoison(key []byte, rec *record, result protocol.Result) error {
+	event := rec.Event.Clone()
+	event.SetExtension(delivery.DeadLetterReasonExtension, result.Error())
+	event.SetExtension(delivery.DeadLetterAttemptsExtension, int32(o.attempts))
+	if rec.Target != "" {
+		event.SetExtension(delivery.DeadLetterTargetExtension, rec.Target)
+	}
+	if err := o.poison.Send(context.Background(), event); err != nil {
+		return fmt.Errorf("writing event %s to poison file: %w", event.ID(), err)
+	}
+	if err := o.remove(key); err != nil {
+		return err
+	}
+	log.Error(result, "Moved undeliverable event from outbox to poison file", "id", event.ID(),
+		"attempts", o.attempts, "file", o.poisonPath)
+	o.attemptsKey, o.attempts = nil, 0
+	poisoned.Inc()
+	backlog.Dec()
+	return nil
+}
+
+// next returns the oldest event in the outbox, or a nil key if the outbox is empty.
+func (o *Outbox) next() ([]byte, *record, error) {
+	var key []byte
+	rec := &record{}
+	err := o.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(eventsBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		key = append([]byte{}, k...)
+		return json.Unmarshal(v, rec)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading event from outbox: %w", err)
+	}
+	return key, rec, nil
+}
+
+func (o *Outbox) remove(key []byte) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(eventsBucket).Delete(key)
+	})
+}
+
+// sequenceKey encodes seq as a big-endian key, so keys sort in the order events were written.
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
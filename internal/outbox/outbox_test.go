@@ -0,0 +1,196 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+
+	"github.com/kubearchive/dynowatch/internal/delivery"
+	"github.com/kubearchive/dynowatch/internal/sink"
+)
+
+// fakeSender records delivered events, and fails while failing is set. Events with an ID in
+// rejected are rejected as not retryable.
+type fakeSender struct {
+	mu       sync.Mutex
+	failing  bool
+	rejected map[string]bool
+	events   []cloudevents.Event
+	targets  []string
+}
+
+func (f *fakeSender) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		return errors.New("connection refused")
+	}
+	if f.rejected[event.ID()] {
+		return cehttp.NewResult(http.StatusBadRequest, "invalid event")
+	}
+	f.events = append(f.events, event)
+	f.targets = append(f.targets, cecontext.TargetFrom(ctx).String())
+	return nil
+}
+
+func (f *fakeSender) setFailing(failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeSender) ids() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := []string{}
+	for _, e := range f.events {
+		ids = append(ids, e.ID())
+	}
+	return ids
+}
+
+func newTestEvent(id string) cloudevents.Event {
+	event := cloudevents.NewEvent()
+	event.SetID(id)
+	event.SetSource("test-source")
+	event.SetType("dynowatch.kubearchive.dev")
+	return event
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	o := NewWithT(t)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	ctx := cloudevents.ContextWithTarget(context.Background(), "http://localhost:8082")
+
+	sender := &fakeSender{failing: true}
+	outbox, err := Open(path, sender, time.Second)
+	o.Expect(err).NotTo(HaveOccurred())
+	for i := 1; i <= 3; i++ {
+		o.Expect(outbox.Send(ctx, newTestEvent(fmt.Sprint(i)))).To(Succeed())
+	}
+	o.Expect(outbox.dispatch(context.Background())).To(HaveOccurred())
+	o.Expect(outbox.Len()).To(Equal(3))
+	o.Expect(outbox.Close()).To(Succeed())
+
+	sender.setFailing(false)
+	outbox, err = Open(path, sender, time.Second)
+	o.Expect(err).NotTo(HaveOccurred())
+	defer outbox.Close()
+	o.Expect(outbox.Len()).To(Equal(3))
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = outbox.Start(runCtx)
+	}()
+	o.Eventually(sender.ids).Should(Equal([]string{"1", "2", "3"}))
+	o.Expect(sender.targets).To(HaveEach("http://localhost:8082"))
+	o.Expect(outbox.Len()).To(Equal(0))
+
+	o.Expect(outbox.Send(ctx, newTestEvent("4"))).To(Succeed())
+	o.Eventually(sender.ids).Should(Equal([]string{"1", "2", "3", "4"}))
+}
+
+func TestOutboxRetriesInOrder(t *testing.T) {
+	o := NewWithT(t)
+	sender := &fakeSender{failing: true}
+	outbox, err := Open(filepath.Join(t.TempDir(), "outbox.db"), sender, 50*time.Millisecond)
+	o.Expect(err).NotTo(HaveOccurred())
+	defer outbox.Close()
+	outbox.initialBackoff = 10 * time.Millisecond
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = outbox.Start(runCtx)
+	}()
+	ctx := cloudevents.ContextWithTarget(context.Background(), "http://localhost:8082")
+	o.Expect(outbox.Send(ctx, newTestEvent("1"))).To(Succeed())
+	o.Expect(outbox.Send(ctx, newTestEvent("2"))).To(Succeed())
+	o.Consistently(sender.ids, 100*time.Millisecond).Should(BeEmpty())
+
+	sender.setFailing(false)
+	o.Eventually(sender.ids).Should(Equal([]string{"1", "2"}))
+}
+
+func TestOutboxAssignsIDs(t *testing.T) {
+	o := NewWithT(t)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	sender := &fakeSender{failing: true}
+	outbox, err := Open(path, sender, time.Second)
+	o.Expect(err).NotTo(HaveOccurred())
+	defer outbox.Close()
+
+	ctx := cloudevents.ContextWithTarget(context.Background(), "http://localhost:8082")
+	o.Expect(outbox.Send(ctx, newTestEvent(""))).To(Succeed())
+	_, rec, err := outbox.next()
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(rec.Event.ID()).NotTo(BeEmpty())
+
+	sender.setFailing(false)
+	o.Expect(outbox.dispatch(context.Background())).To(Succeed())
+	o.Expect(sender.ids()).To(Equal([]string{rec.Event.ID()}))
+}
+
+func TestOutboxMovesPoisonEvents(t *testing.T) {
+	o := NewWithT(t)
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	sender := &fakeSender{rejected: map[string]bool{"1": true}}
+	outbox, err := Open(path, sender, time.Second)
+	o.Expect(err).NotTo(HaveOccurred())
+	defer outbox.Close()
+
+	ctx := cloudevents.ContextWithTarget(context.Background(), "http://localhost:8082")
+	o.Expect(outbox.Send(ctx, newTestEvent("1"))).To(Succeed())
+	o.Expect(outbox.Send(ctx, newTestEvent("2"))).To(Succeed())
+	o.Expect(outbox.dispatch(context.Background())).To(Succeed())
+	o.Expect(sender.ids()).To(Equal([]string{"2"}))
+	o.Expect(outbox.Len()).To(Equal(0))
+
+	poisoned, err := sink.ReadEventsFile(PoisonPath(path))
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(poisoned).To(HaveLen(1))
+	o.Expect(poisoned[0].ID()).To(Equal("1"))
+	o.Expect(poisoned[0].Extensions()).To(HaveKeyWithValue(delivery.DeadLetterTargetExtension,
+		"http://localhost:8082"))
+
+	// Events that may succeed later are only moved once they fail max-attempts times.
+	outbox.MaxAttempts = 2
+	sender.setFailing(true)
+	o.Expect(outbox.Send(ctx, newTestEvent("3"))).To(Succeed())
+	o.Expect(outbox.dispatch(context.Background())).To(HaveOccurred())
+	o.Expect(outbox.Len()).To(Equal(1))
+	o.Expect(outbox.dispatch(context.Background())).To(Succeed())
+	o.Expect(outbox.Len()).To(Equal(0))
+	poisoned, err = sink.ReadEventsFile(PoisonPath(path))
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(poisoned).To(HaveLen(2))
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbac
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var columnPattern = regexp.MustCompile(`\S+`)
+
+// APIResources serves a fixed list of resources in place of discovery, so that RBAC can be
+// generated without access to the cluster. It implements discovery.ServerResourcesInterface, and
+// only lists the preferred version of each group.
+type APIResources []*metav1.APIResourceList
+
+// ParseAPIResources parses the output of kubectl api-resources, with or without -o wide.
+func ParseAPIResources(r io.Reader) (APIResources, error) {
+	scanner := bufio.NewScanner(r)
+	var columns map[string][2]int
+	var resources APIResources
+	lists := map[string]*metav1.APIResourceList{}
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if columns == nil {
+			columns = map[string][2]int{}
+			indexes := columnPattern.FindAllStringIndex(text, -1)
+			for i, index := range indexes {
+				end := -1
+				if i+1 < len(indexes) {
+					end = indexes[i+1][0]
+				}
+				columns[text[index[0]:index[1]]] = [2]int{index[0], end}
+			}
+			for _, name := range []string{"NAME", "APIVERSION", "NAMESPACED", "KIND"} {
+				if _, ok := columns[name]; !ok {
+					return nil, fmt.Errorf("line %d: column %s is missing", line, name)
+				}
+			}
+			continue
+		}
+		column := func(name string) string {
+			bounds, ok := columns[name]
+			if !ok || bounds[0] >= len(text) {
+				return ""
+			}
+			if bounds[1] < 0 || bounds[1] > len(text) {
+				return strings.TrimSpace(text[bounds[0]:])
+			}
+			return strings.TrimSpace(text[bounds[0]:bounds[1]])
+		}
+		resource := metav1.APIResource{
+			Name:       column("NAME"),
+			Namespaced: column("NAMESPACED") == "true",
+			Kind:       column("KIND"),
+			Verbs: strings.FieldsFunc(strings.Trim(column("VERBS"), "[]"), func(r rune) bool {
+				return r == ',' || r == ' '
+			}),
+		}
+		if shortNames := column("SHORTNAMES"); shortNames != "" {
+			resource.ShortNames = strings.Split(shortNames, ",")
+		}
+		groupVersion := column("APIVERSION")
+		if resource.Name == "" || resource.Kind == "" || groupVersion == "" {
+			return nil, fmt.Errorf("line %d: a name, apiversion, and kind are required", line)
+		}
+		if _, err := schema.ParseGroupVersion(groupVersion); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		list, ok := lists[groupVersion]
+		if !ok {
+			list = &metav1.APIResourceList{GroupVersion: groupVersion}
+			lists[groupVersion] = list
+			resources = append(resources, list)
+		}
+		list.APIResources = append(list.APIResources, resource)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if columns == nil {
+		return nil, errors.New("no resources are listed")
+	}
+	return resources, nil
+}
+
+// RESTMapper returns a RESTMapper for the resources.
+func (r APIResources) RESTMapper() meta.RESTMapper {
+	var versions []schema.GroupVersion
+	for _, list := range r {
+		gv, _ := schema.ParseGroupVersion(list.GroupVersion)
+		versions = append(versions, gv)
+	}
+	mapper := meta.NewDefaultRESTMapper(versions)
+	for _, list := range r {
+		gv, _ := schema.ParseGroupVersion(list.GroupVersion)
+		for _, resource := range list.APIResources {
+			scope := meta.RESTScopeRoot
+			if resource.Namespaced {
+				scope = meta.RESTScopeNamespace
+			}
+			singular := resource.SingularName
+			if singular == "" {
+				singular = strings.ToLower(resource.Kind)
+			}
+			mapper.AddSpecific(gv.WithKind(resource.Kind), gv.WithResource(resource.Name),
+				gv.WithResource(singular), scope)
+		}
+	}
+	return mapper
+}
+
+func (r APIResources) ServerResourcesForGroupVersion(groupVersion string) (*metav1.APIResourceList, error) {
+	for _, list := range r {
+		if list.GroupVersion == groupVersion {
+			return list, nil
+		}
+	}
+	return nil, fmt.Errorf("group version %s is not listed", groupVersion)
+}
+
+func (r APIResources) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	var groups []*metav1.APIGroup
+	for _, list := range r {
+		gv, _ := schema.ParseGroupVersion(list.GroupVersion)
+		version := metav1.GroupVersionForDiscovery{GroupVersion: list.GroupVersion, Version: gv.Version}
+		groups = append(groups, &metav1.APIGroup{
+			Name:             gv.Group,
+			Versions:         []metav1.GroupVersionForDiscovery{version},
+			PreferredVersion: version,
+		})
+	}
+	return groups, r, nil
+}
+
+func (r APIResources) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return r, nil
+}
+
+func (r APIResources) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	var namespaced []*metav1.APIResourceList
+	for _, list := range r {
+		filtered := &metav1.APIResourceList{GroupVersion: list.GroupVersion}
+		for _, resource := range list.APIResources {
+			if resource.Namespaced {
+				filtered.APIResources = append(filtered.APIResources, resource)
+			}
+		}
+		namespaced = append(namespaced, filtered)
+	}
+	return namespaced, nil
+}
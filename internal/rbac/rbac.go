@@ -0,0 +1,342 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rbac generates the least-privileged RBAC objects that dynowatch needs for a
+// configuration.
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+	"github.com/kubearchive/dynowatch/internal/manager"
+)
+
+var watchVerbs = []string{"get", "list", "watch"}
+
+// Generator generates the RBAC objects that dynowatch needs for a configuration: get, list, and
+// watch on the watched resources, and only the rights that the enabled features require.
+type Generator struct {
+	// Mapper maps the kinds of the watches and sink references to their resources.
+	Mapper meta.RESTMapper
+	// Resources serves the resources of the cluster, to resolve watches.
+	Resources discovery.ServerResourcesInterface
+	// Reader lists the CustomResourceDefinitions selected by watches with a crd-selector. It is
+	// nil if the cluster is not available, in which case these watches are not supported.
+	Reader client.Reader
+	// Name is the name of the roles and their bindings.
+	Name string
+	// ServiceAccount is the service account dynowatch runs as. Its namespace is the one that
+	// settings without a namespace default to.
+	ServiceAccount types.NamespacedName
+	// WatchNamespaces are the namespaces the watches are restricted to. The rights on the watched
+	// resources are granted by a Role in each of them instead of the ClusterRole.
+	WatchNamespaces []string
+}
+
+// ruleKey identifies a resource that a role grants access to. An empty namespace stands for the
+// ClusterRole, and an empty name for every object of the resource.
+type ruleKey struct {
+	namespace string
+	group     string
+	resource  string
+	name      string
+}
+
+// Generate returns a ClusterRole and Roles granting the rights needed by settings, along with the
+// bindings of the service account to each of them. secrets are the Secrets that settings are read
+// from.
+func (g *Generator) Generate(ctx context.Context, settings *config.DynowatchConfig,
+	secrets []config.SecretKeySelector) ([]client.Object, error) {
+	rules := map[ruleKey]sets.Set[string]{}
+	add := func(key ruleKey, verbs ...string) {
+		if rules[key] == nil {
+			rules[key] = sets.New[string]()
+		}
+		rules[key].Insert(verbs...)
+	}
+	namespace := func(namespace string) string {
+		if namespace == "" {
+			return g.ServiceAccount.Namespace
+		}
+		return namespace
+	}
+
+	if err := g.watchRules(ctx, settings.Watches, add); err != nil {
+		return nil, err
+	}
+	events := settings.CloudEvents
+	sinkRefs := []*config.SinkReference{events.SinkRef}
+	auths := []*config.AuthConfig{events.Auth}
+	if events.DeadLetter != nil {
+		sinkRefs = append(sinkRefs, events.DeadLetter.SinkRef)
+		auths = append(auths, events.DeadLetter.Auth)
+	}
+	for _, ref := range sinkRefs {
+		if ref == nil {
+			continue
+		}
+		gr, err := g.resourceFor(ref.APIVersion, ref.Kind)
+		if err != nil {
+			return nil, fmt.Errorf("sink-ref %s %s: %w", ref.Kind, ref.Name, err)
+		}
+		add(ruleKey{namespace: namespace(ref.Namespace), group: gr.Group, resource: gr.Resource, name: ref.Name},
+			"get")
+	}
+	for _, auth := range auths {
+		if auth == nil || auth.ServiceAccountToken == nil {
+			continue
+		}
+		name := auth.ServiceAccountToken.ServiceAccount
+		if name == "" {
+			name = g.ServiceAccount.Name
+		}
+		add(ruleKey{namespace: namespace(auth.ServiceAccountToken.Namespace), resource: "serviceaccounts/token",
+			name: name}, "create")
+	}
+	if settings.Checkpoint != nil && settings.Checkpoint.Enabled {
+		// The names of the checkpoint ConfigMaps cannot be restricted, since they are created.
+		add(ruleKey{namespace: namespace(settings.Checkpoint.Namespace), resource: "configmaps"},
+			"get", "create", "update")
+	}
+	for _, secret := range secrets {
+		add(ruleKey{namespace: namespace(secret.Namespace), resource: "secrets", name: secret.Name}, "get")
+	}
+	return g.objects(rules), nil
+}
+
+// watchRules adds the rights needed by the watches. Watches of every kind of a group are granted
+// access to all the resources of the group, since their kinds are discovered while dynowatch runs.
+func (g *Generator) watchRules(ctx context.Context, watches []config.Watch, add func(ruleKey, ...string)) error {
+	addWatch := func(gr schema.GroupResource) {
+		if len(g.WatchNamespaces) == 0 {
+			add(ruleKey{group: gr.Group, resource: gr.Resource}, watchVerbs...)
+			return
+		}
+		for _, namespace := range g.WatchNamespaces {
+			add(ruleKey{namespace: namespace, group: gr.Group, resource: gr.Resource}, watchVerbs...)
+		}
+	}
+
+	needsCRDs := false
+	var others []config.Watch
+	for _, watch := range watches {
+		switch {
+		case watch.Kind == config.WildcardKind:
+			addWatch(schema.GroupResource{Group: watch.Group, Resource: "*"})
+			continue
+		case watch.CRDSelector != "" && g.Reader == nil:
+			return fmt.Errorf("watch %q: a crd-selector can only be resolved with access to the cluster", watch.Name)
+		case watch.CRDSelector != "":
+			needsCRDs = true
+		}
+		others = append(others, watch)
+	}
+	namespaced := len(g.WatchNamespaces) > 0
+	others, err := manager.DiscoverWatches(ctx, g.Reader, g.Resources, others, namespaced)
+	if err != nil {
+		return err
+	}
+	// Watches restricted to namespaces are resolved like the manager does, without pending watches
+	// or cluster-scoped kinds.
+	var resolved, pending []config.Watch
+	if namespaced {
+		resolved, err = manager.ResolveWatches(g.Mapper, g.Resources, others)
+		if err == nil {
+			err = manager.ValidateNamespacedWatches(g.Mapper, resolved)
+		}
+	} else {
+		resolved, pending, err = manager.ResolveWatchesAllowingPending(g.Mapper, g.Resources, others)
+	}
+	if err != nil {
+		return err
+	}
+	for _, watch := range resolved {
+		gk := schema.GroupKind{Group: watch.Group, Kind: watch.Kind}
+		mapping, err := g.Mapper.RESTMapping(gk, watch.Version)
+		if err != nil {
+			return fmt.Errorf("watch %q: %w", watch.Name, err)
+		}
+		addWatch(mapping.Resource.GroupResource())
+	}
+	// The resources of pending watches are not served yet, so their plural is guessed from their
+	// kind unless it is set.
+	for _, watch := range pending {
+		needsCRDs = true
+		gr := schema.ParseGroupResource(watch.Resource)
+		if watch.Resource == "" {
+			gvk := schema.GroupVersionKind{Group: watch.Group, Version: watch.Version, Kind: watch.Kind}
+			plural, _ := meta.UnsafeGuessKindToResource(gvk)
+			gr = plural.GroupResource()
+		} else if gr.Group == "" {
+			gr.Group = watch.Group
+		}
+		addWatch(gr)
+	}
+	if needsCRDs {
+		add(ruleKey{group: "apiextensions.k8s.io", resource: "customresourcedefinitions"}, watchVerbs...)
+	}
+	return nil
+}
+
+// resourceFor returns the resource of a kind. The plural of kinds that are not served, such as
+// the kinds of Knative when it is not installed, is guessed.
+func (g *Generator) resourceFor(apiVersion string, kind string) (schema.GroupResource, error) {
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return schema.GroupResource{}, err
+	}
+	mapping, err := g.Mapper.RESTMapping(gv.WithKind(kind).GroupKind(), gv.Version)
+	if meta.IsNoMatchError(err) {
+		plural, _ := meta.UnsafeGuessKindToResource(gv.WithKind(kind))
+		return plural.GroupResource(), nil
+	}
+	if err != nil {
+		return schema.GroupResource{}, err
+	}
+	return mapping.Resource.GroupResource(), nil
+}
+
+// objects returns the roles granting the rules, and their bindings. Rules for the same group and
+// verbs are merged, and the objects are sorted, so that the output is stable.
+func (g *Generator) objects(rules map[ruleKey]sets.Set[string]) []client.Object {
+	// The names of each resource by namespace, group and verbs. An empty set stands for every
+	// object of the resource.
+	type resourceKey struct {
+		namespace string
+		group     string
+		resource  string
+		verbs     string
+	}
+	names := map[resourceKey]sets.Set[string]{}
+	for key, verbs := range rules {
+		rk := resourceKey{key.namespace, key.group, key.resource, strings.Join(sets.List(verbs), ",")}
+		current, ok := names[rk]
+		switch {
+		case !ok:
+			names[rk] = sets.New[string]()
+			if key.name != "" {
+				names[rk].Insert(key.name)
+			}
+		case current.Len() > 0 && key.name != "":
+			current.Insert(key.name)
+		default:
+			names[rk] = sets.New[string]()
+		}
+	}
+
+	type mergedKey struct {
+		namespace string
+		group     string
+		verbs     string
+		names     string
+	}
+	merged := map[mergedKey]sets.Set[string]{}
+	for rk, resourceNames := range names {
+		mk := mergedKey{rk.namespace, rk.group, rk.verbs, strings.Join(sets.List(resourceNames), ",")}
+		if merged[mk] == nil {
+			merged[mk] = sets.New[string]()
+		}
+		merged[mk].Insert(rk.resource)
+	}
+	keys := make([]mergedKey, 0, len(merged))
+	for mk := range merged {
+		keys = append(keys, mk)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		ra, rb := sets.List(merged[a])[0], sets.List(merged[b])[0]
+		if ra != rb {
+			return ra < rb
+		}
+		if a.names != b.names {
+			return a.names < b.names
+		}
+		return a.verbs < b.verbs
+	})
+
+	roleRules := map[string][]rbacv1.PolicyRule{}
+	namespaces := []string{}
+	for _, mk := range keys {
+		rule := rbacv1.PolicyRule{
+			APIGroups: []string{mk.group},
+			Resources: sets.List(merged[mk]),
+			Verbs:     strings.Split(mk.verbs, ","),
+		}
+		if mk.names != "" {
+			rule.ResourceNames = strings.Split(mk.names, ",")
+		}
+		if _, ok := roleRules[mk.namespace]; !ok {
+			namespaces = append(namespaces, mk.namespace)
+		}
+		roleRules[mk.namespace] = append(roleRules[mk.namespace], rule)
+	}
+
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      g.ServiceAccount.Name,
+		Namespace: g.ServiceAccount.Namespace,
+	}}
+	var objects []client.Object
+	for _, namespace := range namespaces {
+		if namespace == "" {
+			objects = append(objects,
+				&rbacv1.ClusterRole{
+					TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+					ObjectMeta: metav1.ObjectMeta{Name: g.Name},
+					Rules:      roleRules[namespace],
+				},
+				&rbacv1.ClusterRoleBinding{
+					TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+					ObjectMeta: metav1.ObjectMeta{Name: g.Name},
+					RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: g.Name},
+					Subjects:   subjects,
+				})
+			continue
+		}
+		objects = append(objects,
+			&rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: metav1.ObjectMeta{Name: g.Name, Namespace: namespace},
+				Rules:      roleRules[namespace],
+			},
+			&rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: g.Name, Namespace: namespace},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: g.Name},
+				Subjects:   subjects,
+			})
+	}
+	return objects
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rbac
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+const testAPIResources = `
+NAME          SHORTNAMES   APIVERSION   NAMESPACED   KIND         VERBS                                                        CATEGORIES
+configmaps    cm           v1           true         ConfigMap    [create delete deletecollection get list patch update watch]
+namespaces    ns           v1           false        Namespace    [create delete get list patch update watch]
+services      svc          v1           true         Service      [create delete get list patch update watch]                  all
+deployments   deploy       apps/v1      true         Deployment   [create delete deletecollection get list patch update watch]   all
+jobs                       batch/v1     true         Job          [create delete deletecollection get list patch update watch]   all
+`
+
+func newTestGenerator(t *testing.T, watchNamespaces ...string) *Generator {
+	resources, err := ParseAPIResources(strings.NewReader(testAPIResources))
+	NewWithT(t).Expect(err).NotTo(HaveOccurred())
+	return &Generator{
+		Mapper:          resources.RESTMapper(),
+		Resources:       resources,
+		Name:            "dynowatch",
+		ServiceAccount:  types.NamespacedName{Namespace: "dynowatch-system", Name: "dynowatch"},
+		WatchNamespaces: watchNamespaces,
+	}
+}
+
+func TestParseAPIResources(t *testing.T) {
+	o := NewWithT(t)
+	resources, err := ParseAPIResources(strings.NewReader(testAPIResources))
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(resources).To(HaveLen(3))
+	o.Expect(resources[0].APIResources[0].Verbs).To(ContainElements("get", "list", "watch"))
+	o.Expect(resources[2].APIResources[0].ShortNames).To(BeEmpty())
+
+	mapping, err := resources.RESTMapper().RESTMapping(schema.GroupKind{Kind: "Namespace"})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(mapping.Resource.Resource).To(Equal("namespaces"))
+	o.Expect(mapping.Scope.Name()).To(BeEquivalentTo("root"))
+
+	_, err = ParseAPIResources(strings.NewReader("NAME KIND\njobs Job\n"))
+	o.Expect(err).To(MatchError("line 1: column APIVERSION is missing"))
+}
+
+func TestGenerate(t *testing.T) {
+	o := NewWithT(t)
+	settings := &config.DynowatchConfig{
+		CloudEvents: config.CloudEventConfig{
+			SinkRef: &config.SinkReference{APIVersion: "eventing.knative.dev/v1", Kind: "Broker", Name: "default"},
+			Auth: &config.AuthConfig{
+				ServiceAccountToken: &config.ServiceAccountTokenConfig{Audience: "splunk"},
+			},
+		},
+		Checkpoint: &config.CheckpointConfig{Enabled: true, Namespace: "checkpoints"},
+		Watches: []config.Watch{
+			{Name: "jobs", Resource: "jobs.batch"},
+			{Name: "namespaces", Kind: "Namespace"},
+			{Name: "apps", Group: "apps", Kind: config.WildcardKind},
+			{Name: "pipelineruns", Group: "tekton.dev", Kind: "PipelineRun"},
+		},
+	}
+	secrets := []config.SecretKeySelector{{Name: "splunk", Key: "token"}}
+
+	objects, err := newTestGenerator(t).Generate(context.Background(), settings, secrets)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(objects).To(HaveLen(6))
+	clusterRole := objects[0].(*rbacv1.ClusterRole)
+	o.Expect(clusterRole.Rules).To(Equal([]rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get", "list", "watch"}},
+		{APIGroups: []string{"apiextensions.k8s.io"}, Resources: []string{"customresourcedefinitions"},
+			Verbs: []string{"get", "list", "watch"}},
+		{APIGroups: []string{"apps"}, Resources: []string{"*"}, Verbs: []string{"get", "list", "watch"}},
+		{APIGroups: []string{"batch"}, Resources: []string{"jobs"}, Verbs: []string{"get", "list", "watch"}},
+		{APIGroups: []string{"tekton.dev"}, Resources: []string{"pipelineruns"}, Verbs: []string{"get", "list", "watch"}},
+	}))
+	binding := objects[1].(*rbacv1.ClusterRoleBinding)
+	o.Expect(binding.RoleRef.Name).To(Equal("dynowatch"))
+	o.Expect(binding.Subjects[0].Namespace).To(Equal("dynowatch-system"))
+
+	checkpoints := objects[2].(*rbacv1.Role)
+	o.Expect(checkpoints.Namespace).To(Equal("checkpoints"))
+	o.Expect(checkpoints.Rules).To(Equal([]rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"create", "get", "update"}},
+	}))
+	role := objects[4].(*rbacv1.Role)
+	o.Expect(role.Namespace).To(Equal("dynowatch-system"))
+	o.Expect(role.Rules).To(Equal([]rbacv1.PolicyRule{
+		{APIGroups: []string{""}, Resources: []string{"secrets"}, ResourceNames: []string{"splunk"},
+			Verbs: []string{"get"}},
+		{APIGroups: []string{""}, Resources: []string{"serviceaccounts/token"}, ResourceNames: []string{"dynowatch"},
+			Verbs: []string{"create"}},
+		{APIGroups: []string{"eventing.knative.dev"}, Resources: []string{"brokers"}, ResourceNames: []string{"default"},
+			Verbs: []string{"get"}},
+	}))
+	o.Expect(objects[5].(*rbacv1.RoleBinding).RoleRef.Kind).To(Equal("Role"))
+}
+
+func TestGenerateWatchNamespaces(t *testing.T) {
+	o := NewWithT(t)
+	settings := &config.DynowatchConfig{
+		Watches: []config.Watch{
+			{Name: "jobs", Resource: "jobs.batch"},
+			{Name: "deployments", Resource: "deployments.apps"},
+		},
+	}
+	generator := newTestGenerator(t, "team-a", "team-b")
+
+	objects, err := generator.Generate(context.Background(), settings, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(objects).To(HaveLen(4))
+	for i, namespace := range []string{"team-a", "team-b"} {
+		role := objects[2*i].(*rbacv1.Role)
+		o.Expect(role.Namespace).To(Equal(namespace))
+		o.Expect(role.Rules).To(Equal([]rbacv1.PolicyRule{
+			{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"get", "list", "watch"}},
+			{APIGroups: []string{"batch"}, Resources: []string{"jobs"}, Verbs: []string{"get", "list", "watch"}},
+		}))
+	}
+
+	settings.Watches = append(settings.Watches, config.Watch{Name: "namespaces", Kind: "Namespace"})
+	_, err = generator.Generate(context.Background(), settings, nil)
+	o.Expect(err).To(MatchError(ContainSubstring(
+		`watch "namespaces": namespaces is cluster-scoped, so it cannot be watched when watch-namespaces is set`)))
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	o := NewWithT(t)
+	generator := newTestGenerator(t)
+
+	_, err := generator.Generate(context.Background(), &config.DynowatchConfig{
+		Watches: []config.Watch{{Name: "tekton", CRDSelector: "dynowatch.io/watch=true"}},
+	}, nil)
+	o.Expect(err).To(MatchError(`watch "tekton": a crd-selector can only be resolved with access to the cluster`))
+
+	_, err = generator.Generate(context.Background(), &config.DynowatchConfig{
+		Watches: []config.Watch{{Name: "deployments", Kind: "Deploymnet", Group: "apps"}},
+	}, nil)
+	o.Expect(err).To(MatchError(ContainSubstring(`watch "deployments"`)))
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// Tokens are only granted for the ServiceAccount of dynowatch, in its own namespace. Other
+// ServiceAccounts need the Role printed by `rbac generate`.
+//+kubebuilder:rbac:groups="",namespace=system,resources=serviceaccounts/token,resourceNames=dynowatch-controller-manager,verbs=create
+
+const defaultTokenExpirationSeconds = 3600
+
+// credentials add authentication to an outgoing request.
+type credentials interface {
+	authenticate(req *http.Request) error
+}
+
+// authTransport is an http.RoundTripper that authenticates every request before passing it to the
+// base transport.
+type authTransport struct {
+	base        http.RoundTripper
+	credentials credentials
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the original request.
+	req = req.Clone(req.Context())
+	if err := t.credentials.authenticate(req); err != nil {
+		return nil, fmt.Errorf("authenticating request: %w", err)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// NewTransport returns an http.RoundTripper that authenticates requests as configured by auth. The
+// Kubernetes client is only used to request service account tokens. If auth is nil, the default
+// transport is returned.
+func NewTransport(auth *config.AuthConfig, kubeClient client.Client) (http.RoundTripper, error) {
+	if auth == nil {
+		return http.DefaultTransport, nil
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if auth.TLS != nil {
+		tlsConfig, err := newReloadingTLSConfig(auth.TLS)
+		if err != nil {
+			return nil, err
+		}
+		base.TLSClientConfig = tlsConfig
+	}
+
+	creds, err := newCredentials(auth, kubeClient, base)
+	if err != nil {
+		return nil, err
+	}
+	if creds == nil {
+		return base, nil
+	}
+	return &authTransport{base: base, credentials: creds}, nil
+}
+
+func newCredentials(auth *config.AuthConfig, kubeClient client.Client, base http.RoundTripper) (credentials, error) {
+	var creds []credentials
+	if auth.BearerTokenFile != "" {
+		creds = append(creds, &bearerTokenFile{token: newFileSource(auth.BearerTokenFile)})
+	}
+	if auth.Basic != nil {
+		if auth.Basic.Username == "" || auth.Basic.PasswordFile == "" {
+			return nil, errors.New("basic auth requires a username and password-file")
+		}
+		creds = append(creds, &basicAuth{
+			username: auth.Basic.Username,
+			password: newFileSource(auth.Basic.PasswordFile),
+		})
+	}
+	if auth.OAuth2 != nil {
+		if auth.OAuth2.TokenURL == "" || auth.OAuth2.ClientID == "" || auth.OAuth2.ClientSecretFile == "" {
+			return nil, errors.New("oauth2 requires a token-url, client-id, and client-secret-file")
+		}
+		creds = append(creds, &oauth2ClientCredentials{
+			config:       *auth.OAuth2,
+			clientSecret: newFileSource(auth.OAuth2.ClientSecretFile),
+			httpClient:   &http.Client{Transport: base},
+		})
+	}
+	if auth.ServiceAccountToken != nil {
+		saCreds, err := newServiceAccountToken(*auth.ServiceAccountToken, kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, saCreds)
+	}
+	switch len(creds) {
+	case 0:
+		return nil, nil
+	case 1:
+		return creds[0], nil
+	default:
+		return nil, errors.New("only one of bearer-token-file, basic, oauth2, or service-account-token can be set")
+	}
+}
+
+// bearerTokenFile sends the contents of a file as a bearer token.
+type bearerTokenFile struct {
+	token *fileSource
+}
+
+func (b *bearerTokenFile) authenticate(req *http.Request) error {
+	token, err := b.token.Read()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	return nil
+}
+
+type basicAuth struct {
+	username string
+	password *fileSource
+}
+
+func (b *basicAuth) authenticate(req *http.Request) error {
+	password, err := b.password.Read()
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.username, string(bytes.TrimSpace(password)))
+	return nil
+}
+
+// oauth2ClientCredentials obtains tokens with the OAuth2 client credentials flow. Tokens are cached
+// by the underlying token source until they expire, and a new token source is created whenever the
+// client secret is rotated.
+type oauth2ClientCredentials struct {
+	config       config.OAuth2Config
+	clientSecret *fileSource
+	httpClient   *http.Client
+
+	mu     sync.Mutex
+	secret string
+	source oauth2.TokenSource
+}
+
+func (o *oauth2ClientCredentials) authenticate(req *http.Request) error {
+	source, err := o.tokenSource()
+	if err != nil {
+		return err
+	}
+	token, err := source.Token()
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+func (o *oauth2ClientCredentials) tokenSource() (oauth2.TokenSource, error) {
+	data, err := o.clientSecret.Read()
+	if err != nil {
+		return nil, err
+	}
+	secret := string(bytes.TrimSpace(data))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.source != nil && secret == o.secret {
+		return o.source, nil
+	}
+	params := url.Values{}
+	for k, v := range o.config.EndpointParams {
+		params.Set(k, v)
+	}
+	cc := &clientcredentials.Config{
+		ClientID:       o.config.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       o.config.TokenURL,
+		Scopes:         o.config.Scopes,
+		EndpointParams: params,
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, o.httpClient)
+	o.source = cc.TokenSource(ctx)
+	o.secret = secret
+	return o.source, nil
+}
+
+// serviceAccountToken requests a ServiceAccount token for the configured audience through the
+// TokenRequest API. The token is renewed once 80% of its lifetime has elapsed.
+type serviceAccountToken struct {
+	client            client.Client
+	serviceAccount    string
+	namespace         string
+	audience          string
+	expirationSeconds int64
+
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+func newServiceAccountToken(cfg config.ServiceAccountTokenConfig, kubeClient client.Client) (*serviceAccountToken, error) {
+	if cfg.Audience == "" {
+		return nil, errors.New("service-account-token requires an audience")
+	}
+	if kubeClient == nil {
+		return nil, errors.New("service-account-token requires a Kubernetes client")
+	}
+	sa := &serviceAccountToken{
+		client:            kubeClient,
+		serviceAccount:    cfg.ServiceAccount,
+		namespace:         cfg.Namespace,
+		audience:          cfg.Audience,
+		expirationSeconds: cfg.ExpirationSeconds,
+	}
+	var err error
+	if sa.serviceAccount == "" {
+		if sa.serviceAccount, err = config.CurrentServiceAccount(); err != nil {
+			return nil, fmt.Errorf("service-account-token has no service-account: %w", err)
+		}
+	}
+	if sa.namespace == "" {
+		if sa.namespace, err = config.CurrentNamespace(); err != nil {
+			return nil, fmt.Errorf("service-account-token has no namespace: %w", err)
+		}
+	}
+	if sa.expirationSeconds == 0 {
+		sa.expirationSeconds = defaultTokenExpirationSeconds
+	}
+	return sa, nil
+}
+
+func (s *serviceAccountToken) authenticate(req *http.Request) error {
+	token, err := s.getToken(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (s *serviceAccountToken) getToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.token != "" && now.Before(s.renewAt) {
+		return s.token, nil
+	}
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.serviceAccount},
+	}
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         []string{s.audience},
+			ExpirationSeconds: &s.expirationSeconds,
+		},
+	}
+	if err := s.client.SubResource("token").Create(ctx, sa, tokenRequest); err != nil {
+		return "", fmt.Errorf("requesting service account token: %w", err)
+	}
+	s.token = tokenRequest.Status.Token
+	lifetime := tokenRequest.Status.ExpirationTimestamp.Sub(now)
+	s.renewAt = now.Add(lifetime * 4 / 5)
+	return s.token, nil
+}
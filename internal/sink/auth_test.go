@@ -0,0 +1,156 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// authHeaderServer returns a server that records the Authorization header of the last request.
+func authHeaderServer(t *testing.T) (*httptest.Server, *atomic.Value) {
+	header := &atomic.Value{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header.Store(r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	return server, header
+}
+
+func writeFile(t *testing.T, path string, data string, modTime time.Time) {
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func doRequest(o *WithT, transport http.RoundTripper, url string) {
+	client := &http.Client{Transport: transport}
+	resp, err := client.Post(url, "application/json", nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(resp.Body.Close()).To(Succeed())
+}
+
+func TestNewTransportNoAuth(t *testing.T) {
+	o := NewWithT(t)
+	transport, err := NewTransport(nil, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(transport).To(BeIdenticalTo(http.DefaultTransport))
+}
+
+func TestBearerTokenFileRotation(t *testing.T) {
+	o := NewWithT(t)
+	server, header := authHeaderServer(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	now := time.Now()
+	writeFile(t, tokenFile, "first-token\n", now.Add(-time.Minute))
+
+	transport, err := NewTransport(&config.AuthConfig{BearerTokenFile: tokenFile}, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	doRequest(o, transport, server.URL)
+	o.Expect(header.Load()).To(Equal("Bearer first-token"))
+
+	writeFile(t, tokenFile, "second-token\n", now)
+	doRequest(o, transport, server.URL)
+	o.Expect(header.Load()).To(Equal("Bearer second-token"))
+}
+
+func TestBasicAuth(t *testing.T) {
+	o := NewWithT(t)
+	server, header := authHeaderServer(t)
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	writeFile(t, passwordFile, "s3cret", time.Now())
+
+	transport, err := NewTransport(&config.AuthConfig{
+		Basic: &config.BasicAuthConfig{Username: "archive", PasswordFile: passwordFile},
+	}, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	doRequest(o, transport, server.URL)
+	o.Expect(header.Load()).To(Equal("Basic YXJjaGl2ZTpzM2NyZXQ="))
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	o := NewWithT(t)
+	server, header := authHeaderServer(t)
+	tokenRequests := &atomic.Int32{}
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := tokenRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, n)
+	}))
+	defer tokenServer.Close()
+	secretFile := filepath.Join(t.TempDir(), "client-secret")
+	writeFile(t, secretFile, "client-secret", time.Now())
+
+	transport, err := NewTransport(&config.AuthConfig{
+		OAuth2: &config.OAuth2Config{
+			TokenURL:         tokenServer.URL,
+			ClientID:         "dynowatch",
+			ClientSecretFile: secretFile,
+		},
+	}, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	doRequest(o, transport, server.URL)
+	doRequest(o, transport, server.URL)
+	o.Expect(header.Load()).To(Equal("Bearer token-1"))
+	o.Expect(tokenRequests.Load()).To(BeEquivalentTo(1), "token is cached")
+}
+
+func TestMultipleCredentials(t *testing.T) {
+	o := NewWithT(t)
+	_, err := NewTransport(&config.AuthConfig{
+		BearerTokenFile: "/var/run/secrets/token",
+		Basic:           &config.BasicAuthConfig{Username: "archive", PasswordFile: "/var/run/secrets/password"},
+	}, nil)
+	o.Expect(err).To(MatchError(ContainSubstring("only one of")))
+}
+
+func TestTLSCABundle(t *testing.T) {
+	o := NewWithT(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	writeFile(t, caFile, string(caPEM), time.Now())
+
+	transport, err := NewTransport(&config.AuthConfig{
+		TLS: &config.TLSConfig{CAFile: caFile, ServerName: "example.com"},
+	}, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	doRequest(o, transport, server.URL)
+
+	_, err = NewTransport(&config.AuthConfig{
+		TLS: &config.TLSConfig{CertFile: caFile},
+	}, nil)
+	o.Expect(err).To(HaveOccurred(), "key-file is required")
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cecontext "github.com/cloudevents/sdk-go/v2/context"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/google/uuid"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+const (
+	defaultBatchMaxEvents = 100
+	defaultBatchMaxBytes  = 1 << 20
+	defaultBatchMaxDelay  = 100 * time.Millisecond
+)
+
+// errNoTarget is returned when an event is sent without a target on the context.
+var errNoTarget = errors.New("no target set on the context")
+
+// BatchSender is a Sender that accumulates events and sends them to the target in a single HTTP
+// request, using the CloudEvents batch content mode (application/cloudevents-batch+json). A batch
+// is sent once it holds MaxEvents events or MaxBytes bytes, or MaxDelay after its first event was
+// added. Send blocks until the batch holding the event has been sent, and returns the result of the
+// request, so that a failed batch fails every event in it. The request of a batch is cancelled once
+// the context of every event in it is done, such as when a drain runs out of time.
+type BatchSender struct {
+	Client    *http.Client
+	Overrides *config.CloudEventOverrides
+	MaxEvents int
+	MaxBytes  int
+	MaxDelay  time.Duration
+	// Timeout bounds each request. If zero, requests are not bounded.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	batches map[string]*batch
+	// flushing is set once Flush was called, so that batches are sent without waiting for more
+	// events.
+	flushing bool
+}
+
+// batch is a set of encoded events waiting to be sent to the same target.
+type batch struct {
+	target      string
+	events      [][]byte
+	size        int
+	timer       *time.Timer
+	retryAfters []*RetryAfter
+	// waiting is the number of events whose Send still waits for the batch. The request is
+	// cancelled with cancel once none does.
+	waiting int
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	result  protocol.Result
+}
+
+// NewHTTPBatchSender returns a BatchSender that sends events over HTTP, authenticated as configured
+// by auth. The overrides are applied to every event sent.
+func NewHTTPBatchSender(cfg *config.BatchConfig, auth *config.AuthConfig,
+	overrides *config.CloudEventOverrides, kubeClient client.Client) (*BatchSender, error) {
+	transport, err := NewTransport(auth, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	return &BatchSender{
+		Client:    &http.Client{Transport: &retryAfterTransport{base: transport}},
+		Overrides: overrides,
+		MaxEvents: cfg.MaxEvents,
+		MaxBytes:  cfg.MaxBytes,
+		MaxDelay:  cfg.MaxDelay,
+	}, nil
+}
+
+func (s *BatchSender) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	target := cecontext.TargetFrom(ctx)
+	if target == nil {
+		return errNoTarget
+	}
+	event = applyOverrides(s.Overrides, event.Clone())
+	if event.ID() == "" {
+		event.SetID(uuid.New().String())
+	}
+	if event.Time().IsZero() {
+		event.SetTime(time.Now())
+	}
+	if err := event.Validate(); err != nil {
+		return err
+	}
+	data, err := event.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	b := s.add(target.String(), data, retryAfterFrom(ctx))
+	select {
+	case <-b.done:
+		return b.result
+	case <-ctx.Done():
+		s.leave(b)
+		return ctx.Err()
+	}
+}
+
+// Flush sends the pending batches right away. Batches are no longer held for more events after it
+// is called, so that the events sent while shutting down are not delayed.
+func (s *BatchSender) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushing = true
+	for _, b := range s.batches {
+		s.flushLocked(b)
+	}
+}
+
+// leave records that an event of b no longer waits for it. The request of the batch is cancelled,
+// or the batch is not sent, once no event waits for it.
+func (s *BatchSender) leave(b *batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.waiting--
+	if b.waiting > 0 {
+		return
+	}
+	b.cancel()
+	if s.batches[b.target] == b {
+		delete(s.batches, b.target)
+		b.timer.Stop()
+		b.result = b.ctx.Err()
+		close(b.done)
+	}
+}
+
+// add appends an encoded event to the pending batch for target, and returns the batch. Full
+// batches are sent right away.
+func (s *BatchSender) add(target string, data []byte, retryAfter *RetryAfter) *batch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batches == nil {
+		s.batches = map[string]*batch{}
+	}
+	b := s.batches[target]
+	if b != nil && b.size+len(data)+1 > s.maxBytes() {
+		s.flushLocked(b)
+		b = nil
+	}
+	if b == nil {
+		b = &batch{target: target, size: 1, done: make(chan struct{})}
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+		b.timer = time.AfterFunc(s.maxDelay(), func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.flushLocked(b)
+		})
+		s.batches[target] = b
+	}
+	b.events = append(b.events, data)
+	b.size += len(data) + 1
+	b.waiting++
+	if retryAfter != nil {
+		b.retryAfters = append(b.retryAfters, retryAfter)
+	}
+	if s.flushing || len(b.events) >= s.maxEvents() || b.size >= s.maxBytes() {
+		s.flushLocked(b)
+	}
+	return b
+}
+
+// flushLocked sends b, unless it was already sent. s.mu must be held.
+func (s *BatchSender) flushLocked(b *batch) {
+	if s.batches[b.target] != b {
+		return
+	}
+	delete(s.batches, b.target)
+	b.timer.Stop()
+	go s.send(b)
+}
+
+// send posts the batch and records the result for the events in it.
+func (s *BatchSender) send(b *batch) {
+	defer close(b.done)
+	defer b.cancel()
+	batchEvents.Observe(float64(len(b.events)))
+
+	ctx := b.ctx
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	ctx, retryAfter := WithRetryAfter(ctx)
+	body := bytes.Join(b.events, []byte(","))
+	body = append(append([]byte("["), body...), ']')
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.target, bytes.NewReader(body))
+	if err != nil {
+		b.result = err
+		return
+	}
+	req.Header.Set("Content-Type", cloudevents.ApplicationCloudEventsBatchJSON)
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		b.result = err
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	for _, eventRetryAfter := range b.retryAfters {
+		eventRetryAfter.setDelay(retryAfter.Delay())
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		b.result = cehttp.NewResult(resp.StatusCode, "%w", protocol.ResultACK)
+		return
+	}
+	b.result = cehttp.NewResult(resp.StatusCode, "%w", fmt.Errorf("batch of %d events rejected: %w",
+		len(b.events), protocol.ResultNACK))
+}
+
+func (s *BatchSender) maxEvents() int {
+	if s.MaxEvents == 0 {
+		return defaultBatchMaxEvents
+	}
+	return s.MaxEvents
+}
+
+func (s *BatchSender) maxBytes() int {
+	if s.MaxBytes == 0 {
+		return defaultBatchMaxBytes
+	}
+	return s.MaxBytes
+}
+
+func (s *BatchSender) maxDelay() time.Duration {
+	if s.MaxDelay == 0 {
+		return defaultBatchMaxDelay
+	}
+	return s.MaxDelay
+}
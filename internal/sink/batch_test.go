@@ -0,0 +1,179 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+
+	"github.com/kubearchive/dynowatch/internal/cloudevents/test"
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+func newBatchTestReceiver(t *testing.T) *test.TestReceiver {
+	ctx, cancel := context.WithCancel(context.Background())
+	receiver, err := test.NewTestReceiver(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver.Start()
+	receiver.StartRecorder()
+	t.Cleanup(func() {
+		receiver.Close()
+		cancel()
+	})
+	return receiver
+}
+
+// sendAll sends n events concurrently, and returns the result of each send.
+func sendAll(ctx context.Context, sender Sender, n int) []protocol.Result {
+	results := make([]protocol.Result, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			event := cloudevents.NewEvent()
+			event.SetSource("test-source")
+			event.SetType("dynowatch.kubearchive.dev")
+			event.SetSubject(fmt.Sprintf("event-%d", i))
+			results[i] = sender.Send(ctx, event)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func TestBatchSender(t *testing.T) {
+	o := NewWithT(t)
+	receiver := newBatchTestReceiver(t)
+	overrides := &config.CloudEventOverrides{Extensions: map[string]string{"cluster": "prod-east"}}
+	sender, err := NewHTTPBatchSender(&config.BatchConfig{MaxEvents: 3, MaxDelay: time.Minute}, nil, overrides, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	ctx := cloudevents.ContextWithTarget(context.Background(), receiver.URL)
+
+	for _, result := range sendAll(ctx, sender, 3) {
+		o.Expect(cloudevents.IsACK(result)).To(BeTrue())
+	}
+	events := receiver.GetEvents()
+	o.Expect(events).To(HaveLen(3))
+	o.Expect(events[0].ID()).NotTo(BeEmpty())
+	o.Expect(events[0].Extensions()).To(HaveKeyWithValue("cluster", "prod-east"))
+
+	receiver.ClearEvents()
+	receiver.FailNext(1)
+	for _, result := range sendAll(ctx, sender, 3) {
+		o.Expect(cloudevents.IsACK(result)).To(BeFalse(), "a failed batch fails every event in it")
+		o.Expect(protocol.ResultIs(result, protocol.ResultNACK)).To(BeTrue())
+	}
+	o.Expect(receiver.GetEvents()).To(BeEmpty())
+}
+
+func TestBatchSenderLimits(t *testing.T) {
+	o := NewWithT(t)
+	receiver := newBatchTestReceiver(t)
+	ctx := cloudevents.ContextWithTarget(context.Background(), receiver.URL)
+
+	sender := &BatchSender{Client: http.DefaultClient, MaxDelay: 20 * time.Millisecond}
+	start := time.Now()
+	o.Expect(cloudevents.IsACK(sendAll(ctx, sender, 1)[0])).To(BeTrue())
+	o.Expect(time.Since(start)).To(BeNumerically(">=", 20*time.Millisecond), "partial batch waits for max-delay")
+	o.Expect(receiver.GetEvents()).To(HaveLen(1))
+
+	receiver.ClearEvents()
+	sender = &BatchSender{Client: http.DefaultClient, MaxBytes: 1, MaxDelay: time.Minute}
+	for _, result := range sendAll(ctx, sender, 2) {
+		o.Expect(cloudevents.IsACK(result)).To(BeTrue(), "oversized events are sent on their own")
+	}
+	o.Expect(receiver.GetEvents()).To(HaveLen(2))
+}
+
+func TestBatchSenderFlush(t *testing.T) {
+	o := NewWithT(t)
+	receiver := newBatchTestReceiver(t)
+	ctx := cloudevents.ContextWithTarget(context.Background(), receiver.URL)
+	sender := &BatchSender{Client: http.DefaultClient, MaxDelay: time.Minute}
+
+	results := make(chan []protocol.Result)
+	go func() {
+		results <- sendAll(ctx, sender, 2)
+	}()
+	o.Eventually(func() int {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		if b := sender.batches[receiver.URL]; b != nil {
+			return len(b.events)
+		}
+		return 0
+	}).Should(Equal(2))
+	sender.Flush()
+	o.Eventually(results).Should(Receive(HaveEach(Satisfy(cloudevents.IsACK))), "open batches are sent")
+
+	start := time.Now()
+	o.Expect(cloudevents.IsACK(sendAll(ctx, sender, 1)[0])).To(BeTrue())
+	o.Expect(time.Since(start)).To(BeNumerically("<", time.Minute), "later events are not held")
+	o.Expect(receiver.GetEvents()).To(HaveLen(3))
+}
+
+func TestBatchSenderCancel(t *testing.T) {
+	o := NewWithT(t)
+	received := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		received <- struct{}{}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	defer server.Close()
+	sender := &BatchSender{Client: http.DefaultClient, MaxEvents: 1}
+
+	ctx, cancel := context.WithCancel(cloudevents.ContextWithTarget(context.Background(), server.URL))
+	result := make(chan []protocol.Result)
+	go func() {
+		result <- sendAll(ctx, sender, 1)
+	}()
+	o.Eventually(received).Should(Receive())
+	cancel()
+	o.Eventually(result).Should(Receive(ConsistOf(MatchError(context.Canceled))))
+	o.Eventually(cancelled).Should(Receive(), "the request is cancelled once no event waits for it")
+
+	sender = &BatchSender{Client: http.DefaultClient, MaxDelay: time.Minute}
+	ctx, cancel = context.WithCancel(cloudevents.ContextWithTarget(context.Background(), server.URL))
+	go func() {
+		result <- sendAll(ctx, sender, 1)
+	}()
+	o.Eventually(func() int {
+		sender.mu.Lock()
+		defer sender.mu.Unlock()
+		return len(sender.batches)
+	}).Should(Equal(1))
+	cancel()
+	o.Eventually(result).Should(Receive(ConsistOf(MatchError(context.Canceled))))
+	o.Expect(sender.batches).To(BeEmpty(), "open batches without events waiting are not sent")
+}
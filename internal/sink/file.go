@@ -0,0 +1,61 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileSource reads a file and caches its contents until the file is modified. Mounted Secrets are
+// updated by the kubelet in place, so credentials rotated this way are picked up without a restart.
+type fileSource struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+func newFileSource(path string) *fileSource {
+	if path == "" {
+		return nil
+	}
+	return &fileSource{path: path}
+}
+
+// Read returns the current contents of the file.
+func (f *fileSource) Read() ([]byte, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.data != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.data, nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.data = data
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	return data, nil
+}
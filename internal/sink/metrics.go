@@ -0,0 +1,32 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var batchEvents = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "dynowatch_batch_events",
+	Help:    "Number of events sent in each batch",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+})
+
+func init() {
+	metrics.Registry.MustRegister(batchEvents)
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cloudeventsclient "github.com/cloudevents/sdk-go/v2/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// WithOverrides returns a client option that sets the override extensions on every event sent by
+// the client. Extensions set by an override replace any value already present on the event.
+func WithOverrides(overrides *config.CloudEventOverrides) cloudeventsclient.Option {
+	return cloudeventsclient.WithEventDefaulter(func(ctx context.Context, event cloudevents.Event) cloudevents.Event {
+		return applyOverrides(overrides, event)
+	})
+}
+
+func applyOverrides(overrides *config.CloudEventOverrides, event cloudevents.Event) cloudevents.Event {
+	if overrides == nil {
+		return event
+	}
+	for name, value := range overrides.Extensions {
+		event.SetExtension(name, value)
+	}
+	return event
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+//+kubebuilder:rbac:groups=eventing.knative.dev,resources=brokers,verbs=get
+//+kubebuilder:rbac:groups=messaging.knative.dev,resources=channels,verbs=get
+//+kubebuilder:rbac:groups=serving.knative.dev,resources=services,verbs=get
+//+kubebuilder:rbac:groups="",resources=services,verbs=get
+
+// ResolveAddress returns the URL of the Addressable object referenced by ref, as reported in its
+// `status.address.url` field. Kubernetes Services are not Addressable, so their URL is derived from
+// the Service name and port instead. References without a namespace are resolved in the namespace
+// dynowatch runs in.
+func ResolveAddress(ctx context.Context, reader client.Reader, ref config.SinkReference) (string, error) {
+	if reader == nil {
+		return "", fmt.Errorf("a Kubernetes client is required to resolve sink references")
+	}
+	if ref.Kind == "" || ref.Name == "" {
+		return "", fmt.Errorf("sink reference must have a kind and name")
+	}
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return "", fmt.Errorf("sink reference has invalid api-version %q: %w", ref.APIVersion, err)
+	}
+	key := types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}
+	if key.Namespace == "" {
+		if key.Namespace, err = config.CurrentNamespace(); err != nil {
+			return "", fmt.Errorf("sink reference has no namespace: %w", err)
+		}
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gv.WithKind(ref.Kind))
+	if err := reader.Get(ctx, key, obj); err != nil {
+		return "", err
+	}
+
+	if gv.Group == "" && ref.Kind == "Service" {
+		return serviceURL(obj)
+	}
+	url, found, err := unstructured.NestedString(obj.Object, "status", "address", "url")
+	if err != nil {
+		return "", err
+	}
+	if !found || url == "" {
+		return "", fmt.Errorf("%s %s is not addressable: status.address.url is not set", ref.Kind, key)
+	}
+	return url, nil
+}
+
+// serviceURL returns the URL of a Service from its first port. The host is the short
+// `name.namespace.svc` form, which resolves in any cluster regardless of its cluster domain. The
+// scheme is https if the port is named https, has the https app protocol, or is 443.
+func serviceURL(svc *unstructured.Unstructured) (string, error) {
+	ports, _, err := unstructured.NestedSlice(svc.Object, "spec", "ports")
+	if err != nil {
+		return "", err
+	}
+	host := fmt.Sprintf("%s.%s.svc", svc.GetName(), svc.GetNamespace())
+	if len(ports) == 0 {
+		return "http://" + host, nil
+	}
+	port, ok := ports[0].(map[string]any)
+	if !ok {
+		return "", fmt.Errorf("service %s/%s has an invalid port", svc.GetNamespace(), svc.GetName())
+	}
+	number, _, _ := unstructured.NestedInt64(port, "port")
+	name, _, _ := unstructured.NestedString(port, "name")
+	appProtocol, _, _ := unstructured.NestedString(port, "appProtocol")
+	scheme, defaultPort := "http", int64(80)
+	if name == "https" || appProtocol == "https" || number == 443 {
+		scheme, defaultPort = "https", 443
+	}
+	if number == 0 || number == defaultPort {
+		return fmt.Sprintf("%s://%s", scheme, host), nil
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, number), nil
+}
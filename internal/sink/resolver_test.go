@@ -0,0 +1,155 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+func newBroker(namespace string, name string, url string) *unstructured.Unstructured {
+	broker := &unstructured.Unstructured{}
+	broker.SetAPIVersion("eventing.knative.dev/v1")
+	broker.SetKind("Broker")
+	broker.SetNamespace(namespace)
+	broker.SetName(name)
+	if url != "" {
+		_ = unstructured.SetNestedField(broker.Object, url, "status", "address", "url")
+	}
+	return broker
+}
+
+func TestResolveAddress(t *testing.T) {
+	o := NewWithT(t)
+	ctx := context.Background()
+	reader := fake.NewClientBuilder().
+		WithScheme(scheme.Scheme).
+		WithObjects(
+			newBroker("archive", "default", "http://broker-ingress.knative-eventing.svc.cluster.local/archive/default"),
+			newBroker("archive", "not-ready", ""),
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "archive", Name: "receiver"},
+				Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+			},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "archive", Name: "receiver-8080"},
+				Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Port: 8080}}},
+			},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "archive", Name: "receiver-tls"},
+				Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "https", Port: 8443}}},
+			},
+		).Build()
+
+	url, err := ResolveAddress(ctx, reader, config.SinkReference{
+		APIVersion: "eventing.knative.dev/v1",
+		Kind:       "Broker",
+		Name:       "default",
+		Namespace:  "archive",
+	})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(url).To(Equal("http://broker-ingress.knative-eventing.svc.cluster.local/archive/default"))
+
+	url, err = ResolveAddress(ctx, reader, config.SinkReference{
+		APIVersion: "v1",
+		Kind:       "Service",
+		Name:       "receiver",
+		Namespace:  "archive",
+	})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(url).To(Equal("http://receiver.archive.svc"))
+
+	url, err = ResolveAddress(ctx, reader, config.SinkReference{
+		APIVersion: "v1",
+		Kind:       "Service",
+		Name:       "receiver-8080",
+		Namespace:  "archive",
+	})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(url).To(Equal("http://receiver-8080.archive.svc:8080"))
+
+	url, err = ResolveAddress(ctx, reader, config.SinkReference{
+		APIVersion: "v1",
+		Kind:       "Service",
+		Name:       "receiver-tls",
+		Namespace:  "archive",
+	})
+	o.Expect(err).NotTo(HaveOccurred())
+	o.Expect(url).To(Equal("https://receiver-tls.archive.svc:8443"))
+
+	_, err = ResolveAddress(ctx, reader, config.SinkReference{
+		APIVersion: "eventing.knative.dev/v1",
+		Kind:       "Broker",
+		Name:       "not-ready",
+		Namespace:  "archive",
+	})
+	o.Expect(err).To(MatchError(ContainSubstring("not addressable")))
+
+	_, err = ResolveAddress(ctx, reader, config.SinkReference{
+		APIVersion: "eventing.knative.dev/v1",
+		Kind:       "Broker",
+		Name:       "missing",
+		Namespace:  "archive",
+	})
+	o.Expect(err).To(HaveOccurred())
+}
+
+func TestWithOverrides(t *testing.T) {
+	o := NewWithT(t)
+	overrides := &config.CloudEventOverrides{
+		Extensions: map[string]string{
+			"cluster": "prod-east",
+		},
+	}
+	sender := &recordingSender{}
+	client, err := cloudevents.NewClient(sender, WithOverrides(overrides))
+	o.Expect(err).NotTo(HaveOccurred())
+
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("test-source")
+	event.SetType("test-type")
+	o.Expect(cloudevents.IsACK(client.Send(context.Background(), event))).To(BeTrue())
+	o.Expect(sender.events).To(HaveLen(1))
+	o.Expect(sender.events[0].Extensions()).To(HaveKeyWithValue("cluster", "prod-east"))
+}
+
+// recordingSender is a protocol.Sender that records the events it is asked to send.
+type recordingSender struct {
+	events []cloudevents.Event
+}
+
+func (s *recordingSender) Send(ctx context.Context, m binding.Message, transformers ...binding.Transformer) error {
+	event, err := binding.ToEvent(ctx, m, transformers...)
+	if err != nil {
+		return err
+	}
+	s.events = append(s.events, *event)
+	return m.Finish(nil)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type retryAfterKey struct{}
+
+// RetryAfter records the delay a target requested with a Retry-After response header. The
+// CloudEvents HTTP protocol does not expose response headers, so they are captured by the
+// transport of clients created with NewHTTPClient.
+type RetryAfter struct {
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+// WithRetryAfter returns a context that captures the Retry-After header of the response to a
+// request sent with it.
+func WithRetryAfter(ctx context.Context) (context.Context, *RetryAfter) {
+	retryAfter := &RetryAfter{}
+	return context.WithValue(ctx, retryAfterKey{}, retryAfter), retryAfter
+}
+
+// Delay returns the requested delay, or zero if the target did not request one.
+func (r *RetryAfter) Delay() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.delay
+}
+
+func (r *RetryAfter) set(header string, now time.Time) {
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = date.Sub(now)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	r.setDelay(delay)
+}
+
+func (r *RetryAfter) setDelay(delay time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = delay
+}
+
+// retryAfterFrom returns the RetryAfter set on ctx with WithRetryAfter, or nil.
+func retryAfterFrom(ctx context.Context) *RetryAfter {
+	retryAfter, _ := ctx.Value(retryAfterKey{}).(*RetryAfter)
+	return retryAfter
+}
+
+// retryAfterTransport records the Retry-After header of responses in the request context.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if retryAfter := retryAfterFrom(req.Context()); retryAfter != nil {
+		if header := resp.Header.Get("Retry-After"); header != "" {
+			retryAfter.set(header, time.Now())
+		}
+	}
+	return resp, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+func TestRetryAfter(t *testing.T) {
+	o := NewWithT(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	eventsClient, err := NewHTTPClient(nil, nil, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("test-source")
+	event.SetType("dynowatch.kubearchive.dev")
+
+	ctx, retryAfter := WithRetryAfter(cloudevents.ContextWithTarget(context.Background(), server.URL))
+	o.Expect(cloudevents.IsACK(eventsClient.Send(ctx, event))).To(BeFalse())
+	o.Expect(retryAfter.Delay()).To(Equal(7 * time.Second))
+
+	retryAfter = &RetryAfter{}
+	now := time.Now()
+	retryAfter.set(now.Add(time.Minute).UTC().Format(http.TimeFormat), now)
+	o.Expect(retryAfter.Delay()).To(BeNumerically("~", time.Minute, time.Second))
+}
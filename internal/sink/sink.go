@@ -0,0 +1,99 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"sync"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/protocol"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// Sender delivers a CloudEvent. The target of the event is set on the context with
+// cloudevents.ContextWithTarget. Sender is implemented by cloudevents.Client, and by the delivery
+// mechanisms layered in front of it.
+type Sender interface {
+	Send(ctx context.Context, event cloudevents.Event) protocol.Result
+}
+
+// Target is a Sender that delivers events to a fixed address, replacing any target set on the
+// context.
+type Target struct {
+	Sender  Sender
+	Address string
+}
+
+func (t *Target) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	return t.Sender.Send(cloudevents.ContextWithTarget(ctx, t.Address), event)
+}
+
+// Reloadable is a Sender whose underlying Sender can be replaced while events are being sent, so
+// that settings read from a reference, such as the target address or credentials, are applied
+// without a restart. Events being sent when the Sender is replaced finish with the previous one.
+type Reloadable struct {
+	mu     sync.RWMutex
+	sender Sender
+}
+
+func NewReloadable(sender Sender) *Reloadable {
+	return &Reloadable{sender: sender}
+}
+
+func (r *Reloadable) Send(ctx context.Context, event cloudevents.Event) protocol.Result {
+	r.mu.RLock()
+	sender := r.sender
+	r.mu.RUnlock()
+	return sender.Send(ctx, event)
+}
+
+// Reload replaces the Sender that events are sent with.
+func (r *Reloadable) Reload(sender Sender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sender = sender
+}
+
+// NewHTTPClient returns a CloudEvents client that sends events over HTTP, authenticated as
+// configured by auth. The overrides are applied to every event sent by the client.
+func NewHTTPClient(auth *config.AuthConfig, overrides *config.CloudEventOverrides,
+	kubeClient client.Client) (cloudevents.Client, error) {
+	transport, err := NewTransport(auth, kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	httpProtocol, err := cloudevents.NewHTTP(cehttp.WithRoundTripper(&retryAfterTransport{base: transport}))
+	if err != nil {
+		return nil, err
+	}
+	return cloudevents.NewClient(httpProtocol, cloudevents.WithTimeNow(), cloudevents.WithUUIDs(),
+		WithOverrides(overrides))
+}
+
+// ResolveTarget returns the address events should be sent to. If ref is set, the address of the
+// referenced Addressable object is returned. Otherwise address is returned as is.
+func ResolveTarget(ctx context.Context, reader client.Reader, address string,
+	ref *config.SinkReference) (string, error) {
+	if ref == nil {
+		return address, nil
+	}
+	return ResolveAddress(ctx, reader, *ref)
+}
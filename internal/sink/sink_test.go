@@ -0,0 +1,50 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+func TestReloadable(t *testing.T) {
+	o := NewWithT(t)
+	first := newBatchTestReceiver(t)
+	second := newBatchTestReceiver(t)
+	client, err := NewHTTPClient(nil, nil, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	sender := NewReloadable(&Target{Sender: client, Address: first.URL})
+
+	o.Expect(cloudevents.IsACK(sendAll(context.Background(), sender, 1)[0])).To(BeTrue())
+	o.Expect(first.GetEvents()).To(HaveLen(1))
+
+	overrides := &config.CloudEventOverrides{Extensions: map[string]string{"cluster": "prod-west"}}
+	client, err = NewHTTPClient(nil, overrides, nil)
+	o.Expect(err).NotTo(HaveOccurred())
+	sender.Reload(&Target{Sender: client, Address: second.URL})
+	o.Expect(cloudevents.IsACK(sendAll(context.Background(), sender, 1)[0])).To(BeTrue())
+	o.Expect(first.GetEvents()).To(HaveLen(1))
+	events := second.GetEvents()
+	o.Expect(events).To(HaveLen(1), "events are sent with the new sender once it is reloaded")
+	o.Expect(events[0].Extensions()).To(HaveKeyWithValue("cluster", "prod-west"))
+}
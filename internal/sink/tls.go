@@ -0,0 +1,144 @@
+/*
+Copyright 2023 The KubeArchive Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kubearchive/dynowatch/internal/config"
+)
+
+// reloadingTLS loads the client certificate and CA bundle from files, reloading them whenever the
+// files change. The files are checked on each new TLS handshake.
+type reloadingTLS struct {
+	serverName string
+	cert       *fileSource
+	key        *fileSource
+	ca         *fileSource
+
+	mu          sync.Mutex
+	certPEM     []byte
+	keyPEM      []byte
+	certificate *tls.Certificate
+	caPEM       []byte
+	roots       *x509.CertPool
+}
+
+func newReloadingTLSConfig(cfg *config.TLSConfig) (*tls.Config, error) {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("tls requires both cert-file and key-file for client certificates")
+	}
+	r := &reloadingTLS{
+		serverName: cfg.ServerName,
+		cert:       newFileSource(cfg.CertFile),
+		key:        newFileSource(cfg.KeyFile),
+		ca:         newFileSource(cfg.CAFile),
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.ServerName,
+		// With a CA bundle, certificates are verified against it in verifyConnection instead.
+		InsecureSkipVerify: cfg.InsecureSkipVerify || r.ca != nil,
+	}
+	if r.cert != nil {
+		if _, err := r.clientCertificate(nil); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = r.clientCertificate
+	}
+	if r.ca != nil && !cfg.InsecureSkipVerify {
+		if _, err := r.rootCAs(); err != nil {
+			return nil, err
+		}
+		tlsConfig.VerifyConnection = r.verifyConnection
+	}
+	return tlsConfig, nil
+}
+
+func (r *reloadingTLS) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certPEM, err := r.cert.Read()
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := r.key.Read()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.certificate != nil && bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM) {
+		return r.certificate, nil
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading client certificate: %w", err)
+	}
+	r.certificate = &certificate
+	r.certPEM = certPEM
+	r.keyPEM = keyPEM
+	return r.certificate, nil
+}
+
+func (r *reloadingTLS) rootCAs() (*x509.CertPool, error) {
+	caPEM, err := r.ca.Read()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.roots != nil && bytes.Equal(caPEM, r.caPEM) {
+		return r.roots, nil
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", r.ca.path)
+	}
+	r.roots = roots
+	r.caPEM = caPEM
+	return r.roots, nil
+}
+
+// verifyConnection verifies the server certificate chain against the current CA bundle. This
+// replaces the standard verification, which cannot pick up a rotated CA bundle.
+func (r *reloadingTLS) verifyConnection(state tls.ConnectionState) error {
+	roots, err := r.rootCAs()
+	if err != nil {
+		return err
+	}
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	serverName := r.serverName
+	if serverName == "" {
+		serverName = state.ServerName
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = state.PeerCertificates[0].Verify(opts)
+	return err
+}